@@ -0,0 +1,207 @@
+package gomatrix
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ASConfig is an Application Service registration, along with the callbacks used by the handler
+// returned by NewASHandler. See http://matrix.org/docs/spec/application_service/unstable.html#registration
+type ASConfig struct {
+	ID              string       `json:"id"`               // The unique ID of the application service
+	URL             string       `json:"url"`              // The URL the homeserver pushes transactions to
+	HSToken         string       `json:"hs_token"`         // The token the homeserver uses to authenticate itself
+	ASToken         string       `json:"as_token"`         // The token the application service uses to authenticate itself
+	SenderLocalpart string       `json:"sender_localpart"` // The localpart of the application service's own user
+	Namespaces      ASNamespaces `json:"namespaces"`
+
+	// OnTransaction is called once for every new transaction pushed by the homeserver. If it returns an error,
+	// the transaction is not marked as processed and the homeserver will retry it later.
+	OnTransaction func(txn *ASTransaction) error `json:"-"`
+	// OnUserQuery is called when the homeserver asks whether a user in the AS namespace exists. It should
+	// return true if the user exists, creating them first if necessary. If nil, all users are reported missing.
+	OnUserQuery func(userID string) bool `json:"-"`
+	// OnRoomQuery is called when the homeserver asks whether a room alias in the AS namespace exists. It
+	// should return true if the alias exists, creating it first if necessary. If nil, all aliases are reported missing.
+	OnRoomQuery func(roomAlias string) bool `json:"-"`
+	// TxnStore remembers which transaction IDs have been processed. If nil, an in-memory store is used.
+	TxnStore ASTxnStorer `json:"-"`
+}
+
+// ASNamespaces are the user IDs, room aliases and room IDs which an application service is interested in.
+type ASNamespaces struct {
+	Users   []ASNamespace `json:"users"`
+	Aliases []ASNamespace `json:"aliases"`
+	Rooms   []ASNamespace `json:"rooms"`
+}
+
+// ASNamespace is a single regular expression in an application service's namespaces.
+type ASNamespace struct {
+	Exclusive bool   `json:"exclusive"`
+	Regex     string `json:"regex"`
+}
+
+// LoadASConfig reads an Application Service registration YAML file. Only the callbacks need to be set
+// on the returned config before passing it to NewASHandler.
+func LoadASConfig(path string) (*ASConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config ASConfig
+	if err = unmarshalYAML(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ASTransaction is a transaction of events pushed to an Application Service by the homeserver.
+// See http://matrix.org/docs/spec/application_service/unstable.html#put-transactions-txnid
+type ASTransaction struct {
+	ID     string  `json:"-"` // The transaction ID, taken from the request path
+	Events []Event `json:"events"`
+}
+
+// ASTxnStorer is an interface which must be satisfied to deduplicate Application Service transactions.
+type ASTxnStorer interface {
+	IsTxnProcessed(txnID string) bool
+	MarkTxnProcessed(txnID string)
+}
+
+// InMemoryASTxnStore implements the ASTxnStorer interface. Seen transaction IDs are lost on restarts.
+type InMemoryASTxnStore struct {
+	mutex sync.Mutex
+	seen  map[string]bool
+}
+
+// IsTxnProcessed returns true if the transaction ID has been marked as processed.
+func (s *InMemoryASTxnStore) IsTxnProcessed(txnID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.seen[txnID]
+}
+
+// MarkTxnProcessed records the transaction ID as processed.
+func (s *InMemoryASTxnStore) MarkTxnProcessed(txnID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seen[txnID] = true
+}
+
+// NewInMemoryASTxnStore constructs a new InMemoryASTxnStore.
+func NewInMemoryASTxnStore() *InMemoryASTxnStore {
+	return &InMemoryASTxnStore{
+		seen: make(map[string]bool),
+	}
+}
+
+const asPrefix = "/_matrix/app/v1/"
+
+type asHandler struct {
+	config   *ASConfig
+	store    ASTxnStorer
+	txnMutex sync.Mutex // serialises transactions so a retried transaction is never processed twice
+}
+
+// NewASHandler returns an http.Handler which serves the homeserver-facing Application Service API. Requests
+// must be authenticated with the config's HSToken. The handler serves:
+//
+//	PUT /_matrix/app/v1/transactions/{txnID}
+//	GET /_matrix/app/v1/users/{userID}
+//	GET /_matrix/app/v1/rooms/{roomAlias}
+func NewASHandler(config *ASConfig) http.Handler {
+	store := config.TxnStore
+	if store == nil {
+		store = NewInMemoryASTxnStore()
+	}
+	return &asHandler{
+		config: config,
+		store:  store,
+	}
+}
+
+func (h *asHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !h.authenticate(w, req) {
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, asPrefix) {
+		writeASError(w, http.StatusNotFound, "M_UNRECOGNIZED", "Unrecognized request")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, asPrefix), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		writeASError(w, http.StatusNotFound, "M_UNRECOGNIZED", "Unrecognized request")
+		return
+	}
+	switch {
+	case parts[0] == "transactions" && req.Method == "PUT":
+		h.handleTransaction(w, req, parts[1])
+	case parts[0] == "users" && req.Method == "GET":
+		h.handleQuery(w, h.config.OnUserQuery, parts[1])
+	case parts[0] == "rooms" && req.Method == "GET":
+		h.handleQuery(w, h.config.OnRoomQuery, parts[1])
+	default:
+		writeASError(w, http.StatusNotFound, "M_UNRECOGNIZED", "Unrecognized request")
+	}
+}
+
+// authenticate checks the request's hs_token, writing an error response and returning false if it is invalid.
+func (h *asHandler) authenticate(w http.ResponseWriter, req *http.Request) bool {
+	token := req.URL.Query().Get("access_token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		writeASError(w, http.StatusUnauthorized, "M_UNAUTHORIZED", "Missing access token")
+		return false
+	}
+	if h.config.HSToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.config.HSToken)) != 1 {
+		writeASError(w, http.StatusForbidden, "M_FORBIDDEN", "Invalid access token")
+		return false
+	}
+	return true
+}
+
+func (h *asHandler) handleTransaction(w http.ResponseWriter, req *http.Request, txnID string) {
+	h.txnMutex.Lock()
+	defer h.txnMutex.Unlock()
+	if h.store.IsTxnProcessed(txnID) {
+		writeASResponse(w, http.StatusOK, struct{}{})
+		return
+	}
+	txn := ASTransaction{ID: txnID}
+	if err := json.NewDecoder(req.Body).Decode(&txn); err != nil {
+		writeASError(w, http.StatusBadRequest, "M_NOT_JSON", "Failed to decode transaction: "+err.Error())
+		return
+	}
+	if h.config.OnTransaction != nil {
+		if err := h.config.OnTransaction(&txn); err != nil {
+			writeASError(w, http.StatusInternalServerError, "M_UNKNOWN", err.Error())
+			return
+		}
+	}
+	h.store.MarkTxnProcessed(txnID)
+	writeASResponse(w, http.StatusOK, struct{}{})
+}
+
+func (h *asHandler) handleQuery(w http.ResponseWriter, exists func(string) bool, id string) {
+	if exists == nil || !exists(id) {
+		writeASError(w, http.StatusNotFound, "M_NOT_FOUND", id+" does not exist")
+		return
+	}
+	writeASResponse(w, http.StatusOK, struct{}{})
+}
+
+func writeASError(w http.ResponseWriter, code int, errCode, msg string) {
+	writeASResponse(w, code, RespError{ErrCode: errCode, Err: msg})
+}
+
+func writeASResponse(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,115 @@
+package gomatrix
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestASHandler_Transaction(t *testing.T) {
+	var txns []*ASTransaction
+	handler := NewASHandler(&ASConfig{
+		HSToken: "hstoken",
+		OnTransaction: func(txn *ASTransaction) error {
+			txns = append(txns, txn)
+			return nil
+		},
+	})
+
+	body := `{"events":[{"type":"m.room.message","event_id":"$foo:bar","content":{"body":"hello"}}]}`
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("PUT", "/_matrix/app/v1/transactions/1?access_token=hstoken", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("PUT transaction: got code %d, want 200", w.Code)
+		}
+	}
+	if len(txns) != 1 {
+		t.Fatalf("OnTransaction: got %d calls, want 1", len(txns))
+	}
+	if txns[0].ID != "1" || len(txns[0].Events) != 1 || txns[0].Events[0].ID != "$foo:bar" {
+		t.Fatalf("OnTransaction: unexpected transaction %+v", txns[0])
+	}
+}
+
+func TestASHandler_UserQuery(t *testing.T) {
+	handler := NewASHandler(&ASConfig{
+		HSToken: "hstoken",
+		OnUserQuery: func(userID string) bool {
+			return userID == "@bridge_alice:localhost"
+		},
+	})
+
+	testCases := []struct {
+		Path string
+		Code int
+	}{
+		{"/_matrix/app/v1/users/@bridge_alice:localhost?access_token=hstoken", http.StatusOK},
+		{"/_matrix/app/v1/users/@bridge_bob:localhost?access_token=hstoken", http.StatusNotFound},
+		{"/_matrix/app/v1/rooms/%23bridge_room:localhost?access_token=hstoken", http.StatusNotFound},
+		{"/_matrix/app/v1/users/@bridge_alice:localhost?access_token=wrong", http.StatusForbidden},
+		{"/_matrix/app/v1/users/@bridge_alice:localhost", http.StatusUnauthorized},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tc.Path, nil))
+		if w.Code != tc.Code {
+			t.Errorf("GET %s: got code %d, want %d", tc.Path, w.Code, tc.Code)
+		}
+	}
+}
+
+func TestLoadASConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "registration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# Bridge registration
+id: "bridge"
+url: http://localhost:8080
+as_token: 'as_secret'
+hs_token: hs_secret
+sender_localpart: bridgebot
+rate_limited: false
+protocols: ["irc"]
+namespaces:
+  users:
+    - exclusive: true
+      regex: "@bridge_.*:localhost"
+  aliases:
+  - exclusive: false
+    regex: '#bridge_.*:localhost' # aliases
+  rooms: []
+`)
+	f.Close()
+
+	config, err := LoadASConfig(f.Name())
+	if err != nil {
+		t.Fatalf("LoadASConfig: error, got %s", err.Error())
+	}
+	if config.ID != "bridge" || config.URL != "http://localhost:8080" || config.ASToken != "as_secret" ||
+		config.HSToken != "hs_secret" || config.SenderLocalpart != "bridgebot" {
+		t.Fatalf("LoadASConfig: unexpected config %+v", config)
+	}
+	checkASNamespaces(t, config.Namespaces)
+}
+
+// checkASNamespaces checks the namespaces of the registration file in TestLoadASConfig.
+func checkASNamespaces(t *testing.T, namespaces ASNamespaces) {
+	users := namespaces.Users
+	if len(users) != 1 || !users[0].Exclusive || users[0].Regex != "@bridge_.*:localhost" {
+		t.Fatalf("LoadASConfig: unexpected user namespaces %+v", users)
+	}
+	aliases := namespaces.Aliases
+	if len(aliases) != 1 || aliases[0].Exclusive || aliases[0].Regex != "#bridge_.*:localhost" {
+		t.Fatalf("LoadASConfig: unexpected alias namespaces %+v", aliases)
+	}
+	if len(namespaces.Rooms) != 0 {
+		t.Fatalf("LoadASConfig: unexpected room namespaces %+v", namespaces.Rooms)
+	}
+}
@@ -0,0 +1,37 @@
+package gomatrix
+
+import (
+	"math/rand"
+	"time"
+)
+
+// The default backoff parameters, see Client.RetryBaseDelay.
+const (
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = time.Minute
+	defaultRetryJitter    = 0.2
+)
+
+// backoff computes the wait before a retry: it starts at base and doubles with each attempt up to max, and is
+// then shortened by a random fraction of up to jitter, so that clients which failed together do not all retry
+// together.
+type backoff struct {
+	base   time.Duration
+	max    time.Duration
+	jitter float64 // between 0 and 1
+}
+
+// duration returns the wait before the given retry, where attempt 0 is the first retry.
+func (b backoff) duration(attempt int) time.Duration {
+	d := b.base
+	for i := 0; i < attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	if b.jitter > 0 {
+		d -= time.Duration(b.jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
@@ -0,0 +1,25 @@
+package gomatrix
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff_Duration(t *testing.T) {
+	b := backoff{base: time.Second, max: 10 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		if got := b.duration(attempt); got != want {
+			t.Errorf("duration(%d): got %s, want %s", attempt, got, want)
+		}
+	}
+	if got := b.duration(1000); got != 10*time.Second {
+		t.Errorf("duration(1000): got %s, want the maximum", got)
+	}
+
+	b.jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := b.duration(2); got < 2*time.Second || got > 4*time.Second {
+			t.Fatalf("duration(2): got %s with jitter 0.5, want between 2s and 4s", got)
+		}
+	}
+}
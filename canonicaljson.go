@@ -0,0 +1,131 @@
+package gomatrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// maxCanonicalInt is the largest integer allowed in canonical JSON, 2^53 - 1.
+const maxCanonicalInt = 1<<53 - 1
+
+// CanonicalJSON marshals v to Matrix canonical JSON: object keys sorted by code point, no insignificant whitespace,
+// strings using the shortest escapes and integers only. This is the encoding signed and hashed in Matrix, and also
+// gives a stable encoding for comparing or hashing event content. It returns an error if v contains a number which
+// is not an integer in the range [-(2^53)+1, (2^53)-1].
+// See https://matrix.org/docs/spec/appendices#canonical-json
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var value interface{}
+	if err = dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = writeCanonicalJSON(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		return writeCanonicalJSONNumber(buf, v)
+	case string:
+		writeCanonicalJSONString(buf, v)
+	case []interface{}:
+		return writeCanonicalJSONArray(buf, v)
+	case map[string]interface{}:
+		return writeCanonicalJSONObject(buf, v)
+	default:
+		return fmt.Errorf("canonical json: unexpected type %T", value)
+	}
+	return nil
+}
+
+func writeCanonicalJSONNumber(buf *bytes.Buffer, v json.Number) error {
+	n, err := strconv.ParseInt(v.String(), 10, 64)
+	if err != nil || n > maxCanonicalInt || n < -maxCanonicalInt {
+		return fmt.Errorf("canonical json: %s is not an integer in the range [-(2^53)+1, (2^53)-1]", v)
+	}
+	buf.WriteString(strconv.FormatInt(n, 10))
+	return nil
+}
+
+func writeCanonicalJSONArray(buf *bytes.Buffer, v []interface{}) error {
+	buf.WriteByte('[')
+	for i, elem := range v {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := writeCanonicalJSON(buf, elem); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+func writeCanonicalJSONObject(buf *bytes.Buffer, v map[string]interface{}) error {
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	// Byte order of UTF-8 strings is the same as code point order.
+	sort.Strings(keys)
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeCanonicalJSONString(buf, key)
+		buf.WriteByte(':')
+		if err := writeCanonicalJSON(buf, v[key]); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// writeCanonicalJSONString writes s as a JSON string, escaping only quotes, backslashes and control characters as
+// canonical JSON requires. encoding/json cannot be used for this as it also escapes <, > and &, and U+2028/U+2029.
+func writeCanonicalJSONString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
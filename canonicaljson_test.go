@@ -0,0 +1,36 @@
+package gomatrix
+
+import "testing"
+
+func TestCanonicalJSON(t *testing.T) {
+	testCases := []struct {
+		Input interface{}
+		Want  string
+	}{
+		{map[string]interface{}{}, `{}`},
+		{map[string]interface{}{"one": 1, "two": "Two"}, `{"one":1,"two":"Two"}`},
+		{map[string]interface{}{"b": "2", "a": "1"}, `{"a":"1","b":"2"}`},
+		{map[string]interface{}{"auth": map[string]interface{}{"success": true, "mxid": "@john.doe:example.com"}}, `{"auth":{"mxid":"@john.doe:example.com","success":true}}`},
+		{map[string]interface{}{"本": 2, "日": 1}, `{"日":1,"本":2}`},
+		{map[string]interface{}{"a": "日本語"}, `{"a":"日本語"}`},
+		{map[string]interface{}{"a": "<&> ", "b": "\"\\\n\x01"}, `{"a":"<&>` + " " + `","b":"\"\\\n\u0001"}`},
+		{map[string]interface{}{"a": nil, "b": []interface{}{1, false}}, `{"a":null,"b":[1,false]}`},
+		{struct {
+			Z int    `json:"z"`
+			A string `json:"a,omitempty"`
+		}{Z: -9007199254740991}, `{"z":-9007199254740991}`},
+	}
+	for _, tc := range testCases {
+		got, err := CanonicalJSON(tc.Input)
+		if err != nil {
+			t.Errorf("CanonicalJSON(%v): returned error: %s", tc.Input, err)
+		} else if string(got) != tc.Want {
+			t.Errorf("CanonicalJSON(%v): got %s, want %s", tc.Input, got, tc.Want)
+		}
+	}
+	for _, input := range []interface{}{1.5, 9007199254740992, map[string]interface{}{"a": []float64{1e100}}} {
+		if got, err := CanonicalJSON(input); err == nil {
+			t.Errorf("CanonicalJSON(%v): got %s, want an error for a non-integer or out of range number", input, got)
+		}
+	}
+}
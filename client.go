@@ -4,16 +4,24 @@
 package gomatrix
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,24 +31,195 @@ type Client struct {
 	Prefix        string       // The API prefix eg '/_matrix/client/r0'
 	UserID        string       // The user ID of the client. Used for forming HTTP paths which use the client's user ID.
 	AccessToken   string       // The access_token for the client.
+	DeviceID      string       // The device ID of the client. Used when sending to-device events which identify the sender's device.
 	Client        *http.Client // The underlying HTTP client which will be used to make HTTP requests.
 	Syncer        Syncer       // The thing which can process /sync responses
 	Store         Storer       // The thing which can store rooms/tokens/ids
 
+	// The User-Agent header sent with every request. Defaults to DefaultUserAgent.
+	UserAgent string
+
 	// The ?user_id= query parameter for application services. This must be set *prior* to calling a method. If this is empty,
 	// no user_id parameter will be sent.
 	// See http://matrix.org/docs/spec/application_service/unstable.html#identity-assertion
 	AppServiceUserID string
 
-	syncingMutex sync.Mutex // protects syncingID
-	syncingID    uint32     // Identifies the current Sync. Only one Sync can be active at any given time.
+	// The as_token of an application service. If this is set, it is sent as a Bearer token in the Authorization
+	// header instead of sending AccessToken. See AsUser to act on behalf of the application service's users.
+	ASToken string
+
+	// The maximum number of requests SendBatch makes at once. If this is not positive, events are sent one at a time.
+	MaxConcurrency int
+
+	// If true, UploadToContentRepo and SendFileFromReader check the homeserver's upload size limit with
+	// GetMediaConfig before uploading content of a known length, and return ErrFileTooLarge instead of uploading
+	// content which is too large.
+	CheckMediaLimits bool
+
+	// The path version used by MakeVersionedRequest when the homeserver does not support the preferred
+	// version, e.g. "r0". If empty, "r0" is used.
+	APIVersion string
+
+	// Whether the media helpers (DownloadAuthed, GetMediaConfig) use the authenticated /_matrix/client/v1/media
+	// endpoints or the legacy /_matrix/media ones. Defaults to MediaEndpointsAuto.
+	MediaEndpoints MediaEndpoints
+
+	// The long-poll timeout of each /sync request made by Sync. Defaults to 30 seconds.
+	SyncTimeout time.Duration
+	// How long after SyncTimeout Sync waits for a /sync response before cancelling the request and retrying, so that
+	// a connection which stalls silently (e.g. after a network partition) does not hang Sync forever. Defaults to
+	// 30 seconds. If negative, requests are never cancelled.
+	SyncWatchdogSlack time.Duration
+
+	// OnSyncProcessed is called by Sync with the next_batch token of each /sync response once the Syncer has
+	// processed it, e.g. to checkpoint the sync position alongside the application's own state. See NextBatch.
+	OnSyncProcessed func(nextBatch string)
+
+	// The identity server used for third party identifier lookups, e.g. https://vector.im, and the access token
+	// for it. Identity server access tokens are separate from homeserver access tokens.
+	IdentityServerURL   *url.URL
+	IdentityAccessToken string
+
+	// TermsCallback is called by AcceptIdentityServerTerms when the identity server has terms which the user has
+	// not accepted yet. It should return true to accept them.
+	TermsCallback func(terms *RespTerms) bool
+
+	// How long GetRoomIDForAlias caches each alias lookup. Defaults to 5 minutes. If negative, lookups are not cached.
+	AliasCacheTTL time.Duration
+
+	// The number of rooms StreamPublicRooms requests in each page of the room directory. Defaults to 100.
+	PublicRoomsPageSize int
+
+	// The maximum size of a response body read by MakeRequest and the other JSON requests, in bytes. Larger
+	// responses fail with ErrResponseTooLarge, so a broken or malicious server cannot make the client run out of
+	// memory. Media downloads, which are streamed to the caller, are not limited. If not positive, there is no limit.
+	MaxResponseBytes int
+
+	// The number of times MakeRequest retries an idempotent request which fails with a transient network error, e.g.
+	// a connection reset or a timeout, or with a 429, 502, 503 or 504 response. Idempotent requests are GETs and
+	// HEADs, except for /sync which the sync loop retries itself, and PUTs with a transaction ID, i.e. message
+	// sends, redactions and to-device sends. A 429 is retried no sooner than the server asked. Other errors,
+	// including certificate errors and other 4xx responses, are never retried. Defaults to 0, which disables retries.
+	RequestRetries int
+
+	// The backoff between retries of failed requests (see RequestRetries) and, with the DefaultSyncer created by
+	// NewClient, of failed /sync requests. The first retry waits RetryBaseDelay (defaults to 1 second), each later
+	// retry waits twice as long up to RetryMaxDelay (defaults to 1 minute), and each wait is shortened by a random
+	// fraction of up to RetryJitter (defaults to 0.2, or no jitter if negative) so that clients do not retry in step.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	RetryJitter    float64
+
+	credentialsMutex sync.RWMutex // protects UserID and AccessToken against SetCredentials and ClearCredentials
+
+	syncingMutex  sync.Mutex         // protects syncingID, syncingCtx and syncingCancel
+	syncingID     uint32             // Identifies the current Sync. Only one Sync can be active at any given time.
+	syncingCtx    context.Context    // Done when the current Sync is stopped
+	syncingCancel context.CancelFunc // cancels syncingCtx
+
+	nextBatchMutex sync.Mutex // protects nextBatch
+	nextBatch      string     // The next_batch token of the last processed /sync response
+
+	versionsMutex    sync.Mutex      // protects versions and unstableFeatures
+	versions         []string        // The homeserver's supported spec versions, or nil if they haven't been fetched yet.
+	unstableFeatures map[string]bool // The homeserver's unstable features, fetched along with versions.
+
+	capabilitiesMutex sync.Mutex        // protects capabilities
+	capabilities      *RespCapabilities // The homeserver's capabilities, or nil if they haven't been fetched yet.
+
+	aliasCacheMutex sync.Mutex                 // protects aliasCache
+	aliasCache      map[string]aliasCacheEntry // GetRoomIDForAlias results by alias
+}
+
+type aliasCacheEntry struct {
+	resp    RespAliasLookup
+	expires time.Time
 }
 
+// MediaEndpoints selects which media endpoints the media helpers use.
+type MediaEndpoints int
+
+const (
+	// MediaEndpointsAuto uses the authenticated media endpoints if the homeserver advertises spec version v1.11 or
+	// the stable MSC3916 unstable feature, and the legacy endpoints otherwise.
+	MediaEndpointsAuto MediaEndpoints = iota
+	// MediaEndpointsAuthenticated always uses the authenticated media endpoints.
+	MediaEndpointsAuthenticated
+	// MediaEndpointsLegacy always uses the legacy unauthenticated media endpoints.
+	MediaEndpointsLegacy
+)
+
+// Version is the version of gomatrix.
+const Version = "0.1.0"
+
+// DefaultUserAgent is the User-Agent sent by clients which do not set Client.UserAgent.
+const DefaultUserAgent = "gomatrix/" + Version
+
+// ErrFileTooLarge is returned when uploading content which is larger than the homeserver's upload size limit.
+// See Client.CheckMediaLimits.
+var ErrFileTooLarge = errors.New("file is larger than the homeserver's upload size limit")
+
+// ErrResponseTooLarge is returned when a response body is larger than Client.MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("response body is larger than Client.MaxResponseBytes")
+
+// KeyServerCapability is the capability a homeserver advertises when it supports GetKeyServerUserKeys.
+const KeyServerCapability = "org.matrix.msc3814.key_server"
+
+// ErrKeyServerUnsupported is returned by GetKeyServerUserKeys when the homeserver does not advertise KeyServerCapability.
+var ErrKeyServerUnsupported = errors.New("homeserver does not support the key server API")
+
+// ErrInvalidGuestAccess is returned by SetRoomGuestAccess for a value other than GuestAccessCanJoin or
+// GuestAccessForbidden.
+var ErrInvalidGuestAccess = errors.New("guest access must be \"can_join\" or \"forbidden\"")
+
+// The values of the guest_access key of m.room.guest_access events.
+const (
+	GuestAccessCanJoin   = "can_join"
+	GuestAccessForbidden = "forbidden"
+)
+
+// ErrInvalidHistoryVisibility is returned by SetHistoryVisibility for a value other than the HistoryVisibility
+// constants.
+var ErrInvalidHistoryVisibility = errors.New("history visibility must be \"world_readable\", \"shared\", \"invited\" or \"joined\"")
+
+// The values of the history_visibility key of m.room.history_visibility events.
+const (
+	HistoryVisibilityWorldReadable = "world_readable"
+	HistoryVisibilityShared        = "shared"
+	HistoryVisibilityInvited       = "invited"
+	HistoryVisibilityJoined        = "joined"
+)
+
+// ErrEncryptionAlreadyEnabled is returned by EnableEncryption if the room already has an m.room.encryption state
+// event. Encryption cannot be disabled or changed once it is enabled.
+var ErrEncryptionAlreadyEnabled = errors.New("encryption is already enabled in this room")
+
+// ErrServerACLDeniesOwnServer is returned by SetServerACL for an ACL which does not allow the client's own homeserver.
+var ErrServerACLDeniesOwnServer = errors.New("server ACL does not allow the client's own homeserver")
+
+// ErrNoTombstone is returned by FollowTombstone if the room has not been upgraded.
+var ErrNoTombstone = errors.New("room has no tombstone")
+
+// maxTombstoneHops is the maximum number of upgrades FollowTombstone follows, in case of a tombstone cycle.
+const maxTombstoneHops = 10
+
 // HTTPError An HTTP Error response, which may wrap an underlying native Go Error.
 type HTTPError struct {
 	WrappedError error
 	Message      string
 	Code         int
+	// RetryAfterMS is how long the server asked the client to wait before retrying, in milliseconds, from the
+	// Retry-After header or the retry_after_ms field of an M_LIMIT_EXCEEDED error. 0 if the server did not say.
+	RetryAfterMS int64
+}
+
+// retryAfter returns how long the server asked the client to wait before retrying a request which failed with err,
+// or 0 if err is not an HTTPError with RetryAfterMS set.
+func retryAfter(err error) time.Duration {
+	if httpErr, ok := err.(HTTPError); ok {
+		return time.Duration(httpErr.RetryAfterMS) * time.Millisecond
+	}
+	return 0
 }
 
 func (e HTTPError) Error() string {
@@ -51,7 +230,63 @@ func (e HTTPError) Error() string {
 	return fmt.Sprintf("msg=%s code=%d wrapped=%s", e.Message, e.Code, wrappedErrMsg)
 }
 
+// StateEventsError is returned by SendStateEvents when sending one or more state events failed.
+type StateEventsError struct {
+	Errors []error // The error for each attempted event, in order. nil for events which were sent.
+}
+
+// Error summarises the failures, giving the number of events which failed and the first error.
+func (e StateEventsError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("failed to send %d of %d state events: %s", failed, len(e.Errors), first)
+}
+
+// SendFileError is returned by SendFileFromReader when the content was uploaded but the message could not be sent.
+// The message can be sent again with ContentURI without uploading the content again.
+type SendFileError struct {
+	ContentURI string // The mxc:// URI of the uploaded content
+	Err        error  // The error from sending the message
+}
+
+// Error returns the uploaded content's mxc:// URI along with the error from sending the message.
+func (e SendFileError) Error() string {
+	return fmt.Sprintf("uploaded %s but failed to send it: %s", e.ContentURI, e.Err)
+}
+
+// Unwrap returns the error from sending the message.
+func (e SendFileError) Unwrap() error {
+	return e.Err
+}
+
+// ProfileNotUpdatedError is returned by SetDisplayNameVerified and SetAvatarURLVerified when the homeserver
+// accepted a profile change but the profile does not reflect it afterwards.
+type ProfileNotUpdatedError struct {
+	Field string // "displayname" or "avatar_url"
+	Want  string // The value which was set
+	Got   string // The value fetched afterwards
+}
+
+// Error returns the profile field with the value which was set and the value fetched afterwards.
+func (e ProfileNotUpdatedError) Error() string {
+	return fmt.Sprintf("profile %s was not updated: set %q but got %q", e.Field, e.Want, e.Got)
+}
+
 // BuildURL builds a URL with the Client's homserver/prefix/access_token set already.
+//
+// Together with BuildBaseURL, BuildURLWithQuery, MakeRequest and DoRaw, this can be used to call endpoints which
+// the Client does not wrap yet, such as unstable or custom endpoints:
+//
+//	u := cli.BuildBaseURL("_matrix", "client", "unstable", "org.example.feature", "rooms", roomID)
+//	raw, err := cli.DoRaw("GET", u, nil)
 func (cli *Client) BuildURL(urlPath ...string) string {
 	ps := []string{cli.Prefix}
 	for _, p := range urlPath {
@@ -69,8 +304,8 @@ func (cli *Client) BuildBaseURL(urlPath ...string) string {
 	parts = append(parts, urlPath...)
 	hsURL.Path = path.Join(parts...)
 	query := hsURL.Query()
-	if cli.AccessToken != "" {
-		query.Set("access_token", cli.AccessToken)
+	if accessToken := cli.accessToken(); accessToken != "" && cli.ASToken == "" {
+		query.Set("access_token", accessToken)
 	}
 	if cli.AppServiceUserID != "" {
 		query.Set("user_id", cli.AppServiceUserID)
@@ -90,16 +325,70 @@ func (cli *Client) BuildURLWithQuery(urlPath []string, urlQuery map[string]strin
 	return u.String()
 }
 
-// SetCredentials sets the user ID and access token on this client instance.
+// AsUser returns a shallow copy of this client which acts on behalf of the given application service user, by
+// adding ?user_id= to every request. The copy shares the HTTP client, Syncer and Store with this client, so
+// it should only be used to make requests and not to Sync.
+func (cli *Client) AsUser(userID string) *Client {
+	return &Client{
+		HomeserverURL:    cli.HomeserverURL,
+		Prefix:           cli.Prefix,
+		UserID:           userID,
+		AccessToken:      cli.accessToken(),
+		DeviceID:         cli.DeviceID,
+		Client:           cli.Client,
+		Syncer:           cli.Syncer,
+		Store:            cli.Store,
+		AppServiceUserID: userID,
+		ASToken:          cli.ASToken,
+		UserAgent:        cli.UserAgent,
+		APIVersion:       cli.APIVersion,
+		MaxConcurrency:   cli.MaxConcurrency,
+		CheckMediaLimits: cli.CheckMediaLimits,
+		MediaEndpoints:   cli.MediaEndpoints,
+
+		SyncTimeout:       cli.SyncTimeout,
+		SyncWatchdogSlack: cli.SyncWatchdogSlack,
+
+		IdentityServerURL:   cli.IdentityServerURL,
+		IdentityAccessToken: cli.IdentityAccessToken,
+		TermsCallback:       cli.TermsCallback,
+		AliasCacheTTL:       cli.AliasCacheTTL,
+		PublicRoomsPageSize: cli.PublicRoomsPageSize,
+		MaxResponseBytes:    cli.MaxResponseBytes,
+		RequestRetries:      cli.RequestRetries,
+		RetryBaseDelay:      cli.RetryBaseDelay,
+		RetryMaxDelay:       cli.RetryMaxDelay,
+		RetryJitter:         cli.RetryJitter,
+	}
+}
+
+// SetCredentials sets the user ID and access token on this client instance. It is safe to call while Sync is
+// running, e.g. to rotate the access token: requests which have already been built keep using the old token.
 func (cli *Client) SetCredentials(userID, accessToken string) {
+	cli.credentialsMutex.Lock()
+	defer cli.credentialsMutex.Unlock()
 	cli.AccessToken = accessToken
 	cli.UserID = userID
 }
 
-// ClearCredentials removes the user ID and access token on this client instance.
+// ClearCredentials removes the user ID and access token on this client instance. Like SetCredentials, it is
+// safe to call while Sync is running.
 func (cli *Client) ClearCredentials() {
-	cli.AccessToken = ""
-	cli.UserID = ""
+	cli.SetCredentials("", "")
+}
+
+// userID returns the client's user ID, guarded against concurrent calls to SetCredentials.
+func (cli *Client) userID() string {
+	cli.credentialsMutex.RLock()
+	defer cli.credentialsMutex.RUnlock()
+	return cli.UserID
+}
+
+// accessToken returns the client's access token, guarded against concurrent calls to SetCredentials.
+func (cli *Client) accessToken() string {
+	cli.credentialsMutex.RLock()
+	defer cli.credentialsMutex.RUnlock()
+	return cli.AccessToken
 }
 
 // Sync starts syncing with the provided Homeserver. If Sync() is called twice then the first sync will be stopped and the
@@ -115,27 +404,45 @@ func (cli *Client) Sync() error {
 	// Mark the client as syncing.
 	// We will keep syncing until the syncing state changes. Either because
 	// Sync is called or StopSync is called.
-	syncingID := cli.incrementSyncingID()
-	nextBatch := cli.Store.LoadNextBatch(cli.UserID)
-	filterID := cli.Store.LoadFilterID(cli.UserID)
-	if filterID == "" {
-		filterJSON := cli.Syncer.GetFilterJSON(cli.UserID)
-		resFilter, err := cli.CreateFilter(filterJSON)
-		if err != nil {
-			return err
-		}
-		filterID = resFilter.FilterID
-		cli.Store.SaveFilterID(cli.UserID, filterID)
+	syncingID, ctx := cli.incrementSyncingID()
+	return cli.sync(ctx, syncingID)
+}
+
+// SyncFrom is like Sync, but starts syncing from the given since token instead of the one in the Store, e.g.
+// when restoring from a snapshot which knows the right token, or to replay events from a known position. The
+// token is saved to the Store straight away, and the Store is kept up to date from then on as usual.
+func (cli *Client) SyncFrom(since string) error {
+	syncingID, ctx := cli.incrementSyncingID()
+	cli.Store.SaveNextBatch(cli.userID(), since)
+	return cli.syncFrom(ctx, syncingID, since)
+}
+
+// sync runs the sync loop from the stored since token until the syncing ID is no longer syncingID or a fatal
+// error occurs.
+func (cli *Client) sync(ctx context.Context, syncingID uint32) error {
+	return cli.syncFrom(ctx, syncingID, cli.Store.LoadNextBatch(cli.userID()))
+}
+
+// syncFrom runs the sync loop from the given since token. ctx is done when the sync is stopped.
+func (cli *Client) syncFrom(ctx context.Context, syncingID uint32, nextBatch string) error {
+	filterID, err := cli.loadOrCreateFilterID()
+	if err != nil {
+		return err
 	}
 
 	for {
-		resSync, err := cli.SyncRequest(30000, nextBatch, filterID, false, "")
+		resSync, err := cli.watchedSyncRequest(ctx, nextBatch, filterID)
+		receivedAt := time.Now()
+		if err == errSyncStalled {
+			if ctx.Err() != nil || cli.getSyncingID() != syncingID {
+				return nil
+			}
+			continue
+		}
 		if err != nil {
-			duration, err2 := cli.Syncer.OnFailedSync(resSync, err)
-			if err2 != nil {
-				return err2
+			if retry, stopErr := cli.retrySync(ctx, syncingID, resSync, err); !retry {
+				return stopErr
 			}
-			time.Sleep(duration)
 			continue
 		}
 
@@ -149,20 +456,145 @@ func (cli *Client) Sync() error {
 		// Save the token now *before* processing it. This means it's possible
 		// to not process some events, but it means that we won't get constantly stuck processing
 		// a malformed/buggy event which keeps making us panic.
-		cli.Store.SaveNextBatch(cli.UserID, resSync.NextBatch)
-		if err = cli.Syncer.ProcessResponse(resSync, nextBatch); err != nil {
+		cli.Store.SaveNextBatch(cli.userID(), resSync.NextBatch)
+		err = cli.Syncer.ProcessResponse(&SyncBatch{Response: resSync, Since: nextBatch, ReceivedAt: receivedAt})
+		if err != nil {
 			return err
 		}
 
 		nextBatch = resSync.NextBatch
+		cli.setNextBatch(nextBatch)
+		if cli.OnSyncProcessed != nil {
+			cli.OnSyncProcessed(nextBatch)
+		}
+	}
+}
+
+// retrySync calls the Syncer's OnFailedSync for a failed /sync request and waits for the duration it returns. It
+// returns false and the error to return from the sync loop if syncing has stopped or should stop.
+func (cli *Client) retrySync(ctx context.Context, syncingID uint32, resSync *RespSync, err error) (bool, error) {
+	duration, err := cli.Syncer.OnFailedSync(ctx, resSync, err)
+	if cli.getSyncingID() != syncingID {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	select {
+	case <-time.After(duration):
+		return true, nil
+	case <-ctx.Done(): // stopped while waiting to retry
+		return false, nil
+	}
+}
+
+// NextBatch returns the next_batch token of the last /sync response processed by Sync, or returned by
+// InitialSync, or "" if there hasn't been one yet.
+func (cli *Client) NextBatch() string {
+	cli.nextBatchMutex.Lock()
+	defer cli.nextBatchMutex.Unlock()
+	return cli.nextBatch
+}
+
+func (cli *Client) setNextBatch(nextBatch string) {
+	cli.nextBatchMutex.Lock()
+	defer cli.nextBatchMutex.Unlock()
+	cli.nextBatch = nextBatch
+}
+
+// errSyncStalled is returned by watchedSyncRequest when the watchdog cancelled a stalled /sync request.
+var errSyncStalled = errors.New("sync request stalled")
+
+// watchedSyncRequest makes a /sync request with Client.SyncTimeout, cancelling it if no response has arrived
+// Client.SyncWatchdogSlack after the timeout. The request is also cancelled when ctx is done.
+func (cli *Client) watchedSyncRequest(ctx context.Context, since, filterID string) (*RespSync, error) {
+	timeout := cli.SyncTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	slack := cli.SyncWatchdogSlack
+	if slack == 0 {
+		slack = 30 * time.Second
+	}
+	reqCtx := ctx
+	if slack > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, timeout+slack)
+		defer cancel()
+	}
+	resp, err := cli.syncRequest(reqCtx, int(timeout/time.Millisecond), since, filterID, false, "")
+	if err != nil && ctx.Err() == nil && reqCtx.Err() == context.DeadlineExceeded {
+		return nil, errSyncStalled
+	}
+	return resp, err
+}
+
+// InitialSync makes a single full-state /sync request with since="" and returns the response without starting
+// the sync loop or passing the response to the Syncer. This lets callers initialise room and member state
+// before calling Sync(). The filter is created from Client.Syncer.GetFilterJSON in the same way as Sync().
+//
+// The next_batch token is saved to the Store, so a subsequent Sync() will only see events after this response.
+func (cli *Client) InitialSync() (*RespSync, error) {
+	filterID, err := cli.loadOrCreateFilterID()
+	if err != nil {
+		return nil, err
+	}
+	resSync, err := cli.SyncRequest(0, "", filterID, true, "")
+	if err != nil {
+		return nil, err
+	}
+	cli.Store.SaveNextBatch(cli.userID(), resSync.NextBatch)
+	cli.setNextBatch(resSync.NextBatch)
+	return resSync, nil
+}
+
+// PollSync makes exactly one /sync request with the given long-poll timeout and returns the response along with
+// its next_batch token. The since token and filter ID are read from the Store, but unlike Sync the response is
+// not passed to the Syncer and the next_batch token is not saved: callers which drive the sync state machine
+// themselves must save it before the next call.
+func (cli *Client) PollSync(ctx context.Context, timeout time.Duration) (*RespSync, string, error) {
+	query := map[string]string{
+		"timeout": strconv.FormatInt(int64(timeout/time.Millisecond), 10),
+	}
+	if since := cli.Store.LoadNextBatch(cli.userID()); since != "" {
+		query["since"] = since
+	}
+	if filterID := cli.Store.LoadFilterID(cli.userID()); filterID != "" {
+		query["filter"] = filterID
+	}
+	var resp RespSync
+	if _, err := cli.makeRequestWithContext(ctx, "GET", cli.BuildURLWithQuery([]string{"sync"}, query), nil, &resp); err != nil {
+		return nil, "", err
+	}
+	return &resp, resp.NextBatch, nil
+}
+
+// loadOrCreateFilterID returns the stored filter ID for the client's user, creating and storing one
+// from the Syncer's filter JSON if there isn't one.
+func (cli *Client) loadOrCreateFilterID() (string, error) {
+	filterID := cli.Store.LoadFilterID(cli.userID())
+	if filterID != "" {
+		return filterID, nil
+	}
+	filterJSON := cli.Syncer.GetFilterJSON(cli.userID())
+	resFilter, err := cli.CreateFilter(filterJSON)
+	if err != nil {
+		return "", err
 	}
+	cli.Store.SaveFilterID(cli.userID(), resFilter.FilterID)
+	return resFilter.FilterID, nil
 }
 
-func (cli *Client) incrementSyncingID() uint32 {
+// incrementSyncingID stops the current Sync, if any, and returns the ID and context for the next one.
+func (cli *Client) incrementSyncingID() (uint32, context.Context) {
 	cli.syncingMutex.Lock()
 	defer cli.syncingMutex.Unlock()
+	if cli.syncingCancel != nil {
+		cli.syncingCancel()
+	}
+	cli.syncingCtx, cli.syncingCancel = context.WithCancel(context.Background())
 	cli.syncingID++
-	return cli.syncingID
+	return cli.syncingID, cli.syncingCtx
 }
 
 func (cli *Client) getSyncingID() uint32 {
@@ -171,10 +603,14 @@ func (cli *Client) getSyncingID() uint32 {
 	return cli.syncingID
 }
 
-// StopSync stops the ongoing sync started by Sync.
+// StopSync stops the ongoing sync started by Sync. If the Syncer implements io.Closer, e.g. DefaultSyncer, it is
+// closed.
 func (cli *Client) StopSync() {
 	// Advance the syncing state so that any running Syncs will terminate.
 	cli.incrementSyncingID()
+	if closer, ok := cli.Syncer.(io.Closer); ok {
+		closer.Close()
+	}
 }
 
 // MakeRequest makes a JSON HTTP request to the given URL.
@@ -184,14 +620,184 @@ func (cli *Client) StopSync() {
 // with the HTTP body bytes if it got that far. This error is an HTTPError which includes the returned
 // HTTP status code and possibly a RespError as the WrappedError, if the HTTP body could be decoded as a RespError.
 func (cli *Client) MakeRequest(method string, httpURL string, reqBody interface{}, resBody interface{}) ([]byte, error) {
-	var req *http.Request
-	var err error
+	return cli.makeRequestWithContext(context.Background(), method, httpURL, reqBody, resBody)
+}
+
+// DoRaw makes a JSON HTTP request to a URL built with BuildURL, BuildBaseURL or BuildURLWithQuery and returns
+// the raw JSON response body. The body, if not nil, is encoded with json.Marshal. Authentication and errors are
+// handled in the same way as MakeRequest.
+func (cli *Client) DoRaw(method, fullURL string, body interface{}) (json.RawMessage, error) {
+	contents, err := cli.MakeRequest(method, fullURL, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(contents), nil
+}
+
+// MakeCustomRequest makes a JSON HTTP request to a path relative to the homeserver URL, such as an unstable MSC or
+// Synapse admin API endpoint which does not follow the Client's Prefix. The query parameters are added to the
+// access token and user ID which the Client sets. reqBody and resBody are handled as by MakeRequest, and may be nil.
+//
+//	var resp struct {
+//		Rooms []struct{ RoomID string `json:"room_id"` } `json:"rooms"`
+//	}
+//	err := cli.MakeCustomRequest(ctx, "GET", "/_synapse/admin/v1/rooms", url.Values{"limit": {"10"}}, nil, &resp)
+func (cli *Client) MakeCustomRequest(ctx context.Context, method, urlPath string, query url.Values, reqBody, resBody interface{}) error {
+	u, _ := url.Parse(cli.BuildBaseURL(urlPath))
+	q := u.Query()
+	for key, values := range query {
+		for _, value := range values {
+			q.Add(key, value)
+		}
+	}
+	u.RawQuery = q.Encode()
+	_, err := cli.makeRequestWithContext(ctx, method, u.String(), reqBody, resBody)
+	return err
+}
+
+// retryAfterMS returns how long an error response asks the client to wait before retrying, in milliseconds. The
+// Retry-After header, either in seconds or as an HTTP date, takes precedence over the deprecated retry_after_ms
+// field of the JSON body. Returns 0 if neither is present.
+func retryAfterMS(res *http.Response, body []byte) int64 {
+	if header := res.Header.Get("Retry-After"); header != "" {
+		if seconds, err := strconv.ParseInt(header, 10, 64); err == nil && seconds >= 0 {
+			return seconds * 1000
+		}
+		if date, err := http.ParseTime(header); err == nil {
+			if wait := time.Until(date); wait > 0 {
+				return int64(wait / time.Millisecond)
+			}
+			return 0
+		}
+	}
+	var respErr struct {
+		RetryAfterMS int64 `json:"retry_after_ms"`
+	}
+	if json.Unmarshal(body, &respErr) == nil && respErr.RetryAfterMS > 0 {
+		return respErr.RetryAfterMS
+	}
+	return 0
+}
+
+// readResponseBody reads a response body, returning ErrResponseTooLarge if it is larger than MaxResponseBytes.
+func (cli *Client) readResponseBody(body io.Reader) ([]byte, error) {
+	if cli.MaxResponseBytes <= 0 {
+		return ioutil.ReadAll(body)
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(body, int64(cli.MaxResponseBytes)+1))
+	if err == nil && len(contents) > cli.MaxResponseBytes {
+		return nil, ErrResponseTooLarge
+	}
+	return contents, err
+}
+
+// makeRequestWithContext is MakeRequest with a context which can cancel the request. Idempotent requests are
+// retried according to RequestRetries, waiting at least as long as the server asked to.
+func (cli *Client) makeRequestWithContext(ctx context.Context, method string, httpURL string, reqBody interface{}, resBody interface{}) ([]byte, error) {
+	var jsonStr []byte
 	if reqBody != nil {
-		var jsonStr []byte
-		jsonStr, err = json.Marshal(reqBody)
-		if err != nil {
+		var err error
+		if jsonStr, err = json.Marshal(reqBody); err != nil {
 			return nil, err
 		}
+	}
+	retries := 0
+	if isRetryableRequest(method, httpURL) {
+		retries = cli.RequestRetries
+	}
+	for attempt := 0; ; attempt++ {
+		contents, err := cli.makeRequestOnce(ctx, method, httpURL, jsonStr, resBody)
+		if attempt >= retries || ctx.Err() != nil || !isTransientError(err) {
+			return contents, err
+		}
+		select {
+		case <-time.After(cli.retryWait(attempt, err)):
+		case <-ctx.Done():
+			return contents, err
+		}
+	}
+}
+
+// txnPathRegex matches the paths which end in a transaction ID: sending a message event, redacting an event and
+// sending to-device events. The homeserver ignores a repeated PUT with the same transaction ID.
+var txnPathRegex = regexp.MustCompile(`/(rooms/[^/]+/(send|redact)/[^/]+|sendToDevice/[^/]+)/[^/]+$`)
+
+// isRetryableRequest returns true if a request is idempotent, so that makeRequestWithContext may retry it: a GET or
+// HEAD, or a PUT with a transaction ID. /sync requests are not retried here, as the sync loop retries them with its
+// own backoff.
+func isRetryableRequest(method, httpURL string) bool {
+	u, err := url.Parse(httpURL)
+	if err != nil {
+		return false
+	}
+	switch method {
+	case "GET", "HEAD":
+		return !strings.HasSuffix(u.Path, "/sync")
+	case "PUT":
+		return txnPathRegex.MatchString(u.EscapedPath())
+	}
+	return false
+}
+
+// retryWait returns how long to wait before retrying a request after the given attempt failed with err: the
+// backoff, or longer if the server asked to wait longer.
+func (cli *Client) retryWait(attempt int, err error) time.Duration {
+	wait := cli.retryBackoff().duration(attempt)
+	if floor := retryAfter(err); wait < floor {
+		return floor
+	}
+	return wait
+}
+
+// retryBackoff returns the backoff configured by RetryBaseDelay, RetryMaxDelay and RetryJitter.
+func (cli *Client) retryBackoff() backoff {
+	b := backoff{base: cli.RetryBaseDelay, max: cli.RetryMaxDelay, jitter: cli.RetryJitter}
+	if b.base <= 0 {
+		b.base = defaultRetryBaseDelay
+	}
+	if b.max <= 0 {
+		b.max = defaultRetryMaxDelay
+	}
+	if b.jitter == 0 {
+		b.jitter = defaultRetryJitter
+	}
+	return b
+}
+
+// isTransientError returns true if a request failed in a way which may succeed if it is retried: a network error
+// such as a connection reset or a timeout, a rate limit, or a gateway error from a proxy in front of the homeserver.
+func isTransientError(err error) bool {
+	switch e := err.(type) {
+	case *url.Error:
+		return isTransientNetError(e.Err)
+	case HTTPError:
+		switch e.Code {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientNetError returns true for errors from the HTTP transport which may not happen again, as opposed to
+// e.g. an invalid certificate or an unsupported URL scheme.
+func isTransientNetError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF { // the connection was closed by the server or a proxy
+		return true
+	}
+	if opErr, ok := err.(*net.OpError); ok && (opErr.Op == "dial" || opErr.Op == "read" || opErr.Op == "write") {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && (netErr.Timeout() || netErr.Temporary())
+}
+
+// makeRequestOnce makes a single attempt at a request for makeRequestWithContext. jsonStr is nil if there is no
+// request body.
+func (cli *Client) makeRequestOnce(ctx context.Context, method string, httpURL string, jsonStr []byte, resBody interface{}) ([]byte, error) {
+	var req *http.Request
+	var err error
+	if jsonStr != nil {
 		req, err = http.NewRequest(method, httpURL, bytes.NewBuffer(jsonStr))
 	} else {
 		req, err = http.NewRequest(method, httpURL, nil)
@@ -200,7 +806,9 @@ func (cli *Client) MakeRequest(method string, httpURL string, reqBody interface{
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
+	cli.setHeaders(req)
 	res, err := cli.Client.Do(req)
 	if res != nil {
 		defer res.Body.Close()
@@ -208,7 +816,10 @@ func (cli *Client) MakeRequest(method string, httpURL string, reqBody interface{
 	if err != nil {
 		return nil, err
 	}
-	contents, err := ioutil.ReadAll(res.Body)
+	contents, err := cli.readResponseBody(res.Body)
+	if err == ErrResponseTooLarge {
+		return nil, err
+	}
 	if res.StatusCode/100 != 2 { // not 2xx
 		var wrap error
 		var respErr RespError
@@ -227,6 +838,7 @@ func (cli *Client) MakeRequest(method string, httpURL string, reqBody interface{
 			Code:         res.StatusCode,
 			Message:      msg,
 			WrappedError: wrap,
+			RetryAfterMS: retryAfterMS(res, contents),
 		}
 	}
 	if err != nil {
@@ -242,15 +854,32 @@ func (cli *Client) MakeRequest(method string, httpURL string, reqBody interface{
 	return contents, nil
 }
 
+// setHeaders sets the User-Agent and authenticates the request with the application service token, if there is
+// one. The token is never sent to hosts other than the homeserver.
+func (cli *Client) setHeaders(req *http.Request) {
+	userAgent := cli.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if cli.ASToken != "" && req.URL.Host == cli.HomeserverURL.Host {
+		req.Header.Set("Authorization", "Bearer "+cli.ASToken)
+	}
+}
+
 // CreateFilter makes an HTTP request according to http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-user-userid-filter
 func (cli *Client) CreateFilter(filter json.RawMessage) (resp *RespCreateFilter, err error) {
-	urlPath := cli.BuildURL("user", cli.UserID, "filter")
+	urlPath := cli.BuildURL("user", cli.userID(), "filter")
 	_, err = cli.MakeRequest("POST", urlPath, &filter, &resp)
 	return
 }
 
 // SyncRequest makes an HTTP request according to http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-sync
 func (cli *Client) SyncRequest(timeout int, since, filterID string, fullState bool, setPresence string) (resp *RespSync, err error) {
+	return cli.syncRequest(context.Background(), timeout, since, filterID, fullState, setPresence)
+}
+
+func (cli *Client) syncRequest(ctx context.Context, timeout int, since, filterID string, fullState bool, setPresence string) (resp *RespSync, err error) {
 	query := map[string]string{
 		"timeout": strconv.Itoa(timeout),
 	}
@@ -267,7 +896,7 @@ func (cli *Client) SyncRequest(timeout int, since, filterID string, fullState bo
 		query["full_state"] = "true"
 	}
 	urlPath := cli.BuildURLWithQuery([]string{"sync"}, query)
-	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	_, err = cli.makeRequestWithContext(ctx, "GET", urlPath, nil, &resp)
 	return
 }
 
@@ -311,6 +940,29 @@ func (cli *Client) RegisterGuest(req *ReqRegister) (*RespRegister, *RespUserInte
 	return cli.register(u, req)
 }
 
+// RegisterStage resubmits a registration request with the auth for a completed stage of user-interactive
+// authentication, carrying over the session from the previous response. If further stages are required, the
+// returned RespUserInteractive lists them: see RespUserInteractive.NextStage.
+//
+// The m.login.recaptcha, m.login.terms, m.login.dummy and m.login.email.identity stages are completed like so:
+//
+//	res, uia, err := cli.Register(req)
+//	for err == nil && res == nil {
+//		auth := gomatrix.ReqUIAuth{Type: uia.NextStage()}
+//		switch auth.Type {
+//		case gomatrix.AuthTypeRecaptcha:
+//			auth.Response = solveCaptcha(uia.RecaptchaPublicKey())
+//		case gomatrix.AuthTypeEmailIdentity:
+//			auth.ThreePIDCreds = &gomatrix.ThreePIDCreds{SID: sid, ClientSecret: clientSecret}
+//		}
+//		res, uia, err = cli.RegisterStage(req, uia, auth)
+//	}
+func (cli *Client) RegisterStage(req *ReqRegister, uia *RespUserInteractive, auth ReqUIAuth) (*RespRegister, *RespUserInteractive, error) {
+	auth.Session = uia.Session
+	req.Auth = auth
+	return cli.Register(req)
+}
+
 // RegisterDummy performs m.login.dummy registration according to https://matrix.org/docs/spec/client_server/r0.2.0.html#dummy-auth
 //
 // Only a username and password need to be provided on the ReqRegister struct. Most local/developer homeservers will allow registration
@@ -332,11 +984,7 @@ func (cli *Client) RegisterDummy(req *ReqRegister) (*RespRegister, error) {
 		return nil, err
 	}
 	if uia != nil && uia.HasSingleStageFlow("m.login.dummy") {
-		req.Auth = struct {
-			Type    string `json:"type"`
-			Session string `json:"session,omitempty"`
-		}{"m.login.dummy", uia.Session}
-		res, _, err = cli.Register(req)
+		res, _, err = cli.RegisterStage(req, uia, ReqUIAuth{Type: AuthTypeDummy})
 		if err != nil {
 			return nil, err
 		}
@@ -355,11 +1003,26 @@ func (cli *Client) Login(req *ReqLogin) (resp *RespLogin, err error) {
 	return
 }
 
-// Logout the current user. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-logout
-// This does not clear the credentials from the client instance. See ClearCredentials() instead.
+// Logout the current user, invalidating the client's access token. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-logout
+// On success the credentials are cleared from the client instance, as if ClearCredentials() had been called.
 func (cli *Client) Logout() (resp *RespLogout, err error) {
 	urlPath := cli.BuildURL("logout")
 	_, err = cli.MakeRequest("POST", urlPath, nil, &resp)
+	if err == nil {
+		cli.ClearCredentials()
+	}
+	return
+}
+
+// LogoutAll invalidates every access token for the current user, not just the client's own, e.g. to sign out
+// everywhere after a password change. See https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-logout-all
+// On success the credentials are cleared from the client instance, as if ClearCredentials() had been called.
+func (cli *Client) LogoutAll() (resp *RespLogoutAll, err error) {
+	urlPath := cli.BuildURL("logout", "all")
+	_, err = cli.MakeRequest("POST", urlPath, nil, &resp)
+	if err == nil {
+		cli.ClearCredentials()
+	}
 	return
 }
 
@@ -370,6 +1033,98 @@ func (cli *Client) Versions() (resp *RespVersions, err error) {
 	return
 }
 
+// SupportedVersions returns the spec versions supported by the homeserver, e.g. ["r0.6.1", "v1.2"]. The versions
+// are fetched with Versions() on first use and cached. If they cannot be fetched, nil is returned and the
+// next call will try again.
+func (cli *Client) SupportedVersions() []string {
+	cli.versionsMutex.Lock()
+	defer cli.versionsMutex.Unlock()
+	cli.loadVersions()
+	return cli.versions
+}
+
+// SupportsUnstableFeature returns true if the homeserver advertises the unstable feature as enabled. The
+// features are fetched and cached along with SupportedVersions.
+func (cli *Client) SupportsUnstableFeature(feature string) bool {
+	cli.versionsMutex.Lock()
+	defer cli.versionsMutex.Unlock()
+	cli.loadVersions()
+	return cli.unstableFeatures[feature]
+}
+
+// loadVersions fetches the versions and unstable features if they haven't been fetched yet. It must be called
+// with versionsMutex held.
+func (cli *Client) loadVersions() {
+	if cli.versions != nil {
+		return
+	}
+	resp, err := cli.Versions()
+	if err != nil {
+		return
+	}
+	cli.versions = resp.Versions
+	if cli.versions == nil {
+		cli.versions = []string{}
+	}
+	cli.unstableFeatures = resp.UnstableFeatures
+}
+
+// useAuthenticatedMedia returns true if the media helpers should use the authenticated media endpoints.
+func (cli *Client) useAuthenticatedMedia() bool {
+	switch cli.MediaEndpoints {
+	case MediaEndpointsAuthenticated:
+		return true
+	case MediaEndpointsLegacy:
+		return false
+	}
+	return cli.supportsSpecVersion(1, 11) || cli.SupportsUnstableFeature("org.matrix.msc3916.stable")
+}
+
+// supportsPathVersion returns true if the homeserver advertises a spec version which serves endpoints under
+// /_matrix/client/<pathVersion>. "r0" paths belong to the r0.x.x spec versions, whereas the newer "v1" and "v3"
+// paths belong to the v1.x spec versions.
+func (cli *Client) supportsPathVersion(pathVersion string) bool {
+	specPrefix := "v1."
+	if pathVersion == "r0" {
+		specPrefix = "r0."
+	}
+	for _, v := range cli.SupportedVersions() {
+		if strings.HasPrefix(v, specPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsSpecVersion returns true if the homeserver advertises spec version v<major>.<minor> or later.
+func (cli *Client) supportsSpecVersion(major, minor int) bool {
+	for _, v := range cli.SupportedVersions() {
+		var vMajor, vMinor int
+		if _, err := fmt.Sscanf(v, "v%d.%d", &vMajor, &vMinor); err != nil {
+			continue
+		}
+		if vMajor > major || (vMajor == major && vMinor >= minor) {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeVersionedRequest makes a JSON HTTP request to /_matrix/client/<version>/<urlPath>, using preferredVersion
+// (e.g. "v3") if the homeserver supports it and falling back to Client.APIVersion otherwise. The request and
+// response are handled in the same way as MakeRequest, which is left to take fully-built URLs.
+func (cli *Client) MakeVersionedRequest(method, preferredVersion string, urlPath []string, reqBody interface{}, resBody interface{}) ([]byte, error) {
+	version := cli.APIVersion
+	if version == "" {
+		version = "r0"
+	}
+	if preferredVersion != "" && preferredVersion != version && cli.supportsPathVersion(preferredVersion) {
+		version = preferredVersion
+	}
+	u := cli.BuildBaseURL(append([]string{"_matrix", "client", version}, urlPath...)...)
+	return cli.MakeRequest(method, u, reqBody, resBody)
+}
+
 // JoinRoom joins the client to a room ID or alias. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-join-roomidoralias
 //
 // If serverName is specified, this will be added as a query param to instruct the homeserver to join via that server. If content is specified, it will
@@ -387,6 +1142,75 @@ func (cli *Client) JoinRoom(roomIDorAlias, serverName string, content interface{
 	return
 }
 
+// JoinRoomVia joins the client to a room ID or alias, asking the homeserver to join via any of the given servers.
+// Each server is added as a server_name query param, which is required to join a room that none of the client's
+// homeserver's users are in. If thirdPartySigned is not nil, it is sent to prove the user was invited by third party ID.
+// See https://matrix.org/docs/spec/client_server/r0.3.0.html#post-matrix-client-r0-join-roomidoralias
+func (cli *Client) JoinRoomVia(roomIDorAlias string, via []string, thirdPartySigned *ReqThirdPartySigned) (resp *RespJoinRoom, err error) {
+	u, _ := url.Parse(cli.BuildURL("join", roomIDorAlias))
+	q := u.Query()
+	for _, serverName := range via {
+		q.Add("server_name", serverName)
+	}
+	u.RawQuery = q.Encode()
+	req := ReqJoinRoom{ThirdPartySigned: thirdPartySigned}
+	_, err = cli.MakeRequest("POST", u.String(), &req, &resp)
+	return
+}
+
+// FollowTombstone joins the room which replaced an upgraded room, as given by its m.room.tombstone state event, and
+// returns the replacement room's ID. If the replacement room has been upgraded too, the chain is followed to the
+// latest room, up to 10 upgrades. The server of the user who sent each tombstone is used to join the replacement.
+// Returns ErrNoTombstone if the room has not been upgraded.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#room-upgrades
+func (cli *Client) FollowTombstone(roomID string) (newRoomID string, err error) {
+	current := roomID
+	var event *Event
+	for i := 0; i < maxTombstoneHops; i++ {
+		event, err = cli.StateEventFull(current, "m.room.tombstone", "")
+		if httpErr, ok := err.(HTTPError); ok && httpErr.Code == 404 {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		replacement, _ := event.Content["replacement_room"].(string)
+		if replacement == "" {
+			break
+		}
+		var via []string
+		if parts := strings.SplitN(event.Sender, ":", 2); len(parts) == 2 {
+			via = []string{parts[1]}
+		}
+		if _, err = cli.JoinRoomVia(replacement, via, nil); err != nil {
+			return "", err
+		}
+		current = replacement
+	}
+	if current == roomID {
+		return "", ErrNoTombstone
+	}
+	return current, nil
+}
+
+// GetRoomSummary returns a preview of a room, such as its name, topic, member count and join rule, without
+// the user having to join it (MSC3266). via lists the servers to ask about the room if the homeserver is not in
+// it. The unstable endpoint is used if the homeserver does not support the stable one.
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/3266
+func (cli *Client) GetRoomSummary(roomID string, via []string) (resp *RespRoomSummary, err error) {
+	for _, prefix := range [][]string{{"_matrix", "client", "v1"}, {"_matrix", "client", "unstable", "im.nheko.summary"}} {
+		u, _ := url.Parse(cli.BuildBaseURL(append(prefix, "rooms", roomID, "summary")...))
+		q := u.Query()
+		for _, serverName := range via {
+			q.Add("via", serverName)
+		}
+		u.RawQuery = q.Encode()
+		if _, err = cli.MakeRequest("GET", u.String(), nil, &resp); !isUnsupportedEndpoint(err) {
+			return
+		}
+	}
+	return
+}
+
 // GetDisplayName returns the display name of the user from the specified MXID. See https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-profile-userid-displayname
 func (cli *Client) GetDisplayName(mxid string) (resp *RespUserDisplayName, err error) {
 	urlPath := cli.BuildURL("profile", mxid, "displayname")
@@ -396,14 +1220,14 @@ func (cli *Client) GetDisplayName(mxid string) (resp *RespUserDisplayName, err e
 
 // GetOwnDisplayName returns the user's display name. See https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-profile-userid-displayname
 func (cli *Client) GetOwnDisplayName() (resp *RespUserDisplayName, err error) {
-	urlPath := cli.BuildURL("profile", cli.UserID, "displayname")
+	urlPath := cli.BuildURL("profile", cli.userID(), "displayname")
 	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
 	return
 }
 
 // SetDisplayName sets the user's profile display name. See http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-profile-userid-displayname
 func (cli *Client) SetDisplayName(displayName string) (err error) {
-	urlPath := cli.BuildURL("profile", cli.UserID, "displayname")
+	urlPath := cli.BuildURL("profile", cli.userID(), "displayname")
 	s := struct {
 		DisplayName string `json:"displayname"`
 	}{displayName}
@@ -413,7 +1237,7 @@ func (cli *Client) SetDisplayName(displayName string) (err error) {
 
 // GetAvatarURL gets the user's avatar URL. See http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-profile-userid-avatar-url
 func (cli *Client) GetAvatarURL() (url string, err error) {
-	urlPath := cli.BuildURL("profile", cli.UserID, "avatar_url")
+	urlPath := cli.BuildURL("profile", cli.userID(), "avatar_url")
 	s := struct {
 		AvatarURL string `json:"avatar_url"`
 	}{}
@@ -428,7 +1252,7 @@ func (cli *Client) GetAvatarURL() (url string, err error) {
 
 // SetAvatarURL sets the user's avatar URL. See http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-profile-userid-avatar-url
 func (cli *Client) SetAvatarURL(url string) (err error) {
-	urlPath := cli.BuildURL("profile", cli.UserID, "avatar_url")
+	urlPath := cli.BuildURL("profile", cli.userID(), "avatar_url")
 	s := struct {
 		AvatarURL string `json:"avatar_url"`
 	}{url}
@@ -440,16 +1264,53 @@ func (cli *Client) SetAvatarURL(url string) (err error) {
 	return nil
 }
 
-// SendMessageEvent sends a message event into a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-send-eventtype-txnid
-// contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
-func (cli *Client) SendMessageEvent(roomID string, eventType string, contentJSON interface{}) (resp *RespSendEvent, err error) {
-	txnID := txnID()
-	urlPath := cli.BuildURL("rooms", roomID, "send", eventType, txnID)
-	_, err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
-	return
+// SetDisplayNameVerified sets the user's profile display name like SetDisplayName, then fetches it again to check
+// that the homeserver applied the change. Some homeservers accept a profile change but then reject or rewrite it,
+// e.g. due to profile restrictions. If the fetched display name differs, the error is a ProfileNotUpdatedError.
+func (cli *Client) SetDisplayNameVerified(displayName string) error {
+	if err := cli.SetDisplayName(displayName); err != nil {
+		return err
+	}
+	resp, err := cli.GetOwnDisplayName()
+	if err != nil {
+		return err
+	}
+	if resp.DisplayName != displayName {
+		return ProfileNotUpdatedError{Field: "displayname", Want: displayName, Got: resp.DisplayName}
+	}
+	return nil
 }
 
-// SendStateEvent sends a state event into a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-state-eventtype-statekey
+// SetAvatarURLVerified sets the user's avatar URL like SetAvatarURL, then fetches it again to check that the
+// homeserver applied the change. If the fetched avatar URL differs, the error is a ProfileNotUpdatedError.
+func (cli *Client) SetAvatarURLVerified(url string) error {
+	if err := cli.SetAvatarURL(url); err != nil {
+		return err
+	}
+	got, err := cli.GetAvatarURL()
+	if err != nil {
+		return err
+	}
+	if got != url {
+		return ProfileNotUpdatedError{Field: "avatar_url", Want: url, Got: got}
+	}
+	return nil
+}
+
+// SendMessageEvent sends a message event into a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-send-eventtype-txnid
+// contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
+func (cli *Client) SendMessageEvent(roomID string, eventType string, contentJSON interface{}) (resp *RespSendEvent, err error) {
+	return cli.sendMessageEvent(context.Background(), roomID, eventType, contentJSON)
+}
+
+// sendMessageEvent is SendMessageEvent with a context which can cancel the request.
+func (cli *Client) sendMessageEvent(ctx context.Context, roomID string, eventType string, contentJSON interface{}) (resp *RespSendEvent, err error) {
+	urlPath := cli.BuildURL("rooms", roomID, "send", eventType, txnID())
+	_, err = cli.makeRequestWithContext(ctx, "PUT", urlPath, contentJSON, &resp)
+	return
+}
+
+// SendStateEvent sends a state event into a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-state-eventtype-statekey
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
 func (cli *Client) SendStateEvent(roomID, eventType, stateKey string, contentJSON interface{}) (resp *RespSendEvent, err error) {
 	urlPath := cli.BuildURL("rooms", roomID, "state", eventType, stateKey)
@@ -457,6 +1318,92 @@ func (cli *Client) SendStateEvent(roomID, eventType, stateKey string, contentJSO
 	return
 }
 
+// SetRoomName sets the name of a room by sending an m.room.name state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-name
+func (cli *Client) SetRoomName(roomID, name string) (err error) {
+	s := struct {
+		Name string `json:"name"`
+	}{name}
+	_, err = cli.SendStateEvent(roomID, "m.room.name", "", &s)
+	return
+}
+
+// SetRoomTopic sets the topic of a room by sending an m.room.topic state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-topic
+func (cli *Client) SetRoomTopic(roomID, topic string) (err error) {
+	s := struct {
+		Topic string `json:"topic"`
+	}{topic}
+	_, err = cli.SendStateEvent(roomID, "m.room.topic", "", &s)
+	return
+}
+
+// SetRoomAvatar sets the avatar of a room to an mxc:// URI by sending an m.room.avatar state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-avatar
+func (cli *Client) SetRoomAvatar(roomID, mxcURL string) (err error) {
+	s := struct {
+		URL string `json:"url"`
+	}{mxcURL}
+	_, err = cli.SendStateEvent(roomID, "m.room.avatar", "", &s)
+	return
+}
+
+// SendStateEvents sends several state events into a room one after another, e.g. to set up a new room. This is not
+// atomic: if an event fails, the events before it have already been sent. Every event is attempted, unless one
+// with StopOnError set fails, in which case no more events are sent.
+//
+// The returned responses are in the same order as the attempted events, with a zero RespSendEvent for each event
+// which failed. If any event failed, the error is a StateEventsError.
+func (cli *Client) SendStateEvents(roomID string, events []StateEventReq) ([]RespSendEvent, error) {
+	resps := make([]RespSendEvent, 0, len(events))
+	errs := make([]error, 0, len(events))
+	failed := false
+	for _, ev := range events {
+		resp, err := cli.SendStateEvent(roomID, ev.Type, ev.StateKey, ev.Content)
+		if resp == nil || err != nil {
+			resp = &RespSendEvent{}
+		}
+		resps = append(resps, *resp)
+		errs = append(errs, err)
+		if err != nil {
+			failed = true
+			if ev.StopOnError {
+				break
+			}
+		}
+	}
+	if failed {
+		return resps, StateEventsError{Errors: errs}
+	}
+	return resps, nil
+}
+
+// AddSpaceChild adds a room to a space by sending an m.space.child state event into the space, keyed
+// on the child room ID. via lists the servers to try when joining the child room.
+// See https://spec.matrix.org/v1.2/client-server-api/#mspacechild
+func (cli *Client) AddSpaceChild(spaceID, childRoomID string, via []string, order string, suggested bool) (*RespSendEvent, error) {
+	return cli.SendStateEvent(spaceID, "m.space.child", childRoomID, SpaceChildContent{
+		Via:       via,
+		Order:     order,
+		Suggested: suggested,
+	})
+}
+
+// RemoveSpaceChild removes a room from a space by replacing its m.space.child state event with one which has
+// empty content.
+func (cli *Client) RemoveSpaceChild(spaceID, childRoomID string) (*RespSendEvent, error) {
+	return cli.SendStateEvent(spaceID, "m.space.child", childRoomID, struct{}{})
+}
+
+// SetSpaceParent points a room at its parent space by sending an m.space.parent state event into the
+// child room, keyed on the space ID. See https://spec.matrix.org/v1.2/client-server-api/#mspaceparent
+func (cli *Client) SetSpaceParent(childRoomID, parentSpaceID string, canonical bool, via []string) (*RespSendEvent, error) {
+	return cli.SendStateEvent(childRoomID, "m.space.parent", parentSpaceID, SpaceParentContent{
+		Via:       via,
+		Canonical: canonical,
+	})
+}
+
 // SendText sends an m.room.message event into the given room with a msgtype of m.text
 // See http://matrix.org/docs/spec/client_server/r0.2.0.html#m-text
 func (cli *Client) SendText(roomID, text string) (*RespSendEvent, error) {
@@ -464,6 +1411,20 @@ func (cli *Client) SendText(roomID, text string) (*RespSendEvent, error) {
 		TextMessage{"m.text", text})
 }
 
+// SendFormattedText sends an m.room.message event into the given room with a msgtype of m.text, a plain-text body
+// and an HTML formatted_body. The HTML is sent as-is, so untrusted input should be passed through SanitizeMatrixHTML
+// first. RenderMarkdown produces both bodies from Markdown.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-message-msgtypes
+func (cli *Client) SendFormattedText(roomID, text, formattedText string) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(roomID, "m.room.message",
+		HTMLMessage{
+			Body:          text,
+			MsgType:       "m.text",
+			Format:        "org.matrix.custom.html",
+			FormattedBody: formattedText,
+		})
+}
+
 // SendImage sends an m.room.message event into the given room with a msgtype of m.image
 // See https://matrix.org/docs/spec/client_server/r0.2.0.html#m-image
 func (cli *Client) SendImage(roomID, body, url string) (*RespSendEvent, error) {
@@ -506,7 +1467,17 @@ func (cli *Client) RedactEvent(roomID, eventID string, req *ReqRedact) (resp *Re
 //  	Preset: "public_chat",
 //  })
 //  fmt.Println("Room:", resp.RoomID)
+//
+// If req.RoomVersion is empty, the room version from DefaultRoomVersion is used. If the homeserver does not
+// advertise one, the room version is left for the homeserver to choose.
 func (cli *Client) CreateRoom(req *ReqCreateRoom) (resp *RespCreateRoom, err error) {
+	if req != nil && req.RoomVersion == "" {
+		if defaultVersion, discoverErr := cli.DefaultRoomVersion(); discoverErr == nil && defaultVersion != "" {
+			reqCopy := *req
+			reqCopy.RoomVersion = defaultVersion
+			req = &reqCopy
+		}
+	}
 	urlPath := cli.BuildURL("createRoom")
 	_, err = cli.MakeRequest("POST", urlPath, req, &resp)
 	return
@@ -519,6 +1490,23 @@ func (cli *Client) LeaveRoom(roomID string) (resp *RespLeaveRoom, err error) {
 	return
 }
 
+// RejectInvite rejects an invite to a room by leaving it, with an optional reason which is shown to the inviter.
+// If Client.Syncer implements InviteRejecter, it is told about the rejection so that it can stop surfacing the
+// invite before the homeserver's /sync catches up.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-rooms-roomid-leave
+func (cli *Client) RejectInvite(roomID, reason string) error {
+	req := struct {
+		Reason string `json:"reason,omitempty"`
+	}{reason}
+	if _, err := cli.MakeRequest("POST", cli.BuildURL("rooms", roomID, "leave"), &req, nil); err != nil {
+		return err
+	}
+	if rejecter, ok := cli.Syncer.(InviteRejecter); ok {
+		rejecter.InviteRejected(roomID)
+	}
+	return nil
+}
+
 // ForgetRoom forgets a room entirely. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-forget
 func (cli *Client) ForgetRoom(roomID string) (resp *RespForgetRoom, err error) {
 	u := cli.BuildURL("rooms", roomID, "forget")
@@ -527,6 +1515,7 @@ func (cli *Client) ForgetRoom(roomID string) (resp *RespForgetRoom, err error) {
 }
 
 // InviteUser invites a user to a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-invite
+// The optional Reason is shown to the invited user.
 func (cli *Client) InviteUser(roomID string, req *ReqInviteUser) (resp *RespInviteUser, err error) {
 	u := cli.BuildURL("rooms", roomID, "invite")
 	_, err = cli.MakeRequest("POST", u, req, &resp)
@@ -541,6 +1530,7 @@ func (cli *Client) InviteUserByThirdParty(roomID string, req *ReqInvite3PID) (re
 }
 
 // KickUser kicks a user from a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-kick
+// The optional Reason is shown to the kicked user.
 func (cli *Client) KickUser(roomID string, req *ReqKickUser) (resp *RespKickUser, err error) {
 	u := cli.BuildURL("rooms", roomID, "kick")
 	_, err = cli.MakeRequest("POST", u, req, &resp)
@@ -548,6 +1538,7 @@ func (cli *Client) KickUser(roomID string, req *ReqKickUser) (resp *RespKickUser
 }
 
 // BanUser bans a user from a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-ban
+// The optional Reason is shown to the banned user.
 func (cli *Client) BanUser(roomID string, req *ReqBanUser) (resp *RespBanUser, err error) {
 	u := cli.BuildURL("rooms", roomID, "ban")
 	_, err = cli.MakeRequest("POST", u, req, &resp)
@@ -555,6 +1546,7 @@ func (cli *Client) BanUser(roomID string, req *ReqBanUser) (resp *RespBanUser, e
 }
 
 // UnbanUser unbans a user from a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-unban
+// The optional Reason is shown to the unbanned user.
 func (cli *Client) UnbanUser(roomID string, req *ReqUnbanUser) (resp *RespUnbanUser, err error) {
 	u := cli.BuildURL("rooms", roomID, "unban")
 	_, err = cli.MakeRequest("POST", u, req, &resp)
@@ -564,11 +1556,125 @@ func (cli *Client) UnbanUser(roomID string, req *ReqUnbanUser) (resp *RespUnbanU
 // UserTyping sets the typing status of the user. See https://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-typing-userid
 func (cli *Client) UserTyping(roomID string, typing bool, timeout int64) (resp *RespTyping, err error) {
 	req := ReqTyping{Typing: typing, Timeout: timeout}
-	u := cli.BuildURL("rooms", roomID, "typing", cli.UserID)
+	u := cli.BuildURL("rooms", roomID, "typing", cli.userID())
 	_, err = cli.MakeRequest("PUT", u, req, &resp)
 	return
 }
 
+// GetPresenceList returns the presence of each user on a user's presence list, the users whose presence they
+// subscribe to. Presence lists were removed from the spec after r0.0.1, so homeservers which do not support them
+// return an HTTPError. See https://matrix.org/docs/spec/client_server/r0.0.1.html#get-matrix-client-r0-presence-list-userid
+func (cli *Client) GetPresenceList(userID string) (resp *RespPresenceList, err error) {
+	u := cli.BuildURL("presence", "list", userID)
+	_, err = cli.MakeRequest("GET", u, nil, &resp)
+	return
+}
+
+// SetPresenceList adds the invited users to a user's presence list and removes the dropped ones. Either list may be
+// nil. See https://matrix.org/docs/spec/client_server/r0.0.1.html#post-matrix-client-r0-presence-list-userid
+func (cli *Client) SetPresenceList(userID string, invite, drop []string) error {
+	u := cli.BuildURL("presence", "list", userID)
+	_, err := cli.MakeRequest("POST", u, ReqPresenceList{Invite: invite, Drop: drop}, nil)
+	return err
+}
+
+// SetReadMarker moves the user's fully-read marker (m.fully_read), which tracks where they stopped reading, and
+// their read receipt (m.read) in a room. Pass "" for either event ID to only update the other marker.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-rooms-roomid-read-markers
+func (cli *Client) SetReadMarker(roomID, fullyReadEventID, readEventID string) (err error) {
+	urlPath := cli.BuildURL("rooms", roomID, "read_markers")
+	_, err = cli.MakeRequest("POST", urlPath, &ReqSetReadMarkers{FullyRead: fullyReadEventID, Read: readEventID}, nil)
+	return
+}
+
+// GetNotifications returns a page of the events which the user has been notified about, most recent first. from
+// is the NextToken of the previous page, or "" for the first page. only may be "highlight" to only return
+// notifications which highlighted the user. If limit is not positive, the server's default limit is used.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-notifications
+func (cli *Client) GetNotifications(from, only string, limit int) (resp *RespGetNotifications, err error) {
+	query := map[string]string{}
+	if from != "" {
+		query["from"] = from
+	}
+	if only != "" {
+		query["only"] = only
+	}
+	if limit > 0 {
+		query["limit"] = strconv.Itoa(limit)
+	}
+	urlPath := cli.BuildURLWithQuery([]string{"notifications"}, query)
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// GetAggregatedRelations returns the events which relate to a parent event with the given relation type (e.g.
+// "m.annotation" or "m.replace") and event type (e.g. "m.reaction"). If eventType is "", events of all types are
+// returned. See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidrelationseventidreltypeeventtype
+func (cli *Client) GetAggregatedRelations(roomID, eventID, relType, eventType string) (*RespAggregatedRelations, error) {
+	return cli.getRelations(roomID, eventID, relType, eventType, "")
+}
+
+func (cli *Client) getRelations(roomID, eventID, relType, eventType, from string) (resp *RespAggregatedRelations, err error) {
+	urlPath := []string{"_matrix", "client", "v1", "rooms", roomID, "relations", eventID, relType}
+	if eventType != "" {
+		urlPath = append(urlPath, eventType)
+	}
+	u, _ := url.Parse(cli.BuildBaseURL(urlPath...))
+	if from != "" {
+		q := u.Query()
+		q.Set("from", from)
+		u.RawQuery = q.Encode()
+	}
+	_, err = cli.MakeRequest("GET", u.String(), nil, &resp)
+	return
+}
+
+// GetAnnotationAggregations counts the reactions to an event, grouped by their key (usually an emoji), by paging
+// through all of its m.reaction annotations.
+func (cli *Client) GetAnnotationAggregations(roomID, eventID string) (*RespAnnotations, error) {
+	counts := make(map[string]int)
+	var from string
+	for {
+		resp, err := cli.getRelations(roomID, eventID, "m.annotation", "m.reaction", from)
+		if err != nil {
+			return nil, err
+		}
+		for _, ev := range resp.Chunk {
+			relatesTo, _ := ev.Content["m.relates_to"].(map[string]interface{})
+			if key, ok := relatesTo["key"].(string); ok {
+				counts[key]++
+			}
+		}
+		if resp.NextBatch == "" || resp.NextBatch == from {
+			break
+		}
+		from = resp.NextBatch
+	}
+	groups := make([]AnnotationGroup, 0, len(counts))
+	for key, count := range counts {
+		groups = append(groups, AnnotationGroup{Key: key, Count: count})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return &RespAnnotations{Chunk: groups}, nil
+}
+
+// ReportContent reports an event as inappropriate to the homeserver administrators. The score ranges from -100
+// (most offensive) to 0 (inoffensive); an error is returned without making a request if it is out of range.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-rooms-roomid-report-eventid
+func (cli *Client) ReportContent(roomID, eventID string, reason string, score int) (err error) {
+	if score < -100 || score > 0 {
+		return fmt.Errorf("report score %d is out of range: must be between -100 and 0", score)
+	}
+	urlPath := cli.BuildURL("rooms", roomID, "report", eventID)
+	_, err = cli.MakeRequest("POST", urlPath, &ReqReportContent{Reason: reason, Score: score}, nil)
+	return
+}
+
 // StateEvent gets a single state event in a room. It will attempt to JSON unmarshal into the given "outContent" struct with
 // the HTTP response body, or return an error.
 // See http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-rooms-roomid-state-eventtype-statekey
@@ -578,6 +1684,267 @@ func (cli *Client) StateEvent(roomID, eventType, stateKey string, outContent int
 	return
 }
 
+// GetRoomVersion returns the version of a room from its m.room.create event, which determines the room's event
+// format and algorithms. Rooms created before room versions existed have no room_version and are version "1".
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-create
+func (cli *Client) GetRoomVersion(roomID string) (string, error) {
+	var content struct {
+		RoomVersion string `json:"room_version"`
+	}
+	if err := cli.StateEvent(roomID, "m.room.create", "", &content); err != nil {
+		return "", err
+	}
+	if content.RoomVersion == "" {
+		return "1", nil
+	}
+	return content.RoomVersion, nil
+}
+
+// GetRoomIDForAlias resolves a room alias to a room ID and a list of servers which know about the room. Successful
+// lookups are cached for Client.AliasCacheTTL, so it is cheap to call for every message.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-directory-room-roomalias
+func (cli *Client) GetRoomIDForAlias(alias string) (*RespAliasLookup, error) {
+	ttl := cli.AliasCacheTTL
+	if ttl == 0 {
+		ttl = 5 * time.Minute
+	}
+	if ttl > 0 {
+		if cached, ok := cli.cachedAlias(alias); ok {
+			return cached, nil
+		}
+	}
+
+	var resp RespAliasLookup
+	if _, err := cli.MakeRequest("GET", cli.BuildURL("directory", "room", alias), nil, &resp); err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		cli.cacheAlias(alias, &resp, ttl)
+	}
+	return &resp, nil
+}
+
+// cachedAlias returns a copy of the cached lookup of an alias, removing it from the cache if it has expired.
+func (cli *Client) cachedAlias(alias string) (*RespAliasLookup, bool) {
+	cli.aliasCacheMutex.Lock()
+	defer cli.aliasCacheMutex.Unlock()
+	entry, ok := cli.aliasCache[alias]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(cli.aliasCache, alias)
+		return nil, false
+	}
+	resp := entry.resp
+	resp.Servers = append([]string(nil), entry.resp.Servers...)
+	return &resp, true
+}
+
+// cacheAlias caches a copy of the lookup of an alias for ttl. Expired lookups of other aliases are removed, so the
+// cache only grows with the number of distinct aliases looked up within ttl.
+func (cli *Client) cacheAlias(alias string, resp *RespAliasLookup, ttl time.Duration) {
+	cli.aliasCacheMutex.Lock()
+	defer cli.aliasCacheMutex.Unlock()
+	now := time.Now()
+	if cli.aliasCache == nil {
+		cli.aliasCache = make(map[string]aliasCacheEntry)
+	}
+	for cachedAlias, entry := range cli.aliasCache {
+		if !now.Before(entry.expires) {
+			delete(cli.aliasCache, cachedAlias)
+		}
+	}
+	cli.aliasCache[alias] = aliasCacheEntry{
+		resp:    RespAliasLookup{RoomID: resp.RoomID, Servers: append([]string(nil), resp.Servers...)},
+		expires: now.Add(ttl),
+	}
+}
+
+// GetRoomAliases returns the local aliases of a room, or an empty slice if it has none. If the user is not
+// allowed to see them (e.g. they are not in the room and it is not world-readable), an HTTPError with code 403
+// and M_FORBIDDEN is returned. See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-rooms-roomid-aliases
+func (cli *Client) GetRoomAliases(roomID string) ([]string, error) {
+	var resp RespRoomAliases
+	if _, err := cli.MakeVersionedRequest("GET", "v3", []string{"rooms", roomID, "aliases"}, nil, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Aliases == nil {
+		return []string{}, nil
+	}
+	return resp.Aliases, nil
+}
+
+// GetServerACL returns the server access control list of a room, from its m.room.server_acl state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-server-acl
+func (cli *Client) GetServerACL(roomID string) (*ServerACL, error) {
+	var acl ServerACL
+	if err := cli.StateEvent(roomID, "m.room.server_acl", "", &acl); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+// SetServerACL replaces the server access control list of a room by sending an m.room.server_acl state event.
+// allow and deny are globs of server names, and allowIPLiterals is whether servers named by an IP literal may
+// participate. Note that an empty allow list denies every server. To stop the client's own homeserver from being
+// locked out of the room, ErrServerACLDeniesOwnServer is returned without sending anything if the ACL does not
+// allow the server of the client's user ID.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-server-acl
+func (cli *Client) SetServerACL(roomID string, allow, deny []string, allowIPLiterals bool) error {
+	acl := &ServerACL{Allow: allow, Deny: deny, AllowIPLiterals: allowIPLiterals}
+	if parts := strings.SplitN(cli.userID(), ":", 2); len(parts) == 2 && !acl.AllowsServer(parts[1]) {
+		return ErrServerACLDeniesOwnServer
+	}
+	_, err := cli.SendStateEvent(roomID, "m.room.server_acl", "", acl)
+	return err
+}
+
+// stateContentOrDefault gets the content of the state event of the given type with an empty state key, like
+// StateEvent. If the room has no such state event, content is left unchanged and no error is returned, so that
+// callers can fall back to the spec's default.
+func (cli *Client) stateContentOrDefault(roomID, eventType string, content interface{}) error {
+	err := cli.StateEvent(roomID, eventType, "", content)
+	if httpErr, ok := err.(HTTPError); ok && httpErr.Code == 404 {
+		return nil
+	}
+	return err
+}
+
+// GetPinnedEvents returns the IDs of the events pinned in a room, from its m.room.pinned_events state event. If
+// the room has no pinned events state, an empty slice is returned.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-pinned-events
+func (cli *Client) GetPinnedEvents(roomID string) ([]string, error) {
+	var content struct {
+		Pinned []string `json:"pinned"`
+	}
+	if err := cli.stateContentOrDefault(roomID, "m.room.pinned_events", &content); err != nil {
+		return nil, err
+	}
+	if content.Pinned == nil {
+		return []string{}, nil
+	}
+	return content.Pinned, nil
+}
+
+// GetRoomGuestAccess returns whether guests can join a room, from its m.room.guest_access state event: either
+// GuestAccessCanJoin or GuestAccessForbidden. Rooms without the state event are GuestAccessForbidden.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-guest-access
+func (cli *Client) GetRoomGuestAccess(roomID string) (string, error) {
+	var content struct {
+		GuestAccess string `json:"guest_access"`
+	}
+	if err := cli.stateContentOrDefault(roomID, "m.room.guest_access", &content); err != nil {
+		return "", err
+	}
+	if content.GuestAccess == "" {
+		return GuestAccessForbidden, nil
+	}
+	return content.GuestAccess, nil
+}
+
+// SetRoomGuestAccess sets whether guests can join a room by sending an m.room.guest_access state event. The access
+// must be GuestAccessCanJoin or GuestAccessForbidden, otherwise ErrInvalidGuestAccess is returned.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-guest-access
+func (cli *Client) SetRoomGuestAccess(roomID, access string) (*RespSendEvent, error) {
+	if access != GuestAccessCanJoin && access != GuestAccessForbidden {
+		return nil, ErrInvalidGuestAccess
+	}
+	s := struct {
+		GuestAccess string `json:"guest_access"`
+	}{access}
+	return cli.SendStateEvent(roomID, "m.room.guest_access", "", &s)
+}
+
+// GetHistoryVisibility returns who can see the history of a room, from its m.room.history_visibility state event:
+// one of the HistoryVisibility constants. Rooms without the state event are HistoryVisibilityShared.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#room-history-visibility
+func (cli *Client) GetHistoryVisibility(roomID string) (string, error) {
+	var content struct {
+		HistoryVisibility string `json:"history_visibility"`
+	}
+	if err := cli.stateContentOrDefault(roomID, "m.room.history_visibility", &content); err != nil {
+		return "", err
+	}
+	if content.HistoryVisibility == "" {
+		return HistoryVisibilityShared, nil
+	}
+	return content.HistoryVisibility, nil
+}
+
+// SetHistoryVisibility sets who can see the history of a room by sending an m.room.history_visibility state event.
+// The visibility must be one of the HistoryVisibility constants, otherwise ErrInvalidHistoryVisibility is returned.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#room-history-visibility
+func (cli *Client) SetHistoryVisibility(roomID, visibility string) (*RespSendEvent, error) {
+	switch visibility {
+	case HistoryVisibilityWorldReadable, HistoryVisibilityShared, HistoryVisibilityInvited, HistoryVisibilityJoined:
+	default:
+		return nil, ErrInvalidHistoryVisibility
+	}
+	s := struct {
+		HistoryVisibility string `json:"history_visibility"`
+	}{visibility}
+	return cli.SendStateEvent(roomID, "m.room.history_visibility", "", &s)
+}
+
+// GetEncryptionState returns the content of a room's m.room.encryption state event, or nil if encryption is not
+// enabled in the room. See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-encryption
+func (cli *Client) GetEncryptionState(roomID string) (*EncryptionContent, error) {
+	var content EncryptionContent
+	if err := cli.stateContentOrDefault(roomID, "m.room.encryption", &content); err != nil {
+		return nil, err
+	}
+	if content.Algorithm == "" {
+		return nil, nil
+	}
+	return &content, nil
+}
+
+// EnableEncryption enables end-to-end encryption in a room by sending an m.room.encryption state event with the
+// given algorithm, typically "m.megolm.v1.aes-sha2". This cannot be undone. Returns ErrEncryptionAlreadyEnabled if
+// the room already has an m.room.encryption state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-encryption
+func (cli *Client) EnableEncryption(roomID, algorithm string) (*RespSendEvent, error) {
+	existing, err := cli.GetEncryptionState(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ErrEncryptionAlreadyEnabled
+	}
+	return cli.SendStateEvent(roomID, "m.room.encryption", "", &EncryptionContent{Algorithm: algorithm})
+}
+
+// StateEventFull gets a single state event in a room along with its envelope, e.g. to find out who set the room
+// topic and when. The event is requested with ?format=event, and if the homeserver ignores that and returns only
+// the content, it is found in the room's full state instead.
+func (cli *Client) StateEventFull(roomID, eventType, stateKey string) (*Event, error) {
+	u := cli.BuildURLWithQuery([]string{"rooms", roomID, "state", eventType, stateKey}, map[string]string{
+		"format": "event",
+	})
+	var event Event
+	if _, err := cli.MakeRequest("GET", u, nil, &event); err != nil {
+		return nil, err
+	}
+	// Content can have a "type" key of its own, e.g. "m.space" in the m.room.create content of a space, so the
+	// response is only taken to be the full event if its type and state key match.
+	if event.Type == eventType && event.StateKey != nil && *event.StateKey == stateKey {
+		event.RoomID = roomID
+		return &event, nil
+	}
+	var state []*Event
+	if _, err := cli.MakeRequest("GET", cli.BuildURL("rooms", roomID, "state"), nil, &state); err != nil {
+		return nil, err
+	}
+	for _, ev := range state {
+		if ev.Type == eventType && ev.StateKey != nil && *ev.StateKey == stateKey {
+			ev.RoomID = roomID
+			return ev, nil
+		}
+	}
+	return nil, HTTPError{Code: 404, Message: "State event not found in the room's state"}
+}
+
 // UploadLink uploads an HTTP URL and then returns an MXC URI.
 func (cli *Client) UploadLink(link string) (*RespMediaUpload, error) {
 	res, err := cli.Client.Get(link)
@@ -593,11 +1960,140 @@ func (cli *Client) UploadLink(link string) (*RespMediaUpload, error) {
 // UploadToContentRepo uploads the given bytes to the content repository and returns an MXC URI.
 // See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-media-r0-upload
 func (cli *Client) UploadToContentRepo(content io.Reader, contentType string, contentLength int64) (*RespMediaUpload, error) {
-	req, err := http.NewRequest("POST", cli.BuildBaseURL("_matrix/media/r0/upload"), content)
+	if err := cli.checkMediaLimits(contentLength); err != nil {
+		return nil, err
+	}
+	return cli.uploadMedia(context.Background(), "POST", cli.BuildBaseURL("_matrix/media/r0/upload"), content, contentType, contentLength)
+}
+
+// checkMediaLimits returns ErrFileTooLarge if Client.CheckMediaLimits is set and contentLength is over the
+// homeserver's upload size limit. A contentLength of -1 means the length is unknown and is not checked.
+func (cli *Client) checkMediaLimits(contentLength int64) error {
+	if !cli.CheckMediaLimits || contentLength < 0 {
+		return nil
+	}
+	config, err := cli.GetMediaConfig()
+	if err != nil && !isUnsupportedEndpoint(err) {
+		return err
+	}
+	if config != nil && config.UploadSize > 0 && contentLength > config.UploadSize {
+		return ErrFileTooLarge
+	}
+	return nil
+}
+
+// GetMediaConfig returns the content repository's configuration, such as the maximum upload size.
+// See https://matrix.org/docs/spec/client_server/r0.4.0.html#get-matrix-media-r0-config
+//
+// The authenticated or legacy endpoint is chosen according to Client.MediaEndpoints.
+func (cli *Client) GetMediaConfig() (resp *RespMediaConfig, err error) {
+	if cli.useAuthenticatedMedia() {
+		u := cli.BuildBaseURL("_matrix", "client", "v1", "media", "config")
+		_, err = cli.MakeRequest("GET", u, nil, &resp)
+		if cli.MediaEndpoints != MediaEndpointsAuto || !isUnsupportedEndpoint(err) {
+			return
+		}
+	}
+	u := cli.BuildBaseURL("_matrix", "media", "r0", "config")
+	_, err = cli.MakeRequest("GET", u, nil, &resp)
+	return
+}
+
+// UploadMediaChunked uploads content of unknown length to the content repository without buffering it in memory,
+// using the asynchronous upload flow from MSC2246. An MXC URI is first reserved with POST /_matrix/media/v1/create,
+// then the content is streamed to it with a chunked PUT, reading at most chunkSize bytes at a time (64KiB if
+// chunkSize is not positive). The server only responds to the PUT once the upload is complete, so there is
+// nothing to poll afterwards.
+//
+// If the server does not support MSC2246, the content is streamed to the synchronous upload endpoint instead.
+// See https://github.com/matrix-org/matrix-doc/pull/2246
+func (cli *Client) UploadMediaChunked(ctx context.Context, content io.Reader, contentType, fileName string, chunkSize int) (*RespMediaUpload, error) {
+	if chunkSize <= 0 {
+		chunkSize = 64 * 1024
+	}
+	body := bufio.NewReaderSize(content, chunkSize)
+	var created RespCreateMXC
+	_, err := cli.MakeRequest("POST", cli.BuildBaseURL("_matrix", "media", "v1", "create"), struct{}{}, &created)
+	if isUnsupportedEndpoint(err) {
+		u := cli.BuildBaseURL("_matrix", "media", "r0", "upload")
+		return cli.uploadMedia(ctx, "POST", withFileName(u, fileName), body, contentType, -1)
+	} else if err != nil {
+		return nil, err
+	}
+	serverName, mediaID, err := ParseMXC(created.ContentURI)
 	if err != nil {
 		return nil, err
 	}
+	u := cli.BuildBaseURL("_matrix", "media", "v3", "upload", serverName, mediaID)
+	if _, err = cli.uploadMedia(ctx, "PUT", withFileName(u, fileName), body, contentType, -1); err != nil {
+		return nil, err
+	}
+	return &RespMediaUpload{ContentURI: created.ContentURI}, nil
+}
+
+// SendFileFromReader uploads content to the content repository and sends it into the room as an m.room.message
+// event. The msgtype is m.image, m.video or m.audio according to contentType, and m.file otherwise. The content is
+// streamed, so its length does not need to be known. If it is known, because content is a *bytes.Buffer,
+// *bytes.Reader or *strings.Reader, the upload size limit is checked first as for UploadToContentRepo. If the
+// upload succeeds but sending the message fails, the error is a SendFileError holding the uploaded content's
+// mxc:// URI.
+func (cli *Client) SendFileFromReader(ctx context.Context, roomID, fileName string, content io.Reader, contentType string) (*RespSendEvent, error) {
+	contentLength := readerLength(content)
+	if err := cli.checkMediaLimits(contentLength); err != nil {
+		return nil, err
+	}
+	u := cli.BuildBaseURL("_matrix", "media", "r0", "upload")
+	upload, err := cli.uploadMedia(ctx, "POST", withFileName(u, fileName), content, contentType, contentLength)
+	if err != nil {
+		return nil, err
+	}
+	msg := FileMessage{
+		MsgType: fileMsgType(contentType),
+		Body:    fileName,
+		URL:     upload.ContentURI,
+		Info:    FileInfo{Mimetype: contentType},
+	}
+	var resp RespSendEvent
+	urlPath := cli.BuildURL("rooms", roomID, "send", "m.room.message", txnID())
+	if _, err = cli.makeRequestWithContext(ctx, "PUT", urlPath, msg, &resp); err != nil {
+		return nil, SendFileError{ContentURI: upload.ContentURI, Err: err}
+	}
+	return &resp, nil
+}
+
+// fileMsgType returns the msgtype of a message for a file with the given MIME type.
+func fileMsgType(contentType string) string {
+	switch strings.SplitN(contentType, "/", 2)[0] {
+	case "image":
+		return "m.image"
+	case "video":
+		return "m.video"
+	case "audio":
+		return "m.audio"
+	}
+	return "m.file"
+}
+
+// readerLength returns the number of bytes left in a reader whose length is known without reading it, as for
+// http.NewRequest, or -1 otherwise.
+func readerLength(r io.Reader) int64 {
+	if lr, ok := r.(interface {
+		Len() int
+	}); ok {
+		return int64(lr.Len())
+	}
+	return -1
+}
+
+// uploadMedia sends content to a media upload URL. A contentLength of -1 streams the content with chunked encoding.
+func (cli *Client) uploadMedia(ctx context.Context, method, u string, content io.Reader, contentType string, contentLength int64) (*RespMediaUpload, error) {
+	req, err := http.NewRequest(method, u, content)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", contentType)
+	cli.setHeaders(req)
 	req.ContentLength = contentLength
 	res, err := cli.Client.Do(req)
 	if res != nil {
@@ -606,8 +2102,11 @@ func (cli *Client) UploadToContentRepo(content io.Reader, contentType string, co
 	if err != nil {
 		return nil, err
 	}
+	contents, err := cli.readResponseBody(res.Body)
+	if err == ErrResponseTooLarge {
+		return nil, err
+	}
 	if res.StatusCode != 200 {
-		contents, err := ioutil.ReadAll(res.Body)
 		if err != nil {
 			return nil, HTTPError{
 				Message: "Upload request failed - Failed to read response body: " + err.Error(),
@@ -615,17 +2114,301 @@ func (cli *Client) UploadToContentRepo(content io.Reader, contentType string, co
 			}
 		}
 		return nil, HTTPError{
-			Message: "Upload request failed: " + string(contents),
-			Code:    res.StatusCode,
+			Message:      "Upload request failed: " + string(contents),
+			Code:         res.StatusCode,
+			RetryAfterMS: retryAfterMS(res, contents),
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
 	var m RespMediaUpload
-	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+	if err := json.Unmarshal(contents, &m); err != nil {
 		return nil, err
 	}
 	return &m, nil
 }
 
+// DownloadAuthed downloads the content of an mxc:// URI, returning the content and its Content-Type. The caller
+// must close the content. The authenticated or legacy unauthenticated endpoint is chosen according to
+// Client.MediaEndpoints. See https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1mediadownloadservernamemediaid
+func (cli *Client) DownloadAuthed(mxcURL string) (io.ReadCloser, string, error) {
+	serverName, mediaID, err := ParseMXC(mxcURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if cli.useAuthenticatedMedia() {
+		content, contentType, err := cli.download(cli.BuildBaseURL("_matrix", "client", "v1", "media", "download", serverName, mediaID), true)
+		if cli.MediaEndpoints != MediaEndpointsAuto || !isUnsupportedEndpoint(err) {
+			return content, contentType, err
+		}
+	}
+	return cli.download(cli.BuildBaseURL("_matrix", "media", "r0", "download", serverName, mediaID), false)
+}
+
+// download GETs a media URL, authenticating with the access token if authed is true.
+func (cli *Client) download(u string, authed bool) (io.ReadCloser, string, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if authed && cli.ASToken == "" {
+		req.Header.Set("Authorization", "Bearer "+cli.accessToken())
+	}
+	cli.setHeaders(req)
+	res, err := cli.Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		contents, _ := cli.readResponseBody(res.Body)
+		var wrap error
+		var respErr RespError
+		if _ = json.Unmarshal(contents, &respErr); respErr.ErrCode != "" {
+			wrap = respErr
+		}
+		return nil, "", HTTPError{
+			Code:         res.StatusCode,
+			Message:      "Download request failed: " + string(contents),
+			WrappedError: wrap,
+		}
+	}
+	return res.Body, res.Header.Get("Content-Type"), nil
+}
+
+// withFileName adds the filename query param to a media upload URL, if there is a file name.
+func withFileName(u, fileName string) string {
+	if fileName == "" {
+		return u
+	}
+	parsed, _ := url.Parse(u)
+	q := parsed.Query()
+	q.Set("filename", fileName)
+	parsed.RawQuery = q.Encode()
+	return parsed.String()
+}
+
+// ParseMXC splits an mxc://<server name>/<media ID> URI into its server name and media ID.
+func ParseMXC(mxcURL string) (serverName, mediaID string, err error) {
+	u, err := url.Parse(mxcURL)
+	if err != nil {
+		return "", "", err
+	}
+	mediaID = strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "mxc" || u.Host == "" || mediaID == "" || strings.Contains(mediaID, "/") {
+		return "", "", fmt.Errorf("%s is not a valid mxc:// URI", mxcURL)
+	}
+	return u.Host, mediaID, nil
+}
+
+// isUnsupportedEndpoint returns true if the error indicates that the homeserver does not implement the endpoint.
+func isUnsupportedEndpoint(err error) bool {
+	httpErr, ok := err.(HTTPError)
+	if !ok {
+		return false
+	}
+	if httpErr.Code == 404 || httpErr.Code == 405 {
+		return true
+	}
+	respErr, ok := httpErr.WrappedError.(RespError)
+	return ok && respErr.ErrCode == "M_UNRECOGNIZED"
+}
+
+// Members returns the m.room.member state events of a room. See ReqMembers for filtering by membership or
+// reading the member list at a point in the room's history.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-rooms-roomid-members
+func (cli *Client) Members(roomID string, req *ReqMembers) (resp *RespMembers, err error) {
+	query := map[string]string{}
+	if req != nil {
+		if req.At != "" {
+			query["at"] = req.At
+		}
+		if req.Membership != "" {
+			query["membership"] = req.Membership
+		}
+		if req.NotMembership != "" {
+			query["not_membership"] = req.NotMembership
+		}
+	}
+	u := cli.BuildURLWithQuery([]string{"rooms", roomID, "members"}, query)
+	_, err = cli.MakeRequest("GET", u, nil, &resp)
+	return
+}
+
+// memberships are the values of the membership of a room member, in the order MemberIterator requests them.
+var memberships = []string{"join", "invite", "knock", "leave", "ban"}
+
+// MemberIterator iterates over the members of a room. See Client.NewMembersIterator and Client.IterateMembers.
+//
+// It does not stream the member list: /members has no from/to pagination, so each membership's members are
+// fetched and held in one response. Iterating the joined members of a huge room costs as much memory and is as
+// likely to time out as GetJoinedMembers; only the other memberships are spread over separate requests.
+type MemberIterator struct {
+	cli     *Client
+	roomID  string
+	at      string
+	pending []string // the memberships which have not been requested yet
+	current string   // the membership of the members in members
+	members []*Event // the member events which have not been returned yet
+	value   *MemberEvent
+	err     error
+}
+
+// NewMembersIterator returns an iterator over the members of a room, filtered by req which may be nil, e.g. to
+// list the members as of a sync token. Nothing is requested until the first call to Next, so a client can create
+// it up front and only load the members when they are needed, e.g. when lazy loading members in Sync.
+//
+// The /members endpoint has no from/to pagination, so the members are loaded in chunks by membership: one request
+// for the joined members, then one for the invited members when those have been returned, and so on, skipping
+// req.NotMembership. If req.Membership is set, that is the only request. Set req.At so that the chunks are
+// consistent with each other if the membership changes while iterating.
+func (cli *Client) NewMembersIterator(roomID string, req *ReqMembers) *MemberIterator {
+	it := &MemberIterator{cli: cli, roomID: roomID}
+	if req == nil {
+		req = &ReqMembers{}
+	}
+	it.at = req.At
+	if req.Membership != "" {
+		it.pending = []string{req.Membership}
+		return it
+	}
+	for _, membership := range memberships {
+		if membership != req.NotMembership {
+			it.pending = append(it.pending, membership)
+		}
+	}
+	return it
+}
+
+// GetPublicRooms returns a page of the room directory of the given server, or of the homeserver if server is "".
+// req may be nil to get the first page with the server's default page size. See StreamPublicRooms to get every page.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-publicrooms
+func (cli *Client) GetPublicRooms(server string, req *ReqPublicRooms) (*RespPublicRooms, error) {
+	return cli.getPublicRooms(context.Background(), server, req)
+}
+
+func (cli *Client) getPublicRooms(ctx context.Context, server string, req *ReqPublicRooms) (resp *RespPublicRooms, err error) {
+	query := map[string]string{}
+	if server != "" {
+		query["server"] = server
+	}
+	if req == nil {
+		req = &ReqPublicRooms{}
+	}
+	u := cli.BuildURLWithQuery([]string{"publicRooms"}, query)
+	_, err = cli.makeRequestWithContext(ctx, "POST", u, req, &resp)
+	return
+}
+
+// StreamPublicRooms returns every room in the room directory of the given server, or of the homeserver if server
+// is "", following next_batch tokens until the last page. filter may be nil. Pages of PublicRoomsPageSize rooms
+// are requested as the rooms channel is read.
+//
+// The rooms channel is closed when the directory is exhausted or a request fails. The error channel then yields
+// the error, or nil, and is closed. Cancelling ctx stops the stream with an error. The error channel is buffered, so
+// the stream stops even if it is never read.
+//
+//	rooms, errs := cli.StreamPublicRooms(ctx, "", nil)
+//	for room := range rooms {
+//		fmt.Println(room.RoomID, room.Name)
+//	}
+//	if err := <-errs; err != nil {
+//		return err
+//	}
+func (cli *Client) StreamPublicRooms(ctx context.Context, server string, filter *PublicRoomsFilter) (<-chan PublicRoom, <-chan error) {
+	rooms := make(chan PublicRoom)
+	errs := make(chan error, 1)
+	pageSize := cli.PublicRoomsPageSize
+	if pageSize <= 0 {
+		pageSize = 100
+	}
+	go func() {
+		defer close(errs)
+		err := func() error {
+			defer close(rooms)
+			req := &ReqPublicRooms{Limit: pageSize, Filter: filter}
+			for {
+				resp, err := cli.getPublicRooms(ctx, server, req)
+				if err != nil {
+					return err
+				}
+				for _, room := range resp.Chunk {
+					select {
+					case rooms <- room:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+				if resp.NextBatch == "" || resp.NextBatch == req.Since {
+					return nil
+				}
+				req.Since = resp.NextBatch
+			}
+		}()
+		errs <- err
+	}()
+	return rooms, errs
+}
+
+// IterateMembers returns an iterator over the members of a room, filtered by membership and notMembership which
+// may be "". It is NewMembersIterator without a sync token. The homeserver cannot page through the members of a
+// single membership, so IterateMembers(roomID, "join", "") loads every joined member in one request.
+//
+//	it := cli.IterateMembers(roomID, "join", "")
+//	for it.Next() {
+//		fmt.Println(it.Value().UserID, it.Value().DisplayName)
+//	}
+//	if err := it.Err(); err != nil {
+//		return err
+//	}
+func (cli *Client) IterateMembers(roomID string, membership string, notMembership string) *MemberIterator {
+	return cli.NewMembersIterator(roomID, &ReqMembers{Membership: membership, NotMembership: notMembership})
+}
+
+// Next advances the iterator to the next member, which is then returned by Value. It returns false when there are
+// no more members or a request fails, see Err.
+func (it *MemberIterator) Next() bool {
+	it.value = nil
+	for it.err == nil {
+		for len(it.members) > 0 {
+			event := it.members[0]
+			it.members = it.members[1:]
+			// Skip members of other memberships from a homeserver which ignores the membership filter.
+			if member := decodeMemberEvent(event); event.StateKey != nil && member.Membership == it.current {
+				it.value = member
+				return true
+			}
+		}
+		if len(it.pending) == 0 {
+			return false
+		}
+		it.err = it.load()
+	}
+	return false
+}
+
+// load requests the members with the next pending membership.
+func (it *MemberIterator) load() error {
+	it.current, it.pending = it.pending[0], it.pending[1:]
+	resp, err := it.cli.Members(it.roomID, &ReqMembers{At: it.at, Membership: it.current})
+	if err != nil {
+		return err
+	}
+	it.members = resp.Chunk
+	return nil
+}
+
+// Value returns the current member. It is nil before the first call to Next and after Next returns false.
+func (it *MemberIterator) Value() *MemberEvent {
+	return it.value
+}
+
+// Err returns the error which stopped the iteration, or nil if every member was returned.
+func (it *MemberIterator) Err() error {
+	return it.err
+}
+
 // JoinedMembers returns a map of joined room members. See TODO-SPEC. https://github.com/matrix-org/synapse/pull/1680
 //
 // In general, usage of this API is discouraged in favour of /sync, as calling this API can race with incoming membership changes.
@@ -666,6 +2449,21 @@ func (cli *Client) Messages(roomID, from, to string, dir rune, limit int) (resp
 	return
 }
 
+// Backfill returns up to limit events from before a limited sync timeline, paginating backwards from the
+// timeline's prev_batch token to since, the token of the previous sync, so that events which were already synced
+// are not returned. Unlike Messages with dir='b', the events in Chunk are in chronological order, so they can be
+// processed before the events in the timeline.
+func (cli *Client) Backfill(roomID, prevBatch, since string, limit int) (*RespMessages, error) {
+	resp, err := cli.Messages(roomID, prevBatch, since, 'b', limit)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(resp.Chunk)-1; i < j; i, j = i+1, j-1 {
+		resp.Chunk[i], resp.Chunk[j] = resp.Chunk[j], resp.Chunk[i]
+	}
+	return resp, nil
+}
+
 // TurnServer returns turn server details and credentials for the client to use when initiating calls.
 // See http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-voip-turnserver
 func (cli *Client) TurnServer() (resp *RespTurnServer, err error) {
@@ -674,13 +2472,254 @@ func (cli *Client) TurnServer() (resp *RespTurnServer, err error) {
 	return
 }
 
+// GetRoomKeysVersion returns the current server-side key backup version.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3room_keysversion
+func (cli *Client) GetRoomKeysVersion() (resp *RespRoomKeysVersion, err error) {
+	_, err = cli.MakeVersionedRequest("GET", "v3", []string{"room_keys", "version"}, nil, &resp)
+	return
+}
+
+// GetRoomKeysVersionByID returns the given server-side key backup version.
+// See https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3room_keysversionversion
+func (cli *Client) GetRoomKeysVersionByID(version string) (resp *RespRoomKeysVersion, err error) {
+	_, err = cli.MakeVersionedRequest("GET", "v3", []string{"room_keys", "version", version}, nil, &resp)
+	return
+}
+
+// Capabilities returns the homeserver's capabilities. See https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-capabilities
+func (cli *Client) Capabilities() (resp *RespCapabilities, err error) {
+	urlPath := cli.BuildURL("capabilities")
+	_, err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// GetKeyServerUserKeys queries the homeserver's key server for a user's device keys, for server-side key
+// management (MSC3814). This is separate from the standard /keys/query API. Returns ErrKeyServerUnsupported
+// if the homeserver does not advertise the KeyServerCapability capability.
+func (cli *Client) GetKeyServerUserKeys(userID string) (*RespKeyServerUserKeys, error) {
+	caps, err := cli.Capabilities()
+	if err != nil {
+		return nil, err
+	}
+	if !caps.Enabled(KeyServerCapability) {
+		return nil, ErrKeyServerUnsupported
+	}
+	var resp RespKeyServerUserKeys
+	urlPath := cli.BuildBaseURL("_matrix", "client", "v1", "keys", "user", userID)
+	if _, err = cli.MakeRequest("GET", urlPath, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DiscoverSupportedRoomVersions returns the room versions the homeserver supports, mapped to their stability
+// ("stable" or "unstable"), and the homeserver's default room version, from the m.room_versions capability.
+// The capabilities are fetched once and cached for the lifetime of the client.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-versions-capability
+func (cli *Client) DiscoverSupportedRoomVersions() (map[string]string, string, error) {
+	caps, err := cli.cachedCapabilities()
+	if err != nil {
+		return nil, "", err
+	}
+	roomVersions, err := caps.RoomVersions()
+	if err != nil {
+		return nil, "", err
+	}
+	return roomVersions.Available, roomVersions.Default, nil
+}
+
+// DefaultRoomVersion returns the homeserver's default room version for new rooms, as reported by
+// DiscoverSupportedRoomVersions, so it is cheap to call before every CreateRoom.
+// If the homeserver does not support /capabilities or does not advertise a default room version, "" is returned
+// with a nil error, meaning the homeserver should be left to choose the room version.
+func (cli *Client) DefaultRoomVersion() (string, error) {
+	_, defaultVersion, err := cli.DiscoverSupportedRoomVersions()
+	if isUnsupportedEndpoint(err) {
+		return "", nil
+	}
+	return defaultVersion, err
+}
+
+// cachedCapabilities returns the homeserver's capabilities, fetching them if they have not been fetched yet.
+// Errors are not cached, so a failed fetch is retried on the next call.
+func (cli *Client) cachedCapabilities() (*RespCapabilities, error) {
+	cli.capabilitiesMutex.Lock()
+	defer cli.capabilitiesMutex.Unlock()
+	if cli.capabilities != nil {
+		return cli.capabilities, nil
+	}
+	caps, err := cli.Capabilities()
+	if err != nil {
+		return nil, err
+	}
+	cli.capabilities = caps
+	return caps, nil
+}
+
+// SendToDevice sends to-device events to a set of devices. See https://matrix.org/docs/spec/client_server/r0.3.0.html#put-matrix-client-r0-sendtodevice-eventtype-txnid
+func (cli *Client) SendToDevice(eventType string, req *ReqSendToDevice) (resp *RespSendToDevice, err error) {
+	urlPath := cli.BuildURL("sendToDevice", eventType, txnID())
+	_, err = cli.MakeRequest("PUT", urlPath, req, &resp)
+	return
+}
+
+// RequestRoomKey asks all of the user's own devices to share the given megolm session using an
+// m.room_key_request to-device event. See https://matrix.org/docs/spec/client_server/r0.3.0.html#m-room-key-request
+//
+// The session ID is used as the request ID, so the request can be cancelled later with
+// CancelRoomKeyRequest(sessionID).
+func (cli *Client) RequestRoomKey(senderKeyID, sessionID, roomID, algorithm string) error {
+	content := RoomKeyRequestContent{
+		Action: "request",
+		Body: &RoomKeyRequestBody{
+			Algorithm: algorithm,
+			RoomID:    roomID,
+			SenderKey: senderKeyID,
+			SessionID: sessionID,
+		},
+		RequestID:          sessionID,
+		RequestingDeviceID: cli.DeviceID,
+	}
+	_, err := cli.SendToDevice("m.room_key_request", cli.ownDevicesMessage(content))
+	return err
+}
+
+// CancelRoomKeyRequest cancels a key request previously sent with RequestRoomKey by sending a
+// request_cancellation to all of the user's own devices.
+func (cli *Client) CancelRoomKeyRequest(requestID string) error {
+	content := RoomKeyRequestContent{
+		Action:             "request_cancellation",
+		RequestID:          requestID,
+		RequestingDeviceID: cli.DeviceID,
+	}
+	_, err := cli.SendToDevice("m.room_key_request", cli.ownDevicesMessage(content))
+	return err
+}
+
+// ownDevicesMessage addresses the given content to every device of the client's user.
+func (cli *Client) ownDevicesMessage(content interface{}) *ReqSendToDevice {
+	return &ReqSendToDevice{
+		Messages: map[string]map[string]interface{}{
+			cli.userID(): {"*": content},
+		},
+	}
+}
+
+// GetServerKey fetches the published signing keys of the given Matrix server. If keyID is empty, all of the server's
+// current keys are returned. See https://matrix.org/docs/spec/server_server/r0.1.0.html#get-matrix-key-v2-server-keyid
+//
+// The request is made directly to https://<serverName>, without .well-known or SRV delegation.
+func (cli *Client) GetServerKey(serverName, keyID string) (resp *RespServerKey, err error) {
+	u := url.URL{
+		Scheme: "https",
+		Host:   serverName,
+		Path:   path.Join("/_matrix/key/v2/server", keyID),
+	}
+	_, err = cli.MakeRequest("GET", u.String(), nil, &resp)
+	return
+}
+
+// NotaryQueryKeys asks a notary server for the signing keys of other servers. serverKeys maps server names to the
+// key IDs wanted from each; an empty list of key IDs asks for all of the server's keys.
+// See https://matrix.org/docs/spec/server_server/r0.1.0.html#post-matrix-key-v2-query
+func NotaryQueryKeys(notaryURL string, serverKeys map[string][]string) (*RespNotaryKeys, error) {
+	nURL, err := url.Parse(notaryURL)
+	if err != nil {
+		return nil, err
+	}
+	req := ReqNotaryKeys{ServerKeys: make(map[string]map[string]struct{})}
+	for serverName, keyIDs := range serverKeys {
+		req.ServerKeys[serverName] = make(map[string]struct{})
+		for _, keyID := range keyIDs {
+			req.ServerKeys[serverName][keyID] = struct{}{}
+		}
+	}
+	nURL.Path = path.Join(nURL.Path, "/_matrix/key/v2/query")
+	cli := Client{HomeserverURL: nURL, Client: http.DefaultClient}
+	var resp RespNotaryKeys
+	if _, err = cli.MakeRequest("POST", nURL.String(), &req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SendBatch sends each of the given events concurrently, running at most Client.MaxConcurrency sends at a time.
+// The returned results are in the same order as sends. Sends which have not started when ctx is done are
+// skipped, and sends in progress are cancelled; their results carry the error.
+func (cli *Client) SendBatch(ctx context.Context, sends []BatchSendRequest) []BatchSendResult {
+	concurrency := cli.MaxConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	results := make([]BatchSendResult, len(sends))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range sends {
+		if err := acquireSlot(ctx, sem); err != nil {
+			results[i].Err = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			send := sends[i]
+			results[i].Response, results[i].Err = cli.sendMessageEvent(ctx, send.RoomID, send.EventType, send.Content)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// acquireSlot waits for a free slot in sem. It returns ctx's error instead if ctx is done, even if a slot is free.
+func acquireSlot(ctx context.Context, sem chan struct{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var txnCounter uint64
+
 func txnID() string {
-	return "go" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	// The counter keeps IDs unique when events are sent concurrently within the clock's resolution.
+	return "go" + strconv.FormatInt(time.Now().UnixNano(), 10) + "." + strconv.FormatUint(atomic.AddUint64(&txnCounter, 1), 10)
+}
+
+// parseHomeserverURL parses a homeserver URL, returning an error unless it is an absolute http(s) URL. A
+// trailing slash is removed.
+func parseHomeserverURL(homeserverURL string) (*url.URL, error) {
+	hsURL, err := url.Parse(homeserverURL)
+	if err != nil {
+		return nil, err
+	}
+	if hsURL.Scheme != "http" && hsURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid homeserver URL %q: scheme must be http or https", homeserverURL)
+	}
+	if hsURL.Host == "" {
+		return nil, fmt.Errorf("invalid homeserver URL %q: missing host", homeserverURL)
+	}
+	hsURL.Path = strings.TrimRight(hsURL.Path, "/")
+	return hsURL, nil
+}
+
+// newDefaultSyncer returns a DefaultSyncer which backs off failed /sync requests with the Client's retry backoff.
+func (cli *Client) newDefaultSyncer(userID string, store Storer) *DefaultSyncer {
+	syncer := NewDefaultSyncer(userID, store)
+	syncer.backoff = cli.retryBackoff
+	return syncer
 }
 
 // NewClient creates a new Matrix Client ready for syncing
 func NewClient(homeserverURL, userID, accessToken string) (*Client, error) {
-	hsURL, err := url.Parse(homeserverURL)
+	hsURL, err := parseHomeserverURL(homeserverURL)
 	if err != nil {
 		return nil, err
 	}
@@ -693,9 +2732,10 @@ func NewClient(homeserverURL, userID, accessToken string) (*Client, error) {
 		HomeserverURL: hsURL,
 		UserID:        userID,
 		Prefix:        "/_matrix/client/r0",
-		Syncer:        NewDefaultSyncer(userID, store),
+		APIVersion:    "r0",
 		Store:         store,
 	}
+	cli.Syncer = cli.newDefaultSyncer(userID, store)
 	// By default, use the default HTTP client.
 	cli.Client = http.DefaultClient
 
@@ -705,7 +2745,7 @@ func NewClient(homeserverURL, userID, accessToken string) (*Client, error) {
 // NewClientWithHTTPClient creates a new Matrix Client ready for syncing, using
 // the supplied HTTP client.
 func NewClientWithHTTPClient(homeserverURL, userID, accessToken string, client *http.Client) (*Client, error) {
-	hsURL, err := url.Parse(homeserverURL)
+	hsURL, err := parseHomeserverURL(homeserverURL)
 	if err != nil {
 		return nil, err
 	}
@@ -718,9 +2758,10 @@ func NewClientWithHTTPClient(homeserverURL, userID, accessToken string, client *
 		HomeserverURL: hsURL,
 		UserID:        userID,
 		Prefix:        "/_matrix/client/r0",
-		Syncer:        NewDefaultSyncer(userID, store),
+		APIVersion:    "r0",
 		Store:         store,
 	}
+	cli.Syncer = cli.newDefaultSyncer(userID, store)
 	// By default, use the default HTTP client.
 	cli.Client = client
 
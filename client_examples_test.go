@@ -30,6 +30,45 @@ func Example_sync() {
 	}()
 }
 
+// Only sync the fields of each event which the bot uses, to reduce the size of /sync responses.
+func Example_eventFieldsFilter() {
+	cli, _ := NewClient("https://matrix.org", "@example:matrix.org", "MDAefhiuwehfuiwe")
+	syncer := cli.Syncer.(*DefaultSyncer)
+	// The filter must be set before the first call to Sync. Keep "state_key" so that room state can be tracked.
+	syncer.Filter = &Filter{
+		EventFields: []string{"type", "state_key", "sender", "event_id", "content.body", "content.msgtype"},
+	}
+	syncer.OnEventType("m.room.message", func(ev *Event) {
+		body, _ := ev.Body()
+		fmt.Println(ev.Sender, "said", body)
+	})
+
+	if err := cli.Sync(); err != nil {
+		fmt.Println("Sync() returned ", err)
+	}
+}
+
+// Notify listeners of messages which were skipped because a room's timeline was limited.
+func Example_backfill() {
+	cli, _ := NewClient("https://matrix.org", "@example:matrix.org", "MDAefhiuwehfuiwe")
+	syncer := cli.Syncer.(*DefaultSyncer)
+	syncer.OnLimitedTimeline = func(roomID, prevBatch, since string) []Event {
+		resp, err := cli.Backfill(roomID, prevBatch, since, 100)
+		if err != nil {
+			fmt.Println("Backfill() returned ", err)
+			return nil
+		}
+		return resp.Chunk
+	}
+	syncer.OnEventType("m.room.message", func(ev *Event) {
+		fmt.Println("Message: ", ev)
+	})
+
+	if err := cli.Sync(); err != nil {
+		fmt.Println("Sync() returned ", err)
+	}
+}
+
 func Example_customInterfaces() {
 	// Custom interfaces must be set prior to calling functions on the client.
 	cli, _ := NewClient("https://matrix.org", "@example:matrix.org", "MDAefhiuwehfuiwe")
@@ -2,10 +2,22 @@ package gomatrix
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestClient_LeaveRoom(t *testing.T) {
@@ -24,6 +36,1932 @@ func TestClient_LeaveRoom(t *testing.T) {
 	}
 }
 
+func TestClient_JoinRoomVia(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/join/!foo:bar" {
+			servers := req.URL.Query()["server_name"]
+			if len(servers) != 2 || servers[0] != "bar" || servers[1] != "baz" {
+				return nil, fmt.Errorf("unexpected server_name params: %v", servers)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!foo:bar"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	resp, err := cli.JoinRoomVia("!foo:bar", []string{"bar", "baz"}, nil)
+	if err != nil {
+		t.Fatalf("JoinRoomVia: error, got %s", err.Error())
+	}
+	if resp.RoomID != "!foo:bar" {
+		t.Fatalf("JoinRoomVia: got room ID %s, want !foo:bar", resp.RoomID)
+	}
+}
+
+func TestClient_InitialSync(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/sync" {
+			q := req.URL.Query()
+			if q.Get("full_state") != "true" || q.Get("since") != "" || q.Get("filter") != "2" {
+				return nil, fmt.Errorf("unexpected sync params: %s", req.URL.RawQuery)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s1"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	cli.Store.SaveFilterID(cli.UserID, "2")
+
+	resp, err := cli.InitialSync()
+	if err != nil {
+		t.Fatalf("InitialSync: error, got %s", err.Error())
+	}
+	if resp.NextBatch != "s1" {
+		t.Fatalf("InitialSync: got next_batch %s, want s1", resp.NextBatch)
+	}
+	if nextBatch := cli.Store.LoadNextBatch(cli.UserID); nextBatch != "s1" {
+		t.Fatalf("InitialSync: stored next_batch %s, want s1", nextBatch)
+	}
+}
+
+func TestClient_SyncWatchdog(t *testing.T) {
+	var cli *Client
+	requests := 0
+	cli = mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/sync" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		requests++
+		if requests == 1 { // stall until the watchdog cancels the request
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		cli.StopSync()
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s2"}`)),
+		}, nil
+	})
+	cli.Store.SaveFilterID(cli.UserID, "1")
+	cli.SyncTimeout = time.Millisecond
+	cli.SyncWatchdogSlack = 10 * time.Millisecond
+
+	done := make(chan error)
+	go func() { done <- cli.Sync() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Sync: error, got %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync: stalled request was never cancelled")
+	}
+	if requests != 2 {
+		t.Fatalf("Sync: made %d requests, want 2", requests)
+	}
+}
+
+func TestClient_SyncWatchdogStopped(t *testing.T) {
+	var requests int32
+	started := make(chan struct{}, 1)
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/sync" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		atomic.AddInt32(&requests, 1)
+		started <- struct{}{}
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	cli.Store.SaveFilterID(cli.UserID, "1")
+	cli.SyncTimeout = time.Hour
+
+	done := make(chan error)
+	go func() { done <- cli.Sync() }()
+	<-started
+	cli.StopSync()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Sync: error, got %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync: pending request was not cancelled by StopSync")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Sync: made %d requests, want 1", n)
+	}
+}
+
+func TestClient_NextBatch(t *testing.T) {
+	var cli *Client
+	requests := 0
+	cli = mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/sync" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		requests++
+		if requests == 2 {
+			cli.StopSync()
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"next_batch":"s%d"}`, requests+1))),
+		}, nil
+	})
+	cli.Store.SaveFilterID(cli.UserID, "1")
+	var processed []string
+	cli.OnSyncProcessed = func(nextBatch string) { processed = append(processed, nextBatch) }
+
+	if err := cli.Sync(); err != nil {
+		t.Fatalf("Sync: error, got %s", err.Error())
+	}
+	if len(processed) != 1 || processed[0] != "s2" {
+		t.Fatalf("OnSyncProcessed: got %v, want [s2]", processed)
+	}
+	if nextBatch := cli.NextBatch(); nextBatch != "s2" {
+		t.Fatalf("NextBatch: got %s, want s2", nextBatch)
+	}
+}
+
+func TestClient_SyncFrom(t *testing.T) {
+	var cli *Client
+	var since string
+	cli = mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/sync" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		since = req.URL.Query().Get("since")
+		cli.StopSync()
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s6"}`)),
+		}, nil
+	})
+	cli.Store.SaveFilterID(cli.UserID, "1")
+	cli.Store.SaveNextBatch(cli.UserID, "s1")
+
+	if err := cli.SyncFrom("s5"); err != nil {
+		t.Fatalf("SyncFrom: error, got %s", err.Error())
+	}
+	if since != "s5" {
+		t.Fatalf("SyncFrom: synced since %s, want s5", since)
+	}
+	if stored := cli.Store.LoadNextBatch(cli.UserID); stored != "s5" {
+		t.Fatalf("SyncFrom: stored next_batch %s, want s5", stored)
+	}
+}
+
+func TestClient_SetCredentialsWhileSyncing(t *testing.T) {
+	var cli *Client
+	var once sync.Once
+	started := make(chan struct{})
+	cli = mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/sync" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		once.Do(func() { close(started) })
+		if req.URL.Query().Get("access_token") == "rotated" {
+			cli.StopSync()
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s2"}`)),
+		}, nil
+	})
+	cli.Store.SaveFilterID(cli.UserID, "1")
+
+	done := make(chan error)
+	go func() { done <- cli.Sync() }()
+	<-started
+	cli.SetCredentials("@user:test.gomatrix.org", "rotated")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Sync: error, got %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync: rotated access token was never used")
+	}
+}
+
+// slowRetrySyncer waits an hour after a failed sync, recording the context it was given.
+type slowRetrySyncer struct {
+	*DefaultSyncer
+	ctxs chan context.Context
+}
+
+func (s slowRetrySyncer) OnFailedSync(ctx context.Context, res *RespSync, err error) (time.Duration, error) {
+	s.ctxs <- ctx
+	return time.Hour, nil
+}
+
+func TestClient_OnFailedSyncContext(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 502,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`Bad Gateway`)),
+		}, nil
+	})
+	cli.Store.SaveFilterID(cli.UserID, "1")
+	syncer := slowRetrySyncer{NewDefaultSyncer(cli.UserID, cli.Store), make(chan context.Context, 1)}
+	cli.Syncer = syncer
+
+	done := make(chan error)
+	go func() { done <- cli.Sync() }()
+	ctx := <-syncer.ctxs
+	if ctx.Err() != nil {
+		t.Fatalf("OnFailedSync: context was done before StopSync")
+	}
+	cli.StopSync()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Sync: error, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync: did not stop while waiting to retry")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("OnFailedSync: got context error %v after StopSync, want context.Canceled", ctx.Err())
+	}
+	if _, err := NewDefaultSyncer(cli.UserID, cli.Store).OnFailedSync(ctx, nil, fmt.Errorf("oops")); err != context.Canceled {
+		t.Fatalf("DefaultSyncer.OnFailedSync: got error %v for a done context, want context.Canceled", err)
+	}
+}
+
+// legacyTestSyncer implements the Syncer interface from before SyncBatch and the context of OnFailedSync.
+type legacyTestSyncer struct {
+	since string
+}
+
+func (s *legacyTestSyncer) ProcessResponse(res *RespSync, since string) error {
+	s.since = since
+	return nil
+}
+
+func (s *legacyTestSyncer) OnFailedSync(res *RespSync, err error) (time.Duration, error) {
+	return time.Minute, nil
+}
+
+func (s *legacyTestSyncer) GetFilterJSON(userID string) json.RawMessage {
+	return nil
+}
+
+func TestWrapLegacySyncer(t *testing.T) {
+	legacy := &legacyTestSyncer{}
+	syncer := WrapLegacySyncer(legacy)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: &RespSync{NextBatch: "s2"}, Since: "s1"}); err != nil || legacy.since != "s1" {
+		t.Fatalf("ProcessResponse: got %v with since %q, want the legacy syncer to process since s1", err, legacy.since)
+	}
+	if duration, err := syncer.OnFailedSync(context.Background(), nil, fmt.Errorf("oops")); err != nil || duration != time.Minute {
+		t.Fatalf("OnFailedSync: got %s, %v, want the legacy syncer's 1m0s", duration, err)
+	}
+}
+
+func TestClient_InitialSyncCreatesFilter(t *testing.T) {
+	filtersCreated := 0
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		switch {
+		case req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/user/@user:test.gomatrix.org/filter":
+			body, _ := ioutil.ReadAll(req.Body)
+			if string(body) != `{"room":{"timeline":{"limit":50}}}` {
+				return nil, fmt.Errorf("unexpected filter: %s", body)
+			}
+			filtersCreated++
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"filter_id":"f1"}`)),
+			}, nil
+		case req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/sync":
+			if filter := req.URL.Query().Get("filter"); filter != "f1" {
+				return nil, fmt.Errorf("synced with filter %q, want f1", filter)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s1"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := cli.InitialSync(); err != nil {
+			t.Fatalf("InitialSync: returned error: %s", err)
+		}
+	}
+	if filtersCreated != 1 || cli.Store.LoadFilterID(cli.UserID) != "f1" {
+		t.Fatalf("InitialSync: created %d filters and stored %q, want 1 and f1", filtersCreated, cli.Store.LoadFilterID(cli.UserID))
+	}
+}
+
+func TestClient_PresenceList(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/presence/list/@alice:bar" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		switch req.Method {
+		case "GET":
+			return &http.Response{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(bytes.NewBufferString(`[
+					{"type":"m.presence","content":{"user_id":"@bob:bar","presence":"online"}}
+				]`)),
+			}, nil
+		case "POST":
+			body, _ := ioutil.ReadAll(req.Body)
+			if string(body) != `{"invite":["@bob:bar"],"drop":["@carol:bar"]}` {
+				return nil, fmt.Errorf("unexpected body: %s", body)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled method: %s", req.Method)
+	})
+	if err := cli.SetPresenceList("@alice:bar", []string{"@bob:bar"}, []string{"@carol:bar"}); err != nil {
+		t.Fatalf("SetPresenceList: returned error: %s", err)
+	}
+	list, err := cli.GetPresenceList("@alice:bar")
+	if err != nil {
+		t.Fatalf("GetPresenceList: returned error: %s", err)
+	}
+	if len(*list) != 1 || (*list)[0].Content["presence"] != "online" {
+		t.Fatalf("GetPresenceList: got %+v", list)
+	}
+}
+
+func TestClient_PollSync(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/sync" {
+			q := req.URL.Query()
+			if q.Get("timeout") != "5000" || q.Get("since") != "s1" {
+				return nil, fmt.Errorf("unexpected sync params: %s", req.URL.RawQuery)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s2"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	cli.Store.SaveNextBatch(cli.UserID, "s1")
+
+	resp, nextBatch, err := cli.PollSync(context.Background(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("PollSync: error, got %s", err.Error())
+	}
+	if resp.NextBatch != "s2" || nextBatch != "s2" {
+		t.Fatalf("PollSync: got next_batch %s, want s2", nextBatch)
+	}
+	if stored := cli.Store.LoadNextBatch(cli.UserID); stored != "s1" {
+		t.Fatalf("PollSync: stored next_batch changed to %s, want s1", stored)
+	}
+}
+
+func TestClient_AsUser(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && req.URL.Path == "/_matrix/client/r0/profile/@bridge_alice:test.gomatrix.org/displayname" {
+			if auth := req.Header.Get("Authorization"); auth != "Bearer as_secret" {
+				return nil, fmt.Errorf("unexpected Authorization header: %s", auth)
+			}
+			q := req.URL.Query()
+			if q.Get("user_id") != "@bridge_alice:test.gomatrix.org" || q.Get("access_token") != "" {
+				return nil, fmt.Errorf("unexpected query params: %s", req.URL.RawQuery)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	cli.ASToken = "as_secret"
+
+	if err := cli.AsUser("@bridge_alice:test.gomatrix.org").SetDisplayName("Alice"); err != nil {
+		t.Fatalf("SetDisplayName: error, got %s", err.Error())
+	}
+}
+
+func TestClient_MakeVersionedRequest(t *testing.T) {
+	testCases := []struct {
+		Versions string
+		Path     string
+	}{
+		{`{"versions":["r0.5.0","r0.6.1"]}`, "/_matrix/client/r0/room_keys/version"},
+		{`{"versions":["r0.6.1","v1.1"]}`, "/_matrix/client/v3/room_keys/version"},
+	}
+	for _, tc := range testCases {
+		versionRequests := 0
+		cli := mockClient(func(req *http.Request) (*http.Response, error) {
+			if req.Method == "GET" && req.URL.Path == "/_matrix/client/versions" {
+				versionRequests++
+				return &http.Response{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(tc.Versions)),
+				}, nil
+			}
+			if req.Method == "GET" && req.URL.Path == tc.Path {
+				return &http.Response{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(`{"version":"1"}`)),
+				}, nil
+			}
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		})
+
+		for i := 0; i < 2; i++ {
+			if _, err := cli.GetRoomKeysVersion(); err != nil {
+				t.Fatalf("GetRoomKeysVersion with versions %s: error, got %s", tc.Versions, err.Error())
+			}
+		}
+		if versionRequests != 1 {
+			t.Fatalf("SupportedVersions: got %d /versions requests, want 1", versionRequests)
+		}
+	}
+}
+
+// mockSendFileClient returns a client for a homeserver with a 3 byte upload size limit, which accepts uploads of
+// cat.png and stores the messages sent to !foo:bar in sent, responding with sendCode.
+func mockSendFileClient(sent *FileMessage, sendCode int) *Client {
+	return mockClient(func(req *http.Request) (*http.Response, error) {
+		code, body := 200, `{"event_id":"$file"}`
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/_matrix/media/r0/config":
+			body = `{"m.upload.size":3}`
+		case req.Method == "POST" && req.URL.Path == "/_matrix/media/r0/upload":
+			if req.URL.Query().Get("filename") != "cat.png" || req.Header.Get("Content-Type") != "image/png" {
+				return nil, fmt.Errorf("unexpected upload: %s %s", req.URL, req.Header.Get("Content-Type"))
+			}
+			body = `{"content_uri":"mxc://bar/cat"}`
+		case req.Method == "PUT" && strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/"):
+			if err := json.NewDecoder(req.Body).Decode(sent); err != nil {
+				return nil, err
+			}
+			if code = sendCode; code != 200 {
+				body = `{"errcode":"M_FORBIDDEN","error":"Not allowed"}`
+			}
+		default:
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: code,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+}
+
+func TestClient_SendFileFromReader(t *testing.T) {
+	var sent FileMessage
+	cli := mockSendFileClient(&sent, 200)
+	resp, err := cli.SendFileFromReader(context.Background(), "!foo:bar", "cat.png", strings.NewReader("meow"), "image/png")
+	if err != nil {
+		t.Fatalf("SendFileFromReader: returned error: %s", err)
+	}
+	if resp.EventID != "$file" {
+		t.Fatalf("SendFileFromReader: got event ID %s, want $file", resp.EventID)
+	}
+	if sent.MsgType != "m.image" || sent.Body != "cat.png" || sent.URL != "mxc://bar/cat" || sent.Info.Mimetype != "image/png" {
+		t.Fatalf("SendFileFromReader: sent %+v", sent)
+	}
+
+	cli = mockSendFileClient(&sent, 403)
+	_, err = cli.SendFileFromReader(context.Background(), "!foo:bar", "cat.png", strings.NewReader("meow"), "image/png")
+	if sendErr, ok := err.(SendFileError); !ok || sendErr.ContentURI != "mxc://bar/cat" {
+		t.Fatalf("SendFileFromReader: got error %v, want a SendFileError for mxc://bar/cat", err)
+	}
+}
+
+func TestClient_SendFileFromReaderMediaLimits(t *testing.T) {
+	var sent FileMessage
+	cli := mockSendFileClient(&sent, 200)
+	cli.CheckMediaLimits = true
+	testCases := []struct {
+		Content io.Reader
+		WantErr error
+	}{
+		{strings.NewReader("meow"), ErrFileTooLarge},
+		{bytes.NewBufferString("meow"), ErrFileTooLarge},
+		{strings.NewReader("mew"), nil},
+		{io.MultiReader(strings.NewReader("meow")), nil}, // the length is unknown, so it is not checked
+	}
+	for i, tc := range testCases {
+		if _, err := cli.SendFileFromReader(context.Background(), "!foo:bar", "cat.png", tc.Content, "image/png"); err != tc.WantErr {
+			t.Errorf("SendFileFromReader: test %d: got error %v, want %v", i, err, tc.WantErr)
+		}
+	}
+}
+
+func TestClient_UploadMediaChunked(t *testing.T) {
+	var uploaded string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/media/v1/create" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://test.gomatrix.org/abc"}`)),
+			}, nil
+		}
+		if req.Method == "PUT" && req.URL.Path == "/_matrix/media/v3/upload/test.gomatrix.org/abc" {
+			if req.URL.Query().Get("filename") != "hello.txt" {
+				return nil, fmt.Errorf("unexpected query params: %s", req.URL.RawQuery)
+			}
+			body, _ := ioutil.ReadAll(req.Body)
+			uploaded = string(body)
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	resp, err := cli.UploadMediaChunked(context.Background(), strings.NewReader("hello world"), "text/plain", "hello.txt", 4)
+	if err != nil {
+		t.Fatalf("UploadMediaChunked: error, got %s", err.Error())
+	}
+	if resp.ContentURI != "mxc://test.gomatrix.org/abc" {
+		t.Fatalf("UploadMediaChunked: got content URI %s", resp.ContentURI)
+	}
+	if uploaded != "hello world" {
+		t.Fatalf("UploadMediaChunked: uploaded %q, want %q", uploaded, "hello world")
+	}
+}
+
+func TestClient_DownloadAuthed(t *testing.T) {
+	for _, versions := range []string{`["r0.6.1","v1.11"]`, `["r0.6.1","v1.1"]`} {
+		var gotPath string
+		cli := mockClient(func(req *http.Request) (*http.Response, error) {
+			switch req.URL.Path {
+			case "/_matrix/client/versions":
+				return &http.Response{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(`{"versions":` + versions + `}`)),
+				}, nil
+			case "/_matrix/client/v1/media/download/example.org/abc":
+				if req.Header.Get("Authorization") != "Bearer abcdef" {
+					return nil, fmt.Errorf("authenticated download without a token")
+				}
+			case "/_matrix/media/r0/download/example.org/abc":
+			default:
+				return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+			}
+			gotPath = req.URL.Path
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": []string{"text/plain"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString("hello")),
+			}, nil
+		})
+
+		content, contentType, err := cli.DownloadAuthed("mxc://example.org/abc")
+		if err != nil {
+			t.Fatalf("DownloadAuthed: error, got %s", err.Error())
+		}
+		data, _ := ioutil.ReadAll(content)
+		content.Close()
+		if string(data) != "hello" || contentType != "text/plain" {
+			t.Fatalf("DownloadAuthed: got %q of type %s", data, contentType)
+		}
+		wantPath := "/_matrix/media/r0/download/example.org/abc"
+		if versions == `["r0.6.1","v1.11"]` {
+			wantPath = "/_matrix/client/v1/media/download/example.org/abc"
+		}
+		if gotPath != wantPath {
+			t.Errorf("DownloadAuthed with versions %s: got path %s, want %s", versions, gotPath, wantPath)
+		}
+	}
+}
+
+func TestClient_GetMediaConfigEndpoints(t *testing.T) {
+	testCases := []struct {
+		Versions  string
+		Endpoints MediaEndpoints
+		WantPath  string
+	}{
+		{`{"versions":["v1.11"]}`, MediaEndpointsAuto, "/_matrix/client/v1/media/config"},
+		{`{"versions":["v1.1"],"unstable_features":{"org.matrix.msc3916.stable":true}}`, MediaEndpointsAuto, "/_matrix/client/v1/media/config"},
+		{`{"versions":["v1.1"]}`, MediaEndpointsAuto, "/_matrix/media/r0/config"},
+		{`{"versions":["v1.11"]}`, MediaEndpointsLegacy, "/_matrix/media/r0/config"},
+		{`{"versions":["v1.1"]}`, MediaEndpointsAuthenticated, "/_matrix/client/v1/media/config"},
+	}
+	for _, tc := range testCases {
+		var gotPath string
+		cli := mockClient(func(req *http.Request) (*http.Response, error) {
+			body := `{"m.upload.size":100}`
+			if req.URL.Path == "/_matrix/client/versions" {
+				body = tc.Versions
+			} else {
+				gotPath = req.URL.Path
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+			}, nil
+		})
+		cli.MediaEndpoints = tc.Endpoints
+		if _, err := cli.GetMediaConfig(); err != nil {
+			t.Fatalf("GetMediaConfig: error, got %s", err.Error())
+		}
+		if gotPath != tc.WantPath {
+			t.Errorf("GetMediaConfig with %s and endpoints %d: got path %s, want %s", tc.Versions, tc.Endpoints, gotPath, tc.WantPath)
+		}
+	}
+}
+
+func TestClient_GetKeyServerUserKeys(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cli := mockClient(func(req *http.Request) (*http.Response, error) {
+			var body string
+			switch req.URL.Path {
+			case "/_matrix/client/r0/capabilities":
+				body = fmt.Sprintf(`{"capabilities":{"%s":{"enabled":%t}}}`, KeyServerCapability, enabled)
+			case "/_matrix/client/v1/keys/user/@alice:example.org":
+				body = `{"user_id":"@alice:example.org","device_keys":{"DEV":{"device_id":"DEV","keys":{"ed25519:DEV":"key"}}}}`
+			default:
+				return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+			}, nil
+		})
+
+		resp, err := cli.GetKeyServerUserKeys("@alice:example.org")
+		if !enabled {
+			if err != ErrKeyServerUnsupported {
+				t.Fatalf("GetKeyServerUserKeys: got error %v, want ErrKeyServerUnsupported", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("GetKeyServerUserKeys: error, got %s", err.Error())
+		}
+		if resp.DeviceKeys["DEV"].Keys["ed25519:DEV"] != "key" {
+			t.Fatalf("GetKeyServerUserKeys: unexpected response %+v", resp)
+		}
+	}
+}
+
+func TestClient_UploadToContentRepoCheckMediaLimits(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/media/r0/config" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"m.upload.size":5}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	cli.CheckMediaLimits = true
+
+	if _, err := cli.UploadToContentRepo(strings.NewReader("hello world"), "text/plain", 11); err != ErrFileTooLarge {
+		t.Fatalf("UploadToContentRepo: got error %v, want ErrFileTooLarge", err)
+	}
+}
+
+func TestClient_SendBatch(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!ok:bar/send/m.room.message/") {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$ok"}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 403,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_FORBIDDEN","error":"not in room"}`)),
+		}, nil
+	})
+	cli.MaxConcurrency = 2
+
+	sends := []BatchSendRequest{
+		{"!ok:bar", "m.room.message", TextMessage{"m.text", "hello"}},
+		{"!forbidden:bar", "m.room.message", TextMessage{"m.text", "hello"}},
+		{"!ok:bar", "m.room.message", TextMessage{"m.text", "hello"}},
+	}
+	results := cli.SendBatch(context.Background(), sends)
+	if len(results) != 3 {
+		t.Fatalf("SendBatch: got %d results, want 3", len(results))
+	}
+	for i, res := range results {
+		if wantErr := i == 1; (res.Err != nil) != wantErr {
+			t.Fatalf("SendBatch: result %d: got error %v, want error %t", i, res.Err, wantErr)
+		}
+		if res.Err == nil && res.Response.EventID != "$ok" {
+			t.Fatalf("SendBatch: result %d: got event ID %s, want $ok", i, res.Response.EventID)
+		}
+	}
+}
+
+func TestClient_SendBatchCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var started int32
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&started, 1)
+		cancel()
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	cli.MaxConcurrency = 1
+	sends := []BatchSendRequest{
+		{"!foo:bar", "m.room.message", TextMessage{"m.text", "hello"}},
+		{"!foo:bar", "m.room.message", TextMessage{"m.text", "hello"}},
+	}
+	for i, res := range cli.SendBatch(ctx, sends) {
+		if res.Err == nil {
+			t.Errorf("SendBatch: result %d: got no error after cancelling", i)
+		}
+	}
+	if started != 1 {
+		t.Fatalf("SendBatch: started %d sends, want only the one in progress when ctx was cancelled", started)
+	}
+
+	started = 0
+	for i, res := range cli.SendBatch(ctx, sends) {
+		if res.Err != context.Canceled {
+			t.Errorf("SendBatch: result %d: got error %v with a cancelled ctx, want context.Canceled", i, res.Err)
+		}
+	}
+	if started != 0 {
+		t.Fatalf("SendBatch: started %d sends with a cancelled ctx", started)
+	}
+}
+
+func TestClient_GetRoomSummary(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/_matrix/client/v1/rooms/!foo:bar/summary":
+			return &http.Response{
+				StatusCode: 404,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`)),
+			}, nil
+		case "/_matrix/client/unstable/im.nheko.summary/rooms/!foo:bar/summary":
+			if via := req.URL.Query()["via"]; len(via) != 2 || via[0] != "bar" || via[1] != "baz" {
+				return nil, fmt.Errorf("unexpected via %v", via)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!foo:bar","name":"Foo","num_joined_members":42,"join_rule":"public"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	resp, err := cli.GetRoomSummary("!foo:bar", []string{"bar", "baz"})
+	if err != nil {
+		t.Fatalf("GetRoomSummary: error, got %s", err.Error())
+	}
+	if resp.Name != "Foo" || resp.NumJoinedMembers != 42 || resp.JoinRule != "public" {
+		t.Fatalf("GetRoomSummary: unexpected summary %+v", resp)
+	}
+}
+
+func TestClient_SetRoomName(t *testing.T) {
+	var got map[string]string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.name" {
+			if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$name"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	if err := cli.SetRoomName("!foo:bar", "Foo"); err != nil {
+		t.Fatalf("SetRoomName: error, got %s", err.Error())
+	}
+	if got["name"] != "Foo" {
+		t.Fatalf("SetRoomName: got content %v, want name Foo", got)
+	}
+}
+
+func TestClient_SendStateEvents(t *testing.T) {
+	var sent []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "PUT" || !strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!foo:bar/state/") {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		eventType := strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!foo:bar/state/")
+		sent = append(sent, eventType)
+		if eventType == "m.room.power_levels" {
+			return &http.Response{
+				StatusCode: 403,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_FORBIDDEN","error":"nope"}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$` + eventType + `"}`)),
+		}, nil
+	})
+	testCases := []struct {
+		StopOnError bool
+		Want        int // the number of events sent
+	}{
+		{true, 2},
+		{false, 3},
+	}
+	for _, tc := range testCases {
+		events := []StateEventReq{
+			{Type: "m.room.name", Content: map[string]string{"name": "Foo"}},
+			{Type: "m.room.power_levels", Content: map[string]int{"users_default": 0}, StopOnError: tc.StopOnError},
+			{Type: "m.room.topic", Content: map[string]string{"topic": "Bar"}},
+		}
+		sent = nil
+		resps, err := cli.SendStateEvents("!foo:bar", events)
+		errs, ok := err.(StateEventsError)
+		if !ok {
+			t.Fatalf("SendStateEvents: got error %v, want a StateEventsError", err)
+		}
+		if len(sent) != tc.Want || len(resps) != tc.Want || len(errs.Errors) != tc.Want {
+			t.Fatalf("SendStateEvents(StopOnError=%t): sent %v, got %d responses and %d errors", tc.StopOnError, sent, len(resps), len(errs.Errors))
+		}
+		if resps[0].EventID != "$m.room.name" || errs.Errors[0] != nil || resps[1].EventID != "" || errs.Errors[1] == nil {
+			t.Fatalf("SendStateEvents(StopOnError=%t): unexpected results %v %v", tc.StopOnError, resps, errs.Errors)
+		}
+	}
+}
+
+// mockSpaceClient returns a client which accepts a state event of the given type and state key in the given room,
+// decoding its content into sent.
+func mockSpaceClient(roomID, eventType, stateKey string, sent interface{}) *Client {
+	return mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "PUT" || req.URL.Path != "/_matrix/client/r0/rooms/"+roomID+"/state/"+eventType+"/"+stateKey {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		if err := json.NewDecoder(req.Body).Decode(sent); err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$space"}`)),
+		}, nil
+	})
+}
+
+func TestClient_AddSpaceChild(t *testing.T) {
+	var got SpaceChildContent
+	cli := mockSpaceClient("!space:bar", "m.space.child", "!child:bar", &got)
+	resp, err := cli.AddSpaceChild("!space:bar", "!child:bar", []string{"bar"}, "a", true)
+	if err != nil {
+		t.Fatalf("AddSpaceChild: error, got %s", err.Error())
+	}
+	if resp.EventID != "$space" || strings.Join(got.Via, ",") != "bar" || got.Order != "a" || !got.Suggested {
+		t.Fatalf("AddSpaceChild: got event ID %s with content %+v", resp.EventID, got)
+	}
+}
+
+func TestClient_SetSpaceParent(t *testing.T) {
+	var got SpaceParentContent
+	cli := mockSpaceClient("!child:bar", "m.space.parent", "!space:bar", &got)
+	resp, err := cli.SetSpaceParent("!child:bar", "!space:bar", true, []string{"bar"})
+	if err != nil {
+		t.Fatalf("SetSpaceParent: error, got %s", err.Error())
+	}
+	if resp.EventID != "$space" || strings.Join(got.Via, ",") != "bar" || !got.Canonical {
+		t.Fatalf("SetSpaceParent: got event ID %s with content %+v", resp.EventID, got)
+	}
+}
+
+func TestClient_RemoveSpaceChild(t *testing.T) {
+	var got map[string]interface{}
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && req.URL.Path == "/_matrix/client/r0/rooms/!space:bar/state/m.space.child/!child:bar" {
+			if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$removed"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	resp, err := cli.RemoveSpaceChild("!space:bar", "!child:bar")
+	if err != nil {
+		t.Fatalf("RemoveSpaceChild: error, got %s", err.Error())
+	}
+	if resp.EventID != "$removed" || len(got) != 0 {
+		t.Fatalf("RemoveSpaceChild: got event ID %s with content %v, want empty content", resp.EventID, got)
+	}
+}
+
+func TestClient_UnbanUser(t *testing.T) {
+	var body ReqUnbanUser
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/unban" {
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	if _, err := cli.UnbanUser("!foo:bar", &ReqUnbanUser{UserID: "@bob:bar", Reason: "appeal accepted"}); err != nil {
+		t.Fatalf("UnbanUser: error, got %s", err.Error())
+	}
+	if body.UserID != "@bob:bar" || body.Reason != "appeal accepted" {
+		t.Fatalf("UnbanUser: unexpected request body %+v", body)
+	}
+}
+
+func TestClient_ForgetRoom(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/forget" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	if _, err := cli.ForgetRoom("!foo:bar"); err != nil {
+		t.Fatalf("ForgetRoom: error, got %s", err.Error())
+	}
+}
+
+func TestClient_RegisterStage(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.Path != "/_matrix/client/r0/register" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		var body struct {
+			Auth ReqUIAuth `json:"auth"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		uia := `{"session":"sess","flows":[{"stages":["m.login.terms","m.login.dummy"]}],"params":{}`
+		switch body.Auth.Type {
+		case "":
+			uia += `,"completed":[]}`
+		case AuthTypeTerms:
+			uia += `,"completed":["m.login.terms"]}`
+		case AuthTypeDummy:
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"user_id":"@alice:test.gomatrix.org","access_token":"token"}`)),
+			}, nil
+		}
+		if body.Auth.Type != "" && body.Auth.Session != "sess" {
+			return nil, fmt.Errorf("session not carried over, got %q", body.Auth.Session)
+		}
+		return &http.Response{
+			StatusCode: 401,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(uia)),
+		}, nil
+	})
+
+	req := &ReqRegister{Username: "alice", Password: "wonderland"}
+	res, uia, err := cli.Register(req)
+	var stages []string
+	for err == nil && res == nil {
+		stage := uia.NextStage()
+		stages = append(stages, stage)
+		res, uia, err = cli.RegisterStage(req, uia, ReqUIAuth{Type: stage})
+	}
+	if err != nil {
+		t.Fatalf("RegisterStage: error, got %s", err.Error())
+	}
+	if len(stages) != 2 || stages[0] != AuthTypeTerms || stages[1] != AuthTypeDummy {
+		t.Fatalf("RegisterStage: completed stages %v, want [m.login.terms m.login.dummy]", stages)
+	}
+	if res.AccessToken != "token" {
+		t.Fatalf("RegisterStage: got access token %s, want token", res.AccessToken)
+	}
+}
+
+func TestClient_LogoutAll(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/logout/all" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	if _, err := cli.LogoutAll(); err != nil {
+		t.Fatalf("LogoutAll: error, got %s", err.Error())
+	}
+	if cli.AccessToken != "" || cli.UserID != "" {
+		t.Fatalf("LogoutAll: credentials not cleared, got user %s token %s", cli.UserID, cli.AccessToken)
+	}
+}
+
+func TestClient_SetReadMarker(t *testing.T) {
+	var got map[string]string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/read_markers" {
+			got = nil
+			if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	if err := cli.SetReadMarker("!foo:bar", "$read", "$receipt"); err != nil {
+		t.Fatalf("SetReadMarker: error, got %s", err.Error())
+	}
+	if len(got) != 2 || got["m.fully_read"] != "$read" || got["m.read"] != "$receipt" {
+		t.Fatalf("SetReadMarker: unexpected request %v", got)
+	}
+	if err := cli.SetReadMarker("!foo:bar", "$read", ""); err != nil {
+		t.Fatalf("SetReadMarker: error, got %s", err.Error())
+	}
+	if _, ok := got["m.read"]; ok || len(got) != 1 {
+		t.Fatalf("SetReadMarker: sent %v, want only m.fully_read", got)
+	}
+}
+
+func TestClient_GetNotifications(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/notifications" {
+			q := req.URL.Query()
+			if q.Get("from") != "t1" || q.Get("only") != "highlight" || q.Get("limit") != "10" {
+				return nil, fmt.Errorf("unexpected params: %s", req.URL.RawQuery)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(bytes.NewBufferString(`{"next_token":"t2","notifications":[{"actions":["notify"],
+					"event":{"type":"m.room.message","event_id":"$msg"},"profile_tag":"hcbvkzxhcvb","read":true,"room_id":"!foo:bar","ts":1475508881945}]}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	resp, err := cli.GetNotifications("t1", "highlight", 10)
+	if err != nil {
+		t.Fatalf("GetNotifications: error, got %s", err.Error())
+	}
+	if resp.NextToken != "t2" || len(resp.Notifications) != 1 {
+		t.Fatalf("GetNotifications: unexpected response %+v", resp)
+	}
+	n := resp.Notifications[0]
+	if n.Event.ID != "$msg" || n.RoomID != "!foo:bar" || !n.Read || n.TS != 1475508881945 || n.ProfileTag != "hcbvkzxhcvb" {
+		t.Fatalf("GetNotifications: unexpected notification %+v", n)
+	}
+}
+
+func TestClient_GetAnnotationAggregations(t *testing.T) {
+	pages := map[string]string{
+		"": `{"next_batch":"p2","chunk":[
+			{"type":"m.reaction","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$msg","key":"👍"}}},
+			{"type":"m.reaction","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$msg","key":"🎉"}}}]}`,
+		"p2": `{"chunk":[{"type":"m.reaction","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$msg","key":"👍"}}}]}`,
+	}
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/v1/rooms/!foo:bar/relations/$msg/m.annotation/m.reaction" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		page, ok := pages[req.URL.Query().Get("from")]
+		if !ok {
+			return nil, fmt.Errorf("unexpected from: %s", req.URL.RawQuery)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(page)),
+		}, nil
+	})
+	resp, err := cli.GetAnnotationAggregations("!foo:bar", "$msg")
+	if err != nil {
+		t.Fatalf("GetAnnotationAggregations: error, got %s", err.Error())
+	}
+	want := []AnnotationGroup{{"👍", 2}, {"🎉", 1}}
+	if len(resp.Chunk) != len(want) || resp.Chunk[0] != want[0] || resp.Chunk[1] != want[1] {
+		t.Fatalf("GetAnnotationAggregations: got %v, want %v", resp.Chunk, want)
+	}
+}
+
+func TestEvent_Redact(t *testing.T) {
+	var reason string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!foo:bar/redact/$spam/") {
+			var body ReqRedact
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return nil, err
+			}
+			reason = body.Reason
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$redaction"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	if _, err := (&Event{RoomID: "!foo:bar"}).Redact(cli, "spam"); err != ErrMissingEventID {
+		t.Fatalf("Redact: got error %v, want ErrMissingEventID", err)
+	}
+	if _, err := (&Event{ID: "$spam"}).Redact(cli, "spam"); err != ErrMissingRoomID {
+		t.Fatalf("Redact: got error %v, want ErrMissingRoomID", err)
+	}
+	resp, err := (&Event{ID: "$spam", RoomID: "!foo:bar"}).Redact(cli, "spam")
+	if err != nil {
+		t.Fatalf("Redact: error, got %s", err.Error())
+	}
+	if resp.EventID != "$redaction" || reason != "spam" {
+		t.Fatalf("Redact: got event ID %s with reason %q", resp.EventID, reason)
+	}
+}
+
+func TestClient_ReportContent(t *testing.T) {
+	var got ReqReportContent
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/report/$spam" {
+			if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	if err := cli.ReportContent("!foo:bar", "$spam", "spam", -100); err != nil {
+		t.Fatalf("ReportContent: error, got %s", err.Error())
+	}
+	if got.Reason != "spam" || got.Score != -100 {
+		t.Fatalf("ReportContent: unexpected request %+v", got)
+	}
+	for _, score := range []int{-101, 1} {
+		if err := cli.ReportContent("!foo:bar", "$spam", "spam", score); err == nil {
+			t.Errorf("ReportContent: no error for score %d", score)
+		}
+	}
+}
+
+func TestClient_StateEventFull(t *testing.T) {
+	for _, honoursFormat := range []bool{true, false} {
+		cli := mockClient(func(req *http.Request) (*http.Response, error) {
+			var body string
+			switch req.URL.Path {
+			case "/_matrix/client/r0/rooms/!foo:bar/state/m.room.topic":
+				body = `{"topic":"hello"}`
+				if honoursFormat && req.URL.Query().Get("format") == "event" {
+					body = `{"type":"m.room.topic","state_key":"","sender":"@alice:bar","origin_server_ts":1234,"content":{"topic":"hello"}}`
+				}
+			case "/_matrix/client/r0/rooms/!foo:bar/state":
+				body = `[{"type":"m.room.name","state_key":"","sender":"@bob:bar","content":{"name":"Foo"}},
+					{"type":"m.room.topic","state_key":"","sender":"@alice:bar","origin_server_ts":1234,"content":{"topic":"hello"}}]`
+			default:
+				return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+			}, nil
+		})
+		event, err := cli.StateEventFull("!foo:bar", "m.room.topic", "")
+		if err != nil {
+			t.Fatalf("StateEventFull: error, got %s", err.Error())
+		}
+		if event.Sender != "@alice:bar" || event.Timestamp != 1234 || event.Content["topic"] != "hello" || event.RoomID != "!foo:bar" {
+			t.Fatalf("StateEventFull: unexpected event %+v", event)
+		}
+	}
+}
+
+func TestClient_StateEventFullSpaceCreate(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.URL.Path {
+		case "/_matrix/client/r0/rooms/!space:bar/state/m.room.create":
+			// The content of a space's create event, from a homeserver which ignores format=event.
+			body = `{"creator":"@alice:bar","room_version":"9","type":"m.space"}`
+		case "/_matrix/client/r0/rooms/!space:bar/state":
+			body = `[{"type":"m.room.create","state_key":"","sender":"@alice:bar",
+				"content":{"creator":"@alice:bar","room_version":"9","type":"m.space"}}]`
+		default:
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	event, err := cli.StateEventFull("!space:bar", "m.room.create", "")
+	if err != nil {
+		t.Fatalf("StateEventFull: error, got %s", err.Error())
+	}
+	if event.Type != "m.room.create" || event.Sender != "@alice:bar" || event.Content["type"] != "m.space" {
+		t.Fatalf("StateEventFull: got %+v, want the space's create event", event)
+	}
+}
+
+func TestClient_CreateRoomDefaultVersion(t *testing.T) {
+	var roomVersion string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.URL.Path {
+		case "/_matrix/client/r0/capabilities":
+			body = `{"capabilities":{"m.room_versions":{"default":"6","available":{"1":"stable","6":"stable","org.example.7":"unstable"}}}}`
+		case "/_matrix/client/r0/createRoom":
+			var createReq ReqCreateRoom
+			if err := json.NewDecoder(req.Body).Decode(&createReq); err != nil {
+				return nil, err
+			}
+			roomVersion = createReq.RoomVersion
+			body = `{"room_id":"!new:bar"}`
+		default:
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+
+	available, defaultVersion, err := cli.DiscoverSupportedRoomVersions()
+	if err != nil {
+		t.Fatalf("DiscoverSupportedRoomVersions: returned error: %s", err)
+	}
+	if defaultVersion != "6" || len(available) != 3 || available["org.example.7"] != "unstable" {
+		t.Fatalf("DiscoverSupportedRoomVersions: got %v, %s", available, defaultVersion)
+	}
+
+	req := &ReqCreateRoom{Name: "test"}
+	if _, err = cli.CreateRoom(req); err != nil {
+		t.Fatalf("CreateRoom: returned error: %s", err)
+	}
+	if roomVersion != "6" {
+		t.Fatalf("CreateRoom: sent room version %q, want the default 6", roomVersion)
+	}
+	if req.RoomVersion != "" {
+		t.Fatalf("CreateRoom: modified the request")
+	}
+	if _, err = cli.CreateRoom(&ReqCreateRoom{RoomVersion: "1"}); err != nil {
+		t.Fatalf("CreateRoom: returned error: %s", err)
+	}
+	if roomVersion != "1" {
+		t.Fatalf("CreateRoom: sent room version %q, want the requested 1", roomVersion)
+	}
+}
+
+// mockStateClient returns a client for a homeserver where the room !set:bar has a state event of the given type
+// with the given content and other rooms have none. Sending the state event to any room stores its content in sent.
+func mockStateClient(eventType, content string, sent *map[string]interface{}) *Client {
+	return mockClient(func(req *http.Request) (*http.Response, error) {
+		code, body := 200, content
+		switch {
+		case !strings.HasSuffix(req.URL.Path, "/state/"+eventType):
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		case req.Method == "PUT":
+			if err := json.NewDecoder(req.Body).Decode(sent); err != nil {
+				return nil, err
+			}
+			body = `{"event_id":"$state"}`
+		case req.URL.Path != "/_matrix/client/r0/rooms/!set:bar/state/"+eventType:
+			code, body = 404, `{"errcode":"M_NOT_FOUND","error":"Event not found"}`
+		}
+		return &http.Response{
+			StatusCode: code,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+}
+
+func TestClient_RoomGuestAccess(t *testing.T) {
+	var sent map[string]interface{}
+	cli := mockStateClient("m.room.guest_access", `{"guest_access":"can_join"}`, &sent)
+	testCases := []struct {
+		RoomID string
+		Want   string
+	}{
+		{"!set:bar", GuestAccessCanJoin},
+		{"!unset:bar", GuestAccessForbidden}, // the default without the state event
+	}
+	for _, tc := range testCases {
+		if access, err := cli.GetRoomGuestAccess(tc.RoomID); err != nil || access != tc.Want {
+			t.Errorf("GetRoomGuestAccess: got %s, %v for %s, want %s", access, err, tc.RoomID, tc.Want)
+		}
+	}
+	if resp, err := cli.SetRoomGuestAccess("!set:bar", GuestAccessForbidden); err != nil || resp.EventID != "$state" || sent["guest_access"] != "forbidden" {
+		t.Fatalf("SetRoomGuestAccess: got %v, %v and sent %v", resp, err, sent)
+	}
+	if _, err := cli.SetRoomGuestAccess("!set:bar", "sometimes"); err != ErrInvalidGuestAccess {
+		t.Fatalf("SetRoomGuestAccess: got error %v, want ErrInvalidGuestAccess", err)
+	}
+}
+
+func TestClient_HistoryVisibility(t *testing.T) {
+	var sent map[string]interface{}
+	cli := mockStateClient("m.room.history_visibility", `{"history_visibility":"world_readable"}`, &sent)
+	testCases := []struct {
+		RoomID string
+		Want   string
+	}{
+		{"!set:bar", HistoryVisibilityWorldReadable},
+		{"!unset:bar", HistoryVisibilityShared}, // the default without the state event
+	}
+	for _, tc := range testCases {
+		if visibility, err := cli.GetHistoryVisibility(tc.RoomID); err != nil || visibility != tc.Want {
+			t.Errorf("GetHistoryVisibility: got %s, %v for %s, want %s", visibility, err, tc.RoomID, tc.Want)
+		}
+	}
+	if resp, err := cli.SetHistoryVisibility("!set:bar", HistoryVisibilityJoined); err != nil || resp.EventID != "$state" || sent["history_visibility"] != "joined" {
+		t.Fatalf("SetHistoryVisibility: got %v, %v and sent %v", resp, err, sent)
+	}
+	if _, err := cli.SetHistoryVisibility("!set:bar", "everyone"); err != ErrInvalidHistoryVisibility {
+		t.Fatalf("SetHistoryVisibility: got error %v, want ErrInvalidHistoryVisibility", err)
+	}
+}
+
+func TestClient_EnableEncryption(t *testing.T) {
+	var sent map[string]interface{}
+	cli := mockStateClient("m.room.encryption", `{"algorithm":"m.megolm.v1.aes-sha2","rotation_period_msgs":100}`, &sent)
+	testCases := []struct {
+		RoomID        string
+		WantAlgorithm string // "" for no encryption state
+		WantRotation  int
+	}{
+		{"!set:bar", "m.megolm.v1.aes-sha2", 100},
+		{"!unset:bar", "", 0},
+	}
+	for _, tc := range testCases {
+		state, err := cli.GetEncryptionState(tc.RoomID)
+		var got EncryptionContent
+		if state != nil {
+			got = *state
+		}
+		if err != nil || (state == nil) != (tc.WantAlgorithm == "") || got.Algorithm != tc.WantAlgorithm || got.RotationPeriodMessages != tc.WantRotation {
+			t.Errorf("GetEncryptionState: got %+v, %v for %s, want %s", state, err, tc.RoomID, tc.WantAlgorithm)
+		}
+	}
+	if _, err := cli.EnableEncryption("!set:bar", "m.megolm.v1.aes-sha2"); err != ErrEncryptionAlreadyEnabled {
+		t.Fatalf("EnableEncryption: got error %v, want ErrEncryptionAlreadyEnabled", err)
+	}
+	resp, err := cli.EnableEncryption("!unset:bar", "m.megolm.v1.aes-sha2")
+	if err != nil || resp.EventID != "$state" || sent["algorithm"] != "m.megolm.v1.aes-sha2" {
+		t.Fatalf("EnableEncryption: got %v, %v and sent %v", resp, err, sent)
+	}
+}
+
+func TestClient_SetDisplayNameVerified(t *testing.T) {
+	var stored string
+	rewrite := false
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/profile/@user:test.gomatrix.org/displayname" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		body := `{}`
+		switch req.Method {
+		case "PUT":
+			var content map[string]string
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				return nil, err
+			}
+			if !rewrite {
+				stored = content["displayname"]
+			}
+		case "GET":
+			body = `{"displayname":"` + stored + `"}`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	if err := cli.SetDisplayNameVerified("Alice"); err != nil {
+		t.Fatalf("SetDisplayNameVerified: returned error: %s", err)
+	}
+	rewrite = true
+	err := cli.SetDisplayNameVerified("Mallory")
+	if profileErr, ok := err.(ProfileNotUpdatedError); !ok || profileErr.Want != "Mallory" || profileErr.Got != "Alice" {
+		t.Fatalf("SetDisplayNameVerified: got error %v, want a ProfileNotUpdatedError", err)
+	}
+}
+
+func TestClient_RetryAfterMS(t *testing.T) {
+	testCases := []struct {
+		Header string
+		Body   string
+		Want   int64
+	}{
+		{"", `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":2500}`, 2500},
+		{"3", `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":2500}`, 3000},
+		{time.Unix(0, 0).UTC().Format(http.TimeFormat), `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests"}`, 0},
+		{"", `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests"}`, 0},
+		{"", `<html>Too many requests</html>`, 0},
+	}
+	for _, tc := range testCases {
+		cli := mockClient(func(req *http.Request) (*http.Response, error) {
+			header := make(http.Header)
+			if tc.Header != "" {
+				header.Set("Retry-After", tc.Header)
+			}
+			return &http.Response{
+				StatusCode: 429,
+				Header:     header,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(tc.Body)),
+			}, nil
+		})
+		_, err := cli.MakeRequest("GET", cli.BuildURL("sync"), nil, nil)
+		httpErr, ok := err.(HTTPError)
+		if !ok || httpErr.Code != 429 {
+			t.Fatalf("MakeRequest: got error %v, want an HTTPError with code 429", err)
+		}
+		if httpErr.RetryAfterMS != tc.Want {
+			t.Errorf("MakeRequest: got RetryAfterMS %d for header %q and body %s, want %d", httpErr.RetryAfterMS, tc.Header, tc.Body, tc.Want)
+		}
+	}
+
+	future := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 429,
+			Header:     http.Header{"Retry-After": []string{future}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+		}, nil
+	})
+	_, err := cli.MakeRequest("GET", cli.BuildURL("sync"), nil, nil)
+	if httpErr, ok := err.(HTTPError); !ok || httpErr.RetryAfterMS < 50000 || httpErr.RetryAfterMS > 60000 {
+		t.Fatalf("MakeRequest: got %v for a Retry-After date a minute away, want about 60000ms", err)
+	}
+}
+
+func TestClient_SetServerACL(t *testing.T) {
+	var sent map[string]interface{}
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "PUT" || req.URL.Path != "/_matrix/client/r0/rooms/!foo:bar/state/m.room.server_acl" {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		if err := json.NewDecoder(req.Body).Decode(&sent); err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$acl"}`)),
+		}, nil
+	})
+	if err := cli.SetServerACL("!foo:bar", []string{"*"}, nil, false); err != nil {
+		t.Fatalf("SetServerACL: returned error: %s", err)
+	}
+	deny, ok := sent["deny"].([]interface{})
+	if !ok || len(deny) != 0 || sent["allow_ip_literals"] != false {
+		t.Fatalf("SetServerACL: sent %v, want an empty deny list and allow_ip_literals false", sent)
+	}
+
+	sent = nil
+	testCases := []struct {
+		Allow []string
+		Deny  []string
+	}{
+		{nil, nil},
+		{[]string{"*"}, []string{"*.gomatrix.org"}},
+	}
+	for _, tc := range testCases {
+		if err := cli.SetServerACL("!foo:bar", tc.Allow, tc.Deny, true); err != ErrServerACLDeniesOwnServer {
+			t.Fatalf("SetServerACL(%v, %v): got error %v, want ErrServerACLDeniesOwnServer", tc.Allow, tc.Deny, err)
+		}
+	}
+	if sent != nil {
+		t.Fatalf("SetServerACL: sent an ACL which denies the client's own server")
+	}
+}
+
+func TestClient_FollowTombstone(t *testing.T) {
+	var joined []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		var code = 200
+		var body string
+		switch {
+		case req.URL.Path == "/_matrix/client/r0/rooms/!v1:bar/state/m.room.tombstone":
+			body = `{"type":"m.room.tombstone","state_key":"","sender":"@admin:bar","content":{"body":"upgraded","replacement_room":"!v2:bar"}}`
+		case req.URL.Path == "/_matrix/client/r0/rooms/!v2:bar/state/m.room.tombstone":
+			body = `{"type":"m.room.tombstone","state_key":"","sender":"@admin:baz","content":{"replacement_room":"!v3:baz"}}`
+		case strings.HasSuffix(req.URL.Path, "/state/m.room.tombstone"):
+			code, body = 404, `{"errcode":"M_NOT_FOUND","error":"Event not found"}`
+		case req.Method == "POST" && strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/join/"):
+			roomID := strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0/join/")
+			joined = append(joined, roomID+" via "+req.URL.Query().Get("server_name"))
+			body = `{"room_id":"` + roomID + `"}`
+		default:
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: code,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	newRoomID, err := cli.FollowTombstone("!v1:bar")
+	if err != nil || newRoomID != "!v3:baz" {
+		t.Fatalf("FollowTombstone: got %s, %v, want !v3:baz", newRoomID, err)
+	}
+	if strings.Join(joined, ", ") != "!v2:bar via bar, !v3:baz via baz" {
+		t.Fatalf("FollowTombstone: joined %v", joined)
+	}
+	if _, err = cli.FollowTombstone("!v3:baz"); err != ErrNoTombstone {
+		t.Fatalf("FollowTombstone: got error %v for a room without a tombstone, want ErrNoTombstone", err)
+	}
+}
+
+func TestClient_IterateMembers(t *testing.T) {
+	fail := false
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/rooms/!foo:bar/members" || req.URL.Query().Get("membership") != "join" {
+			return nil, fmt.Errorf("unhandled request: %s", req.URL)
+		}
+		if fail {
+			return &http.Response{
+				StatusCode: 403,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_FORBIDDEN"}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`{"chunk":[
+				{"type":"m.room.member","state_key":"@a:bar","content":{"membership":"join","displayname":"A"}},
+				{"type":"m.room.member","content":{"membership":"join"}},
+				{"type":"m.room.member","state_key":"@b:bar","content":{"membership":"join"}}
+			]}`)),
+		}, nil
+	})
+
+	it := cli.IterateMembers("!foo:bar", "join", "")
+	var users []string
+	for it.Next() {
+		users = append(users, it.Value().UserID+"="+it.Value().DisplayName)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("IterateMembers: returned error: %s", err)
+	}
+	if strings.Join(users, ",") != "@a:bar=A,@b:bar=" || it.Value() != nil {
+		t.Fatalf("IterateMembers: got %v", users)
+	}
+
+	fail = true
+	it = cli.IterateMembers("!foo:bar", "join", "")
+	if it.Next() || it.Err() == nil {
+		t.Fatalf("IterateMembers: expected an error")
+	}
+}
+
+// decodePublicRoomsRequest decodes the body of a POST /publicRooms request for the given server.
+func decodePublicRoomsRequest(req *http.Request, server string) (*ReqPublicRooms, error) {
+	if req.Method != "POST" || req.URL.Path != "/_matrix/client/r0/publicRooms" || req.URL.Query().Get("server") != server {
+		return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL)
+	}
+	var body ReqPublicRooms
+	err := json.NewDecoder(req.Body).Decode(&body)
+	return &body, err
+}
+
+// collectPublicRooms returns the room IDs from a StreamPublicRooms stream and its error.
+func collectPublicRooms(rooms <-chan PublicRoom, errs <-chan error) ([]string, error) {
+	var got []string
+	for room := range rooms {
+		got = append(got, room.RoomID)
+	}
+	return got, <-errs
+}
+
+func TestClient_StreamPublicRooms(t *testing.T) {
+	pages := map[string]string{
+		"":   `{"chunk":[{"room_id":"!a:bar"},{"room_id":"!b:bar"}],"next_batch":"p2"}`,
+		"p2": `{"chunk":[{"room_id":"!c:bar","name":"C"}]}`,
+	}
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		body, err := decodePublicRoomsRequest(req, "other.bar")
+		if err != nil {
+			return nil, err
+		}
+		if body.Limit != 2 || body.Filter == nil || body.Filter.GenericSearchTerm != "chat" {
+			return nil, fmt.Errorf("unexpected request body: %+v", body)
+		}
+		page, ok := pages[body.Since]
+		if !ok {
+			return &http.Response{
+				StatusCode: 400,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNKNOWN"}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(page)),
+		}, nil
+	})
+	cli.PublicRoomsPageSize = 2
+
+	got, err := collectPublicRooms(cli.StreamPublicRooms(context.Background(), "other.bar", &PublicRoomsFilter{GenericSearchTerm: "chat"}))
+	if err != nil {
+		t.Fatalf("StreamPublicRooms: returned error: %s", err)
+	}
+	if strings.Join(got, ",") != "!a:bar,!b:bar,!c:bar" {
+		t.Fatalf("StreamPublicRooms: got %v", got)
+	}
+
+	pages["p2"] = `{"chunk":[{"room_id":"!c:bar"}],"next_batch":"missing"}`
+	got, err = collectPublicRooms(cli.StreamPublicRooms(context.Background(), "other.bar", &PublicRoomsFilter{GenericSearchTerm: "chat"}))
+	if err == nil || len(got) != 3 {
+		t.Fatalf("StreamPublicRooms: got %v, %v, want 3 rooms and an error", got, err)
+	}
+}
+
+func TestClient_StreamPublicRoomsCancel(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{ // an endless directory
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"chunk":[{"room_id":"!a:bar"},{"room_id":"!b:bar"}],"next_batch":"next"}`)),
+		}, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	rooms, errs := cli.StreamPublicRooms(ctx, "", nil)
+	<-rooms
+	cancel()
+	for range rooms {
+	}
+	// The error is sent even though nothing is receiving it yet, so the goroutine can exit.
+	deadline := time.Now().Add(time.Second)
+	for len(errs) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(errs) != 1 {
+		t.Fatal("StreamPublicRooms: goroutine is blocked sending the error")
+	}
+	if err := <-errs; err == nil {
+		t.Fatal("StreamPublicRooms: got no error after cancelling, want one")
+	}
+	if _, ok := <-errs; ok {
+		t.Fatal("StreamPublicRooms: error channel was not closed")
+	}
+}
+
+func TestClient_MembersIterator(t *testing.T) {
+	members := map[string][]string{"join": {"@a:bar", "@b:bar"}, "invite": {"@c:bar"}, "ban": {"@d:bar"}}
+	var requested []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		q := req.URL.Query()
+		if req.URL.Path != "/_matrix/client/r0/rooms/!foo:bar/members" || q.Get("at") != "s1" || q.Get("not_membership") != "" {
+			return nil, fmt.Errorf("unhandled request: %s", req.URL)
+		}
+		membership := q.Get("membership")
+		requested = append(requested, membership)
+		var events []string
+		for _, user := range members[membership] {
+			events = append(events, `{"type":"m.room.member","state_key":"`+user+`","content":{"membership":"`+membership+`"}}`)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"chunk":[` + strings.Join(events, ",") + `]}`)),
+		}, nil
+	})
+
+	it := cli.NewMembersIterator("!foo:bar", &ReqMembers{At: "s1", NotMembership: "leave"})
+	if len(requested) != 0 {
+		t.Fatalf("NewMembersIterator: made a request before Next")
+	}
+	var users []string
+	for it.Next() {
+		if len(users) == 0 && len(requested) != 1 {
+			t.Fatalf("Next: made %d requests for the first member, want 1", len(requested))
+		}
+		users = append(users, it.Value().UserID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Next: returned error: %s", err)
+	}
+	if strings.Join(users, " ") != "@a:bar @b:bar @c:bar @d:bar" || strings.Join(requested, " ") != "join invite knock ban" {
+		t.Fatalf("Next: got %v with requests for %v, want 4 members with a request for each membership but leave", users, requested)
+	}
+}
+
+func TestClient_RejectInvite(t *testing.T) {
+	var reason string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.Path != "/_matrix/client/r0/rooms/!foo:bar/leave" {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		var body map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		reason = body["reason"]
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+		}, nil
+	})
+	syncer := cli.Syncer.(*DefaultSyncer)
+	if err := cli.RejectInvite("!foo:bar", "not interested"); err != nil {
+		t.Fatalf("RejectInvite: returned error: %s", err)
+	}
+	if reason != "not interested" {
+		t.Fatalf("RejectInvite: sent reason %q", reason)
+	}
+	if !syncer.rejectedInvites(&RespSync{})["!foo:bar"] {
+		t.Fatalf("RejectInvite: the syncer was not told about the rejection")
+	}
+}
+
+func TestClient_GetRoomVersion(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.URL.Path {
+		case "/_matrix/client/r0/rooms/!new:bar/state/m.room.create":
+			body = `{"creator":"@alice:bar","room_version":"9"}`
+		case "/_matrix/client/r0/rooms/!old:bar/state/m.room.create":
+			body = `{"creator":"@alice:bar"}`
+		default:
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	for roomID, want := range map[string]string{"!new:bar": "9", "!old:bar": "1"} {
+		version, err := cli.GetRoomVersion(roomID)
+		if err != nil {
+			t.Fatalf("GetRoomVersion(%s): returned error: %s", roomID, err)
+		}
+		if version != want {
+			t.Fatalf("GetRoomVersion(%s): got %s, want %s", roomID, version, want)
+		}
+	}
+}
+
+func TestClient_DefaultRoomVersion(t *testing.T) {
+	requests := 0
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/capabilities" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		requests++
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"capabilities":{"m.room_versions":{"default":"9","available":{"9":"stable"}}}}`)),
+		}, nil
+	})
+	for i := 0; i < 2; i++ {
+		if version, err := cli.DefaultRoomVersion(); err != nil || version != "9" {
+			t.Fatalf("DefaultRoomVersion: got %s, %v, want 9", version, err)
+		}
+	}
+	if available, _, err := cli.DiscoverSupportedRoomVersions(); err != nil || available["9"] != "stable" {
+		t.Fatalf("DiscoverSupportedRoomVersions: got %v, %v", available, err)
+	}
+	if requests != 1 {
+		t.Fatalf("DefaultRoomVersion: made %d requests, want 1 with the capabilities cached", requests)
+	}
+
+	cli = mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`)),
+		}, nil
+	})
+	if version, err := cli.DefaultRoomVersion(); err != nil || version != "" {
+		t.Fatalf("DefaultRoomVersion: got %q, %v without /capabilities, want \"\"", version, err)
+	}
+}
+
+func TestClient_GetRoomIDForAlias(t *testing.T) {
+	requests := 0
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/_matrix/client/r0/directory/room/#missing:bar" {
+			return &http.Response{
+				StatusCode: 404,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"Room alias not found"}`)),
+			}, nil
+		}
+		if req.URL.Path != "/_matrix/client/r0/directory/room/#foo:bar" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		requests++
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!foo:bar","servers":["bar","baz"]}`)),
+		}, nil
+	})
+	for i := 0; i < 2; i++ {
+		resp, err := cli.GetRoomIDForAlias("#foo:bar")
+		if err != nil {
+			t.Fatalf("GetRoomIDForAlias: returned error: %s", err)
+		}
+		if resp.RoomID != "!foo:bar" || len(resp.Servers) != 2 {
+			t.Fatalf("GetRoomIDForAlias: got %+v", resp)
+		}
+		resp.Servers[0] = "modified"
+	}
+	if requests != 1 {
+		t.Fatalf("GetRoomIDForAlias: made %d requests, want 1 with the second lookup cached", requests)
+	}
+	if _, err := cli.GetRoomIDForAlias("#missing:bar"); err == nil {
+		t.Fatalf("GetRoomIDForAlias: expected an error for an unknown alias")
+	}
+
+	cli.AliasCacheTTL = -1
+	if _, err := cli.GetRoomIDForAlias("#foo:bar"); err != nil {
+		t.Fatalf("GetRoomIDForAlias: returned error: %s", err)
+	}
+	if requests != 2 {
+		t.Fatalf("GetRoomIDForAlias: made %d requests, want 2 with caching disabled", requests)
+	}
+}
+
+func TestClient_AliasCacheExpiry(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!foo:bar","servers":["bar"]}`)),
+		}, nil
+	})
+	cli.aliasCache = map[string]aliasCacheEntry{"#old:bar": {expires: time.Now().Add(-time.Minute)}}
+	if _, err := cli.GetRoomIDForAlias("#foo:bar"); err != nil {
+		t.Fatalf("GetRoomIDForAlias: returned error: %s", err)
+	}
+	if _, ok := cli.aliasCache["#old:bar"]; ok || len(cli.aliasCache) != 1 {
+		t.Fatalf("GetRoomIDForAlias: got cache %v, want the expired lookup removed", cli.aliasCache)
+	}
+
+	cli.aliasCache["#foo:bar"] = aliasCacheEntry{expires: time.Now().Add(-time.Minute)}
+	if _, ok := cli.cachedAlias("#foo:bar"); ok || len(cli.aliasCache) != 0 {
+		t.Fatalf("cachedAlias: got cache %v, want the expired lookup removed", cli.aliasCache)
+	}
+}
+
+func TestClient_GetRoomAliases(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		var code int
+		var body string
+		switch req.URL.Path {
+		case "/_matrix/client/versions":
+			code, body = 200, `{"versions":["r0.6.1"]}`
+		case "/_matrix/client/r0/rooms/!aliased:bar/aliases":
+			code, body = 200, `{"aliases":["#foo:bar","#baz:bar"]}`
+		case "/_matrix/client/r0/rooms/!unaliased:bar/aliases":
+			code, body = 200, `{"aliases":[]}`
+		case "/_matrix/client/r0/rooms/!private:bar/aliases":
+			code, body = 403, `{"errcode":"M_FORBIDDEN","error":"You are not in the room"}`
+		default:
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: code,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	aliases, err := cli.GetRoomAliases("!aliased:bar")
+	if err != nil || len(aliases) != 2 || aliases[0] != "#foo:bar" {
+		t.Fatalf("GetRoomAliases: got %v, %v, want [#foo:bar #baz:bar]", aliases, err)
+	}
+	aliases, err = cli.GetRoomAliases("!unaliased:bar")
+	if err != nil || aliases == nil || len(aliases) != 0 {
+		t.Fatalf("GetRoomAliases: got %#v, %v for a room without aliases, want an empty slice", aliases, err)
+	}
+	_, err = cli.GetRoomAliases("!private:bar")
+	if httpErr, ok := err.(HTTPError); !ok || httpErr.Code != 403 {
+		t.Fatalf("GetRoomAliases: got error %v, want an HTTPError with code 403", err)
+	}
+}
+
+func TestClient_GetPinnedEvents(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/_matrix/client/r0/rooms/!pinned:bar/state/m.room.pinned_events":
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"pinned":["$a","$b"]}`)),
+			}, nil
+		case "/_matrix/client/r0/rooms/!unpinned:bar/state/m.room.pinned_events":
+			return &http.Response{
+				StatusCode: 404,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"Event not found."}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	pinned, err := cli.GetPinnedEvents("!pinned:bar")
+	if err != nil {
+		t.Fatalf("GetPinnedEvents: error, got %s", err.Error())
+	}
+	if len(pinned) != 2 || pinned[0] != "$a" || pinned[1] != "$b" {
+		t.Fatalf("GetPinnedEvents: got %v, want [$a $b]", pinned)
+	}
+	pinned, err = cli.GetPinnedEvents("!unpinned:bar")
+	if err != nil {
+		t.Fatalf("GetPinnedEvents: error for a room without pins, got %s", err.Error())
+	}
+	if pinned == nil || len(pinned) != 0 {
+		t.Fatalf("GetPinnedEvents: got %#v for a room without pins, want an empty slice", pinned)
+	}
+}
+
 func TestClient_GetAvatarUrl(t *testing.T) {
 	cli := mockClient(func(req *http.Request) (*http.Response, error) {
 		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/profile/@user:test.gomatrix.org/avatar_url" {
@@ -84,6 +2022,239 @@ func TestClient_StateEvent(t *testing.T) {
 	}
 }
 
+func TestClient_RequestRoomKey(t *testing.T) {
+	var body ReqSendToDevice
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/sendToDevice/m.room_key_request/") {
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	if err := cli.RequestRoomKey("senderkey", "session", "!foo:bar", "m.megolm.v1.aes-sha2"); err != nil {
+		t.Fatalf("RequestRoomKey: error, got %s", err.Error())
+	}
+	content, ok := body.Messages["@user:test.gomatrix.org"]["*"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("RequestRoomKey: not sent to all own devices, got %v", body.Messages)
+	}
+	if content["action"] != "request" || content["request_id"] != "session" {
+		t.Fatalf("RequestRoomKey: unexpected content %v", content)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	testCases := []struct {
+		URL     string
+		WantURL string // "" if the URL is invalid
+	}{
+		{"https://matrix.org", "https://matrix.org"},
+		{"https://matrix.org/", "https://matrix.org"},
+		{"http://localhost:8008/matrix/", "http://localhost:8008/matrix"},
+		{"matrix.org", ""},
+		{"ftp://matrix.org", ""},
+		{"https://", ""},
+		{"://matrix.org", ""},
+	}
+	for _, tc := range testCases {
+		cli, err := NewClient(tc.URL, "@alice:matrix.org", "token")
+		if tc.WantURL == "" {
+			if err == nil {
+				t.Errorf("NewClient(%q): no error for an invalid URL", tc.URL)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewClient(%q): error, got %s", tc.URL, err.Error())
+			continue
+		}
+		if got := cli.HomeserverURL.String(); got != tc.WantURL {
+			t.Errorf("NewClient(%q): got homeserver URL %s, want %s", tc.URL, got, tc.WantURL)
+		}
+	}
+}
+
+func TestClient_MaxResponseBytes(t *testing.T) {
+	body := `{"joined_rooms":["!foo:bar"]}`
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	cli.MaxResponseBytes = len(body)
+	if _, err := cli.JoinedRooms(); err != nil {
+		t.Fatalf("JoinedRooms: returned error for a response of exactly MaxResponseBytes: %s", err)
+	}
+	cli.MaxResponseBytes = len(body) - 1
+	if _, err := cli.JoinedRooms(); err != ErrResponseTooLarge {
+		t.Fatalf("JoinedRooms: got error %v, want ErrResponseTooLarge", err)
+	}
+}
+
+func TestClient_MakeCustomRequest(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "PUT" || req.URL.Path != "/_synapse/admin/v2/users/@alice:bar" {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		q := req.URL.Query()
+		if q.Get("access_token") != "abcdef" || q.Get("dry_run") != "true" {
+			return nil, fmt.Errorf("unexpected query: %s", req.URL.RawQuery)
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body["admin"] != true {
+			return nil, fmt.Errorf("unexpected body: %v, %v", body, err)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"name":"@alice:bar","admin":true}`)),
+		}, nil
+	})
+	var resp struct {
+		Name string `json:"name"`
+	}
+	err := cli.MakeCustomRequest(context.Background(), "PUT", "/_synapse/admin/v2/users/@alice:bar",
+		url.Values{"dry_run": {"true"}}, map[string]bool{"admin": true}, &resp)
+	if err != nil {
+		t.Fatalf("MakeCustomRequest: returned error: %s", err)
+	}
+	if resp.Name != "@alice:bar" {
+		t.Fatalf("MakeCustomRequest: got response %+v", resp)
+	}
+}
+
+func TestClient_RequestRetries(t *testing.T) {
+	connReset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	var responses []interface{} // the *http.Response or error for each attempt in turn
+	var attempts int
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		res := responses[attempts]
+		attempts++
+		if err, ok := res.(error); ok {
+			return nil, err
+		}
+		return res.(*http.Response), nil
+	})
+	resp := func(code int, body string) *http.Response {
+		return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}
+	}
+	joinedRooms := func() error { _, err := cli.JoinedRooms(); return err }
+	testCases := []struct {
+		Name         string
+		Retries      int
+		Request      func() error
+		Responses    []interface{}
+		WantErr      bool
+		WantAttempts int
+	}{
+		{"JoinedRooms without retries by default", 0, joinedRooms, []interface{}{connReset}, true, 1},
+		{"JoinedRooms", 2, joinedRooms, []interface{}{connReset, resp(502, `Bad Gateway`), resp(200, `{"joined_rooms":[]}`)}, false, 3},
+		{"JoinedRooms when rate limited", 1, joinedRooms, []interface{}{resp(429, `{"errcode":"M_LIMIT_EXCEEDED"}`), resp(200, `{"joined_rooms":[]}`)}, false, 2},
+		{"JoinedRooms with an invalid certificate", 2, joinedRooms, []interface{}{x509.UnknownAuthorityError{}}, true, 1},
+		{"JoinedRooms with an unsupported scheme", 2, joinedRooms, []interface{}{errors.New(`unsupported protocol scheme "ftp"`)}, true, 1},
+		{"GetDisplayName with a 404", 2, func() error { _, err := cli.GetDisplayName("@alice:bar"); return err }, []interface{}{resp(404, `{"errcode":"M_NOT_FOUND"}`)}, true, 1},
+		{"RejectInvite with a POST", 2, func() error { return cli.RejectInvite("!foo:bar", "") }, []interface{}{connReset}, true, 1},
+		{"SendText with a transaction ID", 1, func() error { _, err := cli.SendText("!foo:bar", "hi"); return err }, []interface{}{connReset, resp(200, `{"event_id":"$hi"}`)}, false, 2},
+		{"SetDisplayName without a transaction ID", 2, func() error { return cli.SetDisplayName("Alice") }, []interface{}{connReset}, true, 1},
+		{"SyncRequest", 2, func() error { _, err := cli.SyncRequest(0, "", "", false, ""); return err }, []interface{}{connReset}, true, 1},
+	}
+	cli.RetryBaseDelay = time.Millisecond
+	for _, tc := range testCases {
+		attempts = 0
+		responses = tc.Responses
+		cli.RequestRetries = tc.Retries
+		if err := tc.Request(); (err != nil) != tc.WantErr || attempts != tc.WantAttempts {
+			t.Errorf("%s: got %v after %d attempts, want error %t after %d", tc.Name, err, attempts, tc.WantErr, tc.WantAttempts)
+		}
+	}
+}
+
+func TestClient_RequestRetryAfter(t *testing.T) {
+	var attempts int
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return &http.Response{
+				StatusCode: 503,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNKNOWN","retry_after_ms":100}`)),
+			}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"joined_rooms":[]}`))}, nil
+	})
+	cli.RequestRetries = 1
+	cli.RetryBaseDelay = time.Millisecond
+	started := time.Now()
+	if _, err := cli.JoinedRooms(); err != nil || attempts != 2 {
+		t.Fatalf("JoinedRooms: got %v after %d attempts, want success after 2", err, attempts)
+	}
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond {
+		t.Fatalf("JoinedRooms: retried after %s, want at least the 100ms the server asked for", elapsed)
+	}
+}
+
+func TestClient_DoRaw(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/_matrix/client/unstable/org.example.feature":
+			var body map[string]string
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"echo":"` + body["say"] + `"}`)),
+			}, nil
+		case "/_matrix/client/unstable/org.example.missing":
+			return &http.Response{
+				StatusCode: 404,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	raw, err := cli.DoRaw("POST", cli.BuildBaseURL("_matrix", "client", "unstable", "org.example.feature"), map[string]string{"say": "hi"})
+	if err != nil {
+		t.Fatalf("DoRaw: error, got %s", err.Error())
+	}
+	if string(raw) != `{"echo":"hi"}` {
+		t.Fatalf("DoRaw: got %s", raw)
+	}
+	_, err = cli.DoRaw("GET", cli.BuildBaseURL("_matrix", "client", "unstable", "org.example.missing"), nil)
+	if httpErr, ok := err.(HTTPError); !ok || httpErr.Code != 404 {
+		t.Fatalf("DoRaw: got error %v, want an HTTPError with code 404", err)
+	}
+}
+
+func TestClient_UserAgent(t *testing.T) {
+	var userAgent string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		userAgent = req.Header.Get("User-Agent")
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"versions":["r0.6.1"]}`)),
+		}, nil
+	})
+	if _, err := cli.Versions(); err != nil {
+		t.Fatalf("Versions: error, got %s", err.Error())
+	}
+	if userAgent != DefaultUserAgent {
+		t.Fatalf("User-Agent: got %q, want %q", userAgent, DefaultUserAgent)
+	}
+	cli.UserAgent = "examplebot/1.0"
+	if _, err := cli.Versions(); err != nil {
+		t.Fatalf("Versions: error, got %s", err.Error())
+	}
+	if userAgent != "examplebot/1.0" {
+		t.Fatalf("User-Agent: got %q, want examplebot/1.0", userAgent)
+	}
+}
+
 func mockClient(fn func(*http.Request) (*http.Response, error)) *Client {
 	mrt := MockRoundTripper{
 		RT: fn,
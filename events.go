@@ -1,8 +1,13 @@
 package gomatrix
 
 import (
+	"encoding/json"
+	"errors"
 	"html"
+	"net"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 // Event represents a single Matrix event.
@@ -14,6 +19,148 @@ type Event struct {
 	ID        string                 `json:"event_id"`            // The unique ID of this event
 	RoomID    string                 `json:"room_id"`             // The room the event was sent to. May be nil (e.g. for presence)
 	Content   map[string]interface{} `json:"content"`             // The JSON content of the event.
+	Redacts   string                 `json:"redacts,omitempty"`   // The event ID redacted by an m.room.redaction event, before room version 11
+	Unsigned  map[string]interface{} `json:"unsigned,omitempty"`  // Extra information added by the homeserver, e.g. prev_content
+	// DecryptionError is set by DefaultSyncer when DecryptEvent fails for an encrypted event. It is never sent.
+	DecryptionError error `json:"-"`
+	// Origin is the section of the /sync response the event came from, set by DefaultSyncer. It is never sent.
+	Origin EventOrigin `json:"-"`
+}
+
+// EventOrigin is the section of a /sync response an event came from. The same event type can appear in several
+// sections with different meanings, e.g. an m.room.member event in the state section is the membership at the
+// start of the timeline, while one in the timeline is a membership change.
+type EventOrigin int
+
+// The sections of a /sync response. DefaultSyncer sets the origin of the events in each of them, and of the
+// events it backfills for a limited timeline to TimelineEvent.
+const (
+	UnknownOrigin    EventOrigin = iota // Not from a /sync response, e.g. from Client.Messages
+	StateEvent                          // A room's state section
+	TimelineEvent                       // A room's timeline section
+	InviteEvent                         // The stripped state of a room the user is invited to
+	EphemeralEvent                      // A room's ephemeral section, e.g. typing notifications and receipts
+	ToDeviceEvent                       // The to_device section
+	AccountDataEvent                    // The global or a room's account_data section
+)
+
+var eventOriginNames = []string{"unknown", "state", "timeline", "invite", "ephemeral", "to_device", "account_data"}
+
+// String returns the name of the section, e.g. "timeline", as used in log output.
+func (o EventOrigin) String() string {
+	if o < 0 || int(o) >= len(eventOriginNames) {
+		return "EventOrigin(" + strconv.Itoa(int(o)) + ")"
+	}
+	return eventOriginNames[o]
+}
+
+// ErrMissingEventID is returned by Event.Redact if the event has no ID.
+var ErrMissingEventID = errors.New("event has no event ID")
+
+// ErrMissingRoomID is returned by Event.Redact if the event has no room ID.
+var ErrMissingRoomID = errors.New("event has no room ID")
+
+// Redact redacts the event with the given client. The reason is optional and may be "".
+func (event *Event) Redact(cli *Client, reason string) (*RespSendEvent, error) {
+	if event.ID == "" {
+		return nil, ErrMissingEventID
+	}
+	if event.RoomID == "" {
+		return nil, ErrMissingRoomID
+	}
+	return cli.RedactEvent(event.RoomID, event.ID, &ReqRedact{Reason: reason})
+}
+
+// RedactedEventID returns the ID of the event redacted by an m.room.redaction event, which is a top-level key
+// before room version 11 and a content key after it. Returns "" for other events.
+func (event *Event) RedactedEventID() string {
+	if event.Type != "m.room.redaction" {
+		return ""
+	}
+	if event.Redacts != "" {
+		return event.Redacts
+	}
+	redacts, _ := event.Content["redacts"].(string)
+	return redacts
+}
+
+// redactionProtectedKeys are the content keys kept when an event is redacted, by event type. This is the union of
+// the keys protected by room versions 1 to 11, as the room version is not known when applying redactions locally.
+// Version 11 also keeps all of m.room.create's content and the signed part of an m.room.member event's
+// third_party_invite, which StripRedactedContent handles separately.
+// See https://spec.matrix.org/v1.8/rooms/v11/#redactions
+var redactionProtectedKeys = map[string][]string{
+	"m.room.member":             {"membership", "join_authorised_via_users_server"},
+	"m.room.join_rules":         {"join_rule", "allow"},
+	"m.room.power_levels":       {"ban", "events", "events_default", "invite", "kick", "redact", "state_default", "users", "users_default"},
+	"m.room.aliases":            {"aliases"},
+	"m.room.history_visibility": {"history_visibility"},
+	"m.room.redaction":          {"redacts"},
+}
+
+// StripRedactedContent removes the content keys which are not kept when the event is redacted, as a homeserver
+// does. It only changes the local copy of the event; use Redact to redact it on the homeserver.
+func (event *Event) StripRedactedContent() {
+	if event.Type == "m.room.create" {
+		return
+	}
+	content := make(map[string]interface{})
+	for _, key := range redactionProtectedKeys[event.Type] {
+		if value, ok := event.Content[key]; ok {
+			content[key] = value
+		}
+	}
+	if invite, ok := event.Content["third_party_invite"].(map[string]interface{}); ok && event.Type == "m.room.member" {
+		if signed, found := invite["signed"]; found {
+			content["third_party_invite"] = map[string]interface{}{"signed": signed}
+		}
+	}
+	event.Content = content
+}
+
+// IsStateEvent returns true if the event came from a room's state section in a /sync response. It only reports
+// where the event was delivered, not whether it is a state event: state events in the timeline are TimelineEvent.
+// A state event is one with a non-nil StateKey.
+func (event *Event) IsStateEvent() bool {
+	return event.Origin == StateEvent
+}
+
+// IsTimelineEvent returns true if the event came from a room's timeline in a /sync response.
+func (event *Event) IsTimelineEvent() bool {
+	return event.Origin == TimelineEvent
+}
+
+// IsInviteEvent returns true if the event came from the stripped state of an invite in a /sync response.
+func (event *Event) IsInviteEvent() bool {
+	return event.Origin == InviteEvent
+}
+
+// IsEphemeral returns true if the event came from a room's ephemeral section in a /sync response.
+func (event *Event) IsEphemeral() bool {
+	return event.Origin == EphemeralEvent
+}
+
+// IsToDevice returns true if the event came from the to_device section of a /sync response.
+func (event *Event) IsToDevice() bool {
+	return event.Origin == ToDeviceEvent
+}
+
+// IsAccountData returns true if the event came from an account_data section of a /sync response.
+func (event *Event) IsAccountData() bool {
+	return event.Origin == AccountDataEvent
+}
+
+// prevMembership returns the membership from the unsigned prev_content of an m.room.member event, or "" if it is
+// not known.
+func (event *Event) prevMembership() string {
+	prevContent, _ := event.Unsigned["prev_content"].(map[string]interface{})
+	membership, _ := prevContent["membership"].(string)
+	return membership
+}
+
+// IsEncrypted returns true if the event is an m.room.encrypted event.
+func (event *Event) IsEncrypted() bool {
+	return event.Type == "m.room.encrypted"
 }
 
 // Body returns the value of the "body" key in the event content if it is
@@ -79,6 +226,21 @@ type ImageMessage struct {
 	Info    ImageInfo `json:"info"`
 }
 
+// FileInfo contains info about a file - https://matrix.org/docs/spec/client_server/r0.6.0#m-file
+type FileInfo struct {
+	Mimetype string `json:"mimetype,omitempty"`
+	Size     uint   `json:"size,omitempty"`
+}
+
+// FileMessage is an m.file event. It is also used for m.image, m.video and m.audio events when only the MIME type
+// of the content is known.
+type FileMessage struct {
+	MsgType string   `json:"msgtype"`
+	Body    string   `json:"body"`
+	URL     string   `json:"url"`
+	Info    FileInfo `json:"info"`
+}
+
 // An HTMLMessage is the contents of a Matrix HTML formated message event.
 type HTMLMessage struct {
 	Body          string `json:"body"`
@@ -87,6 +249,231 @@ type HTMLMessage struct {
 	FormattedBody string `json:"formatted_body"`
 }
 
+// Tombstone is the content of an m.room.tombstone state event, sent when a room is upgraded to point at the room
+// which replaces it. See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-tombstone
+type Tombstone struct {
+	Body            string `json:"body"`             // A message explaining the upgrade
+	ReplacementRoom string `json:"replacement_room"` // The ID of the room which replaces this one
+}
+
+// MemberEvent is the content of an m.room.member state event, along with the user ID of the member.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-member
+type MemberEvent struct {
+	UserID      string `json:"-"`          // The member's user ID, i.e. the state key of the event
+	Membership  string `json:"membership"` // "invite", "join", "knock", "leave" or "ban"
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"` // The mxc:// URI of the member's avatar
+	Reason      string `json:"reason,omitempty"`     // Why the member was invited, kicked or banned, if given
+	IsDirect    bool   `json:"is_direct,omitempty"`  // Whether the invite is for a direct chat
+}
+
+// decodeMemberEvent decodes an m.room.member event. Content keys with the wrong type are left as the zero value.
+func decodeMemberEvent(event *Event) *MemberEvent {
+	var member MemberEvent
+	if b, err := json.Marshal(event.Content); err == nil {
+		// Unmarshal skips values of the wrong type and decodes the rest, so the error can be ignored.
+		_ = json.Unmarshal(b, &member)
+	}
+	if event.StateKey != nil {
+		member.UserID = *event.StateKey
+	}
+	return &member
+}
+
+// MembershipEvent is an m.room.member event with the membership before and after it, as passed to
+// DefaultSyncer.OnMembershipEvent.
+type MembershipEvent struct {
+	Event          *Event // The underlying m.room.member event
+	RoomID         string
+	Sender         string // The user who changed the membership, e.g. the kicker for a kick
+	Target         string // The user whose membership changed, i.e. the state key
+	NewMembership  string
+	PrevMembership string // The membership from unsigned.prev_content, or "" if it is not known
+	DisplayName    string // The target's display name after the event, if any
+	IsDirect       bool   // Whether the invite is for a direct chat
+}
+
+// NewMembershipEvent returns the MembershipEvent for an m.room.member event, or nil if the event is not a
+// membership event.
+func NewMembershipEvent(event *Event) *MembershipEvent {
+	if event.Type != "m.room.member" || event.StateKey == nil {
+		return nil
+	}
+	member := decodeMemberEvent(event)
+	return &MembershipEvent{
+		Event:          event,
+		RoomID:         event.RoomID,
+		Sender:         event.Sender,
+		Target:         *event.StateKey,
+		NewMembership:  member.Membership,
+		PrevMembership: event.prevMembership(),
+		DisplayName:    member.DisplayName,
+		IsDirect:       member.IsDirect,
+	}
+}
+
+// LeaveKind classifies how a member left a room. See MembershipEvent.LeaveKind.
+type LeaveKind int
+
+// The ways a member can leave a room.
+const (
+	NotALeave       LeaveKind = iota // The membership event is not a leave or ban
+	VoluntaryLeave                   // The member left the room themselves
+	Kick                             // Another user removed the member, or revoked their invite
+	InviteRejection                  // The member rejected their invite
+	Ban                              // The member was banned
+)
+
+var leaveKindNames = []string{"not_a_leave", "leave", "kick", "invite_rejection", "ban"}
+
+// String returns the name of the kind of leave, e.g. "kick", as used in log output.
+func (k LeaveKind) String() string {
+	if k < 0 || int(k) >= len(leaveKindNames) {
+		return "LeaveKind(" + strconv.Itoa(int(k)) + ")"
+	}
+	return leaveKindNames[k]
+}
+
+// LeaveKind returns how the target left the room, or NotALeave if the event is not a leave or ban. A leave whose
+// previous membership is not known is classified from the sender alone.
+func (m *MembershipEvent) LeaveKind() LeaveKind {
+	switch {
+	case m.NewMembership == "ban":
+		return Ban
+	case m.NewMembership != "leave":
+		return NotALeave
+	case m.Sender != m.Target:
+		return Kick
+	case m.PrevMembership == "invite":
+		return InviteRejection
+	default:
+		return VoluntaryLeave
+	}
+}
+
+// EncryptionContent is the content of an m.room.encryption state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-encryption
+type EncryptionContent struct {
+	Algorithm              string `json:"algorithm"`                      // e.g. "m.megolm.v1.aes-sha2"
+	RotationPeriodMillis   int64  `json:"rotation_period_ms,omitempty"`   // How long a session is used before rotating it
+	RotationPeriodMessages int    `json:"rotation_period_msgs,omitempty"` // How many messages are sent before rotating the session
+}
+
+// RoomKeyRequestContent is the content of an m.room_key_request to-device event.
+// See https://matrix.org/docs/spec/client_server/r0.3.0.html#m-room-key-request
+type RoomKeyRequestContent struct {
+	Action             string              `json:"action"` // "request" or "request_cancellation"
+	Body               *RoomKeyRequestBody `json:"body,omitempty"`
+	RequestID          string              `json:"request_id"`
+	RequestingDeviceID string              `json:"requesting_device_id"`
+}
+
+// RoomKeyRequestBody identifies the megolm session being requested by an m.room_key_request event.
+type RoomKeyRequestBody struct {
+	Algorithm string `json:"algorithm"`
+	RoomID    string `json:"room_id"`
+	SenderKey string `json:"sender_key"`
+	SessionID string `json:"session_id"`
+}
+
+// SpaceChildContent is the content of an m.space.child state event - https://spec.matrix.org/v1.2/client-server-api/#mspacechild
+type SpaceChildContent struct {
+	Via       []string `json:"via"`
+	Order     string   `json:"order,omitempty"`
+	Suggested bool     `json:"suggested,omitempty"`
+}
+
+// SpaceParentContent is the content of an m.space.parent state event - https://spec.matrix.org/v1.2/client-server-api/#mspaceparent
+type SpaceParentContent struct {
+	Via       []string `json:"via"`
+	Canonical bool     `json:"canonical,omitempty"`
+}
+
+// ServerACL is the content of an m.room.server_acl state event - https://matrix.org/docs/spec/client_server/r0.6.0#m-room-server-acl
+type ServerACL struct {
+	Allow           []string `json:"allow"`             // Globs of server names which may participate in the room
+	Deny            []string `json:"deny"`              // Globs of server names which may not participate, overriding Allow
+	AllowIPLiterals bool     `json:"allow_ip_literals"` // Whether server names which are IP literals may participate
+}
+
+// UnmarshalJSON decodes an ACL, defaulting AllowIPLiterals to true as the spec requires when it is absent.
+func (a *ServerACL) UnmarshalJSON(data []byte) error {
+	type serverACL ServerACL // no UnmarshalJSON method, to avoid recursion
+	acl := serverACL{AllowIPLiterals: true}
+	if err := json.Unmarshal(data, &acl); err != nil {
+		return err
+	}
+	*a = ServerACL(acl)
+	return nil
+}
+
+// MarshalJSON encodes an ACL, sending empty lists rather than null for a nil Allow or Deny.
+func (a ServerACL) MarshalJSON() ([]byte, error) {
+	type serverACL ServerACL // no MarshalJSON method, to avoid recursion
+	acl := serverACL(a)
+	if acl.Allow == nil {
+		acl.Allow = []string{}
+	}
+	if acl.Deny == nil {
+		acl.Deny = []string{}
+	}
+	return json.Marshal(acl)
+}
+
+// AllowsServer returns true if the ACL allows the server to participate in the room. Any port is ignored.
+func (a *ServerACL) AllowsServer(serverName string) bool {
+	host := serverName
+	if strings.HasPrefix(host, "[") { // IPv6 literal, e.g. [::1]:8448
+		if end := strings.Index(host, "]"); end >= 0 {
+			host = host[:end+1]
+		}
+	} else if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	if !a.AllowIPLiterals && (strings.HasPrefix(host, "[") || net.ParseIP(host) != nil) {
+		return false
+	}
+	for _, glob := range a.Deny {
+		if matchServerGlob(glob, host) {
+			return false
+		}
+	}
+	for _, glob := range a.Allow {
+		if matchServerGlob(glob, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchServerGlob matches a server name against a glob in which "*" matches zero or more characters and "?"
+// matches exactly one. Matching is case-insensitive, as DNS names are.
+func matchServerGlob(glob, name string) bool {
+	glob, name = strings.ToLower(glob), strings.ToLower(name)
+	// Iterative wildcard matching: on a mismatch, backtrack to just after the last "*".
+	g, n := 0, 0
+	starG, starN := -1, 0
+	for n < len(name) {
+		switch {
+		case g < len(glob) && (glob[g] == '?' || glob[g] == name[n]):
+			g++
+			n++
+		case g < len(glob) && glob[g] == '*':
+			starG, starN = g, n
+			g++
+		case starG >= 0:
+			starN++
+			g, n = starG+1, starN
+		default:
+			return false
+		}
+	}
+	for g < len(glob) && glob[g] == '*' {
+		g++
+	}
+	return g == len(glob)
+}
+
 var htmlRegex = regexp.MustCompile("<[^<]+?>")
 
 // GetHTMLMessage returns an HTMLMessage with the body set to a stripped version of the provided HTML, in addition
@@ -0,0 +1,93 @@
+package gomatrix
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestServerACL_AllowsServer(t *testing.T) {
+	var acl ServerACL
+	if err := json.Unmarshal([]byte(`{"allow":["*"],"deny":["*.evil.com","evil.com","bad?.org"]}`), &acl); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.AllowIPLiterals {
+		t.Fatal("ServerACL: allow_ip_literals did not default to true")
+	}
+	testCases := []struct {
+		ServerName string
+		Allowed    bool
+	}{
+		{"matrix.org", true},
+		{"matrix.org:8448", true},
+		{"evil.com", false},
+		{"EVIL.com:443", false},
+		{"sub.evil.com", false},
+		{"notevil.com", true},
+		{"bad1.org", false},
+		{"bad12.org", true},
+		{"1.2.3.4:8448", true},
+		{"[::1]:8448", true},
+	}
+	for _, tc := range testCases {
+		if got := acl.AllowsServer(tc.ServerName); got != tc.Allowed {
+			t.Errorf("AllowsServer(%s): got %t, want %t", tc.ServerName, got, tc.Allowed)
+		}
+	}
+
+	acl = ServerACL{Allow: []string{"*.example.org"}}
+	for serverName, allowed := range map[string]bool{
+		"matrix.example.org": true,
+		"example.org":        false,
+		"1.2.3.4":            false,
+		"[::1]":              false,
+	} {
+		if got := acl.AllowsServer(serverName); got != allowed {
+			t.Errorf("AllowsServer(%s) without IP literals: got %t, want %t", serverName, got, allowed)
+		}
+	}
+}
+
+func TestMembershipEvent_LeaveKind(t *testing.T) {
+	testCases := []struct {
+		Sender, New, Prev string
+		Kind              LeaveKind
+	}{
+		{"@alice:bar", "join", "invite", NotALeave},
+		{"@alice:bar", "leave", "join", VoluntaryLeave},
+		{"@alice:bar", "leave", "", VoluntaryLeave},
+		{"@bob:bar", "leave", "join", Kick},
+		{"@bob:bar", "leave", "invite", Kick},
+		{"@alice:bar", "leave", "invite", InviteRejection},
+		{"@bob:bar", "ban", "join", Ban},
+	}
+	for _, tc := range testCases {
+		m := MembershipEvent{Sender: tc.Sender, Target: "@alice:bar", NewMembership: tc.New, PrevMembership: tc.Prev}
+		if got := m.LeaveKind(); got != tc.Kind {
+			t.Errorf("LeaveKind(%s %s -> %s): got %s, want %s", tc.Sender, tc.Prev, tc.New, got, tc.Kind)
+		}
+	}
+}
+
+func TestEvent_StripRedactedContent(t *testing.T) {
+	testCases := []struct {
+		Type    string
+		Content string
+		Want    string
+	}{
+		{"m.room.message", `{"body":"hi","msgtype":"m.text"}`, `{}`},
+		{"m.room.create", `{"creator":"@a:bar","room_version":"11","m.federate":false}`, `{"creator":"@a:bar","m.federate":false,"room_version":"11"}`},
+		{"m.room.redaction", `{"redacts":"$ev","reason":"spam"}`, `{"redacts":"$ev"}`},
+		{"m.room.member", `{"membership":"invite","displayname":"A","third_party_invite":{"display_name":"a@bar","signed":{"token":"t"}}}`, `{"membership":"invite","third_party_invite":{"signed":{"token":"t"}}}`},
+		{"m.room.power_levels", `{"ban":50,"notifications":{"room":50}}`, `{"ban":50}`},
+	}
+	for _, tc := range testCases {
+		event := Event{Type: tc.Type}
+		if err := json.Unmarshal([]byte(tc.Content), &event.Content); err != nil {
+			t.Fatal(err)
+		}
+		event.StripRedactedContent()
+		if got, _ := json.Marshal(event.Content); string(got) != tc.Want {
+			t.Errorf("StripRedactedContent: got %s for %s, want %s", got, tc.Type, tc.Want)
+		}
+	}
+}
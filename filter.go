@@ -14,24 +14,35 @@
 
 package gomatrix
 
+import "encoding/json"
+
 //Filter is used by clients to specify how the server should filter responses to e.g. sync requests
 //Specified by: https://matrix.org/docs/spec/client_server/r0.2.0.html#filtering
 type Filter struct {
 	AccountData FilterPart `json:"account_data,omitempty"`
-	EventFields []string   `json:"event_fields,omitempty"`
-	EventFormat string     `json:"event_format,omitempty"`
+	EventFields []string   `json:"event_fields,omitempty"` // Only include these fields of each event, e.g. "content.body"
+	EventFormat string     `json:"event_format,omitempty"` // "client" or "federation"
 	Presence    FilterPart `json:"presence,omitempty"`
-	Room        struct {
-		AccountData  FilterPart `json:"account_data,omitempty"`
-		Ephemeral    FilterPart `json:"ephemeral,omitempty"`
-		IncludeLeave bool       `json:"include_leave,omitempty"`
-		NotRooms     []string   `json:"not_rooms,omitempty"`
-		Rooms        []string   `json:"rooms,omitempty"`
-		State        FilterPart `json:"state,omitempty"`
-		Timeline     FilterPart `json:"timeline,omitempty"`
-	} `json:"room,omitempty"`
+	Room        RoomFilter `json:"room,omitempty"`
+}
+
+// RoomFilter is the room part of a Filter. Rooms and NotRooms restrict which rooms are included in
+// every section of the response.
+type RoomFilter struct {
+	AccountData  FilterPart `json:"account_data,omitempty"`
+	Ephemeral    FilterPart `json:"ephemeral,omitempty"`
+	IncludeLeave bool       `json:"include_leave,omitempty"`
+	NotRooms     []string   `json:"not_rooms,omitempty"`
+	Rooms        []string   `json:"rooms,omitempty"`
+	State        FilterPart `json:"state,omitempty"`
+	Timeline     FilterPart `json:"timeline,omitempty"`
 }
 
+// FilterPart is used to filter the events in one part of a Filter, e.g. the room timeline or presence. For
+// presence and account data, the Rooms and NotRooms fields are ignored.
+//
+// A nil Rooms, Senders or Types list is omitted so that everything matches. An empty, non-nil list is sent
+// as-is so that nothing matches: for example, Filter.Presence.Types = []string{} stops the server sending presence.
 type FilterPart struct {
 	NotRooms   []string `json:"not_rooms,omitempty"`
 	Rooms      []string `json:"rooms,omitempty"`
@@ -41,3 +52,22 @@ type FilterPart struct {
 	Senders    []string `json:"senders,omitempty"`
 	Types      []string `json:"types,omitempty"`
 }
+
+// MarshalJSON implements json.Marshaler, keeping empty but non-nil allow lists.
+func (fp FilterPart) MarshalJSON() ([]byte, error) {
+	type filterPart FilterPart // avoids recursing into MarshalJSON
+	return json.Marshal(struct {
+		filterPart
+		Rooms   *[]string `json:"rooms,omitempty"`
+		Senders *[]string `json:"senders,omitempty"`
+		Types   *[]string `json:"types,omitempty"`
+	}{filterPart(fp), explicitList(fp.Rooms), explicitList(fp.Senders), explicitList(fp.Types)})
+}
+
+// explicitList returns nil for a nil list, and a pointer to the list otherwise so it survives omitempty.
+func explicitList(list []string) *[]string {
+	if list == nil {
+		return nil
+	}
+	return &list
+}
@@ -0,0 +1,28 @@
+package gomatrix
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFilterPart_MarshalJSON(t *testing.T) {
+	limit := 10
+	testCases := []struct {
+		Part FilterPart
+		JSON string
+	}{
+		{FilterPart{}, `{}`},
+		{FilterPart{Types: []string{}}, `{"types":[]}`},
+		{FilterPart{Limit: &limit, Senders: []string{"@alice:bar"}}, `{"limit":10,"senders":["@alice:bar"]}`},
+		{FilterPart{NotTypes: []string{"m.presence"}, Rooms: []string{}}, `{"not_types":["m.presence"],"rooms":[]}`},
+	}
+	for _, tc := range testCases {
+		got, err := json.Marshal(tc.Part)
+		if err != nil {
+			t.Fatalf("MarshalJSON: error, got %s", err)
+		}
+		if string(got) != tc.JSON {
+			t.Errorf("MarshalJSON: got %s, want %s", got, tc.JSON)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package gomatrix
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// matrixHTMLTags are the tags allowed in the formatted_body of m.room.message events.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-message-msgtypes
+var matrixHTMLTags = makeHTMLTagSet("font del h1 h2 h3 h4 h5 h6 blockquote p a ul ol sup sub li b i u strong em " +
+	"strike code hr br div table thead tbody tr th td caption pre span img details summary mx-reply")
+
+// matrixHTMLAttrs are the attributes allowed on each tag. Tags which are not listed have no allowed attributes.
+var matrixHTMLAttrs = map[string][]string{
+	"font": {"data-mx-bg-color", "data-mx-color", "color"},
+	"span": {"data-mx-bg-color", "data-mx-color", "data-mx-spoiler"},
+	"a":    {"name", "target", "href"},
+	"img":  {"width", "height", "alt", "title", "src"},
+	"ol":   {"start"},
+	"code": {"class"},
+}
+
+// htmlVoidTags have no closing tag.
+var htmlVoidTags = map[string]bool{"br": true, "hr": true, "img": true}
+
+// htmlDroppedTags are removed along with their content, rather than just having the tags stripped.
+var htmlDroppedTags = map[string]bool{"script": true, "style": true}
+
+// htmlSafeSchemes are the URL schemes allowed in links.
+var htmlSafeSchemes = []string{"https://", "http://", "ftp://", "mailto:", "magnet:"}
+
+var htmlColorRegex = regexp.MustCompile("^#[0-9a-fA-F]{6}$")
+
+// SanitizeMatrixHTML reduces untrusted HTML to the subset allowed in the formatted_body of m.room.message events.
+// Disallowed tags are removed but their text is kept, except for script and style elements which are removed
+// entirely. Disallowed attributes are removed, as are links with unsafe schemes (e.g. javascript:) and images
+// which are not mxc:// URIs. Unclosed tags are closed at the end.
+func SanitizeMatrixHTML(input string) string {
+	var z htmlSanitizer
+	for len(input) > 0 {
+		lt := strings.IndexByte(input, '<')
+		if lt < 0 {
+			z.writeText(input)
+			break
+		}
+		z.writeText(input[:lt])
+		input = input[lt:]
+		if strings.HasPrefix(input, "<!--") {
+			end := strings.Index(input, "-->")
+			if end < 0 {
+				break
+			}
+			input = input[end+3:]
+			continue
+		}
+		tag, n := parseHTMLTag(input)
+		if n == 0 { // not a tag, so escape the "<"
+			z.writeText("&lt;")
+			input = input[1:]
+			continue
+		}
+		input = input[n:]
+		z.writeTag(tag)
+	}
+	for i := len(z.open) - 1; i >= 0; i-- {
+		z.out.WriteString("</" + z.open[i] + ">")
+	}
+	return z.out.String()
+}
+
+// htmlSanitizer is the output of SanitizeMatrixHTML as it is being built.
+type htmlSanitizer struct {
+	out      bytes.Buffer
+	open     []string // allowed tags which have been opened but not closed, innermost last
+	dropping string   // the dropped tag whose content is being skipped, if any
+}
+
+func (z *htmlSanitizer) writeText(text string) {
+	if z.dropping == "" {
+		z.out.WriteString(strings.Replace(text, ">", "&gt;", -1))
+	}
+}
+
+func (z *htmlSanitizer) writeTag(tag htmlTag) {
+	switch {
+	case z.dropping != "":
+		if tag.closing && tag.name == z.dropping {
+			z.dropping = ""
+		}
+	case htmlDroppedTags[tag.name]:
+		if !tag.closing && !tag.selfClosing {
+			z.dropping = tag.name
+		}
+	case !matrixHTMLTags[tag.name]:
+		// Strip the tag but keep its content.
+	case tag.closing:
+		z.closeTag(tag.name)
+	default:
+		z.openTag(tag)
+	}
+}
+
+// closeTag closes the innermost open tag with the given name, and any tags left open inside it. It does nothing if
+// there is no such tag.
+func (z *htmlSanitizer) closeTag(name string) {
+	for i := len(z.open) - 1; i >= 0; i-- {
+		if z.open[i] != name {
+			continue
+		}
+		for j := len(z.open) - 1; j >= i; j-- {
+			z.out.WriteString("</" + z.open[j] + ">")
+		}
+		z.open = z.open[:i]
+		return
+	}
+}
+
+func (z *htmlSanitizer) openTag(tag htmlTag) {
+	z.out.WriteString("<" + tag.name)
+	for _, attr := range tag.attrs {
+		if value, ok := sanitizeHTMLAttr(tag.name, attr.name, attr.value); ok {
+			z.out.WriteString(" " + attr.name + `="` + html.EscapeString(value) + `"`)
+		}
+	}
+	z.out.WriteString(">")
+	if !htmlVoidTags[tag.name] && !tag.selfClosing {
+		z.open = append(z.open, tag.name)
+	}
+}
+
+// htmlToPlainText returns the text of sanitized HTML as a plain text fallback: blocks are separated by blank lines,
+// list items get bullets or numbers, quotes are prefixed with "> " and link targets are kept after the link text,
+// except for matrix.to links such as mentions.
+func htmlToPlainText(input string) string {
+	var w plainTextWriter
+	for len(input) > 0 {
+		lt := strings.IndexByte(input, '<')
+		if lt < 0 {
+			w.write(html.UnescapeString(input))
+			break
+		}
+		w.write(html.UnescapeString(input[:lt]))
+		tag, n := parseHTMLTag(input[lt:])
+		if n == 0 {
+			w.write("<")
+			input = input[lt+1:]
+			continue
+		}
+		input = input[lt+n:]
+		w.writeTag(tag)
+	}
+	return strings.TrimRight(w.out.String(), "\n")
+}
+
+// plainTextWriter is the output of htmlToPlainText as it is being built.
+type plainTextWriter struct {
+	out        bytes.Buffer
+	lists      []int // the next item number of each open list, innermost last, or 0 for bullet lists
+	quoteDepth int
+	linkHref   string // the href of the open link, if any
+	linkStart  int    // the length of out when the open link started
+}
+
+// write writes text, prefixing each line with the quote markers of the open blockquotes.
+func (w *plainTextWriter) write(text string) {
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			w.out.WriteString("\n")
+		}
+		if line == "" {
+			continue
+		}
+		if w.quoteDepth > 0 && (w.out.Len() == 0 || bytes.HasSuffix(w.out.Bytes(), []byte("\n"))) {
+			w.out.WriteString(strings.Repeat("> ", w.quoteDepth))
+		}
+		w.out.WriteString(line)
+	}
+}
+
+// lineBreak ends the current line with at least n newlines, unless nothing has been written yet.
+func (w *plainTextWriter) lineBreak(n int) {
+	trimmed := bytes.TrimRight(w.out.Bytes(), "\n")
+	if newlines := w.out.Len() - len(trimmed); len(trimmed) > 0 && newlines < n {
+		w.out.WriteString(strings.Repeat("\n", n-newlines))
+	}
+}
+
+func (w *plainTextWriter) writeTag(tag htmlTag) {
+	switch tag.name {
+	case "br":
+		w.out.WriteString("\n")
+	case "p", "div", "pre", "hr", "table", "h1", "h2", "h3", "h4", "h5", "h6":
+		w.lineBreak(2)
+	case "tr":
+		w.lineBreak(1)
+	case "blockquote":
+		w.lineBreak(2)
+		if !tag.closing {
+			w.quoteDepth++
+		} else if w.quoteDepth > 0 {
+			w.quoteDepth--
+		}
+	case "ul", "ol":
+		w.listTag(tag)
+	case "li":
+		if !tag.closing && len(w.lists) > 0 {
+			w.listItem()
+		}
+	case "a":
+		w.linkTag(tag)
+	}
+}
+
+func (w *plainTextWriter) listTag(tag htmlTag) {
+	if tag.closing {
+		if len(w.lists) > 0 {
+			w.lists = w.lists[:len(w.lists)-1]
+		}
+		if len(w.lists) == 0 {
+			w.lineBreak(2)
+		}
+		return
+	}
+	if len(w.lists) > 0 {
+		w.lineBreak(1)
+	} else {
+		w.lineBreak(2)
+	}
+	next := 0
+	if tag.name == "ol" {
+		next = 1
+		for _, attr := range tag.attrs {
+			if start, err := strconv.Atoi(attr.value); attr.name == "start" && err == nil {
+				next = start
+			}
+		}
+	}
+	w.lists = append(w.lists, next)
+}
+
+// listItem starts an item of the innermost list with its bullet or number, indented by the list's depth.
+func (w *plainTextWriter) listItem() {
+	w.lineBreak(1)
+	bullet := "- "
+	if next := w.lists[len(w.lists)-1]; next > 0 {
+		bullet = strconv.Itoa(next) + ". "
+		w.lists[len(w.lists)-1]++
+	}
+	w.write(strings.Repeat("  ", len(w.lists)-1) + bullet)
+}
+
+// linkTag remembers the href of an opening link, and writes it after the link text when the link is closed.
+func (w *plainTextWriter) linkTag(tag htmlTag) {
+	if !tag.closing {
+		w.linkHref, w.linkStart = "", w.out.Len()
+		for _, attr := range tag.attrs {
+			if attr.name == "href" {
+				w.linkHref = attr.value
+			}
+		}
+		return
+	}
+	text := string(w.out.Bytes()[w.linkStart:])
+	if w.linkHref != "" && w.linkHref != text && !strings.HasPrefix(w.linkHref, matrixToPrefix) {
+		w.write(" (" + w.linkHref + ")")
+	}
+	w.linkHref = ""
+}
+
+func makeHTMLTagSet(tags string) map[string]bool {
+	set := make(map[string]bool)
+	for _, tag := range strings.Fields(tags) {
+		set[tag] = true
+	}
+	return set
+}
+
+// sanitizeHTMLAttr returns the value to keep for an attribute, and false if the attribute should be removed.
+func sanitizeHTMLAttr(tagName, attrName, value string) (string, bool) {
+	allowed := false
+	for _, a := range matrixHTMLAttrs[tagName] {
+		if a == attrName {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", false
+	}
+	switch attrName {
+	case "href":
+		lower := strings.ToLower(strings.TrimSpace(value))
+		for _, scheme := range htmlSafeSchemes {
+			if strings.HasPrefix(lower, scheme) {
+				return value, true
+			}
+		}
+		return "", false
+	case "src":
+		return value, strings.HasPrefix(value, "mxc://")
+	case "class":
+		return value, strings.HasPrefix(value, "language-") && !strings.ContainsAny(value, " \t\n")
+	case "color", "data-mx-color", "data-mx-bg-color":
+		return value, htmlColorRegex.MatchString(value)
+	}
+	return value, true
+}
+
+type htmlAttr struct {
+	name  string
+	value string // unescaped
+}
+
+type htmlTag struct {
+	name        string // lower case
+	closing     bool   // </name>
+	selfClosing bool   // <name/>
+	attrs       []htmlAttr
+}
+
+// parseHTMLTag parses the tag at the start of s, which must start with "<". It returns the tag and its length
+// in bytes, or a length of 0 if s does not start with a complete tag.
+func parseHTMLTag(s string) (tag htmlTag, n int) {
+	i := 1
+	if i < len(s) && s[i] == '/' {
+		tag.closing = true
+		i++
+	}
+	start := i
+	i = scanHTMLTagName(s, i)
+	if i == start {
+		return htmlTag{}, 0
+	}
+	tag.name = strings.ToLower(s[start:i])
+	for {
+		i = skipHTMLSpace(s, i)
+		if i >= len(s) {
+			return htmlTag{}, 0
+		}
+		switch {
+		case s[i] == '>':
+			return tag, i + 1
+		case strings.HasPrefix(s[i:], "/>"):
+			tag.selfClosing = true
+			return tag, i + 2
+		case s[i] == '/':
+			i++
+			continue
+		}
+		attr, next, ok := parseHTMLAttr(s, i)
+		if !ok {
+			return htmlTag{}, 0
+		}
+		i = next
+		if attr.name != "" {
+			tag.attrs = append(tag.attrs, attr)
+		}
+	}
+}
+
+// scanHTMLTagName returns the index of the end of the tag name starting at s[start].
+func scanHTMLTagName(s string, start int) int {
+	i := start
+	for i < len(s) && (isASCIILetter(s[i]) || (i > start && (s[i] == '-' || (s[i] >= '0' && s[i] <= '9')))) {
+		i++
+	}
+	return i
+}
+
+// parseHTMLAttr parses the attribute starting at s[i]. It returns the attribute and the index of its end, or false
+// if the tag is incomplete.
+func parseHTMLAttr(s string, i int) (attr htmlAttr, end int, ok bool) {
+	nameStart := i
+	for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '=' && s[i] != '>' && s[i] != '/' {
+		i++
+	}
+	attr.name = strings.ToLower(s[nameStart:i])
+	i = skipHTMLSpace(s, i)
+	if i >= len(s) || s[i] != '=' {
+		return attr, i, true
+	}
+	attr.value, end, ok = parseHTMLAttrValue(s, skipHTMLSpace(s, i+1))
+	return attr, end, ok
+}
+
+// parseHTMLAttrValue parses the quoted or unquoted attribute value starting at s[i]. It returns the unescaped value
+// and the index of its end, or false if the tag is incomplete.
+func parseHTMLAttrValue(s string, i int) (value string, end int, ok bool) {
+	if i >= len(s) {
+		return "", 0, false
+	}
+	if quote := s[i]; quote == '"' || quote == '\'' {
+		closeQuote := strings.IndexByte(s[i+1:], quote)
+		if closeQuote < 0 {
+			return "", 0, false
+		}
+		return html.UnescapeString(s[i+1 : i+1+closeQuote]), i + closeQuote + 2, true
+	}
+	valueStart := i
+	for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '>' {
+		i++
+	}
+	return html.UnescapeString(s[valueStart:i]), i, true
+}
+
+// skipHTMLSpace returns the index of the first character at or after s[i] which is not a space.
+func skipHTMLSpace(s string, i int) int {
+	for i < len(s) && isHTMLSpace(s[i]) {
+		i++
+	}
+	return i
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
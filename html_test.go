@@ -0,0 +1,29 @@
+package gomatrix
+
+import "testing"
+
+func TestSanitizeMatrixHTML(t *testing.T) {
+	testCases := []struct {
+		Input string
+		Want  string
+	}{
+		{`<b>bold</b> and <i>italic</i>`, `<b>bold</b> and <i>italic</i>`},
+		{`<a href="https://matrix.org" onclick="evil()">link</a>`, `<a href="https://matrix.org">link</a>`},
+		{`<a href="javascript:alert(1)">link</a>`, `<a>link</a>`},
+		{`<A HREF='mailto:alice@example.org'>mail</A>`, `<a href="mailto:alice@example.org">mail</a>`},
+		{`<img src="https://example.org/cat.png"><img src="mxc://example.org/cat" alt="cat">`, `<img><img src="mxc://example.org/cat" alt="cat">`},
+		{`<script>alert("hi")</script>safe`, `safe`},
+		{`<marquee>still here</marquee>`, `still here`},
+		{`<code class="language-go">x</code><code class="evil">y</code>`, `<code class="language-go">x</code><code>y</code>`},
+		{`<font color="#ff0000" data-mx-color="red">red</font>`, `<font color="#ff0000">red</font>`},
+		{`<blockquote><p>unclosed`, `<blockquote><p>unclosed</p></blockquote>`},
+		{`<b><i>misnested</b></i>`, `<b><i>misnested</i></b>`},
+		{`1 < 2 <!-- comment --> & 3 > 2<br/>`, `1 &lt; 2  & 3 &gt; 2<br>`},
+		{`<a title="x" href="https://a.org/?q=1&amp;r=&quot;2&quot;">q</a>`, `<a href="https://a.org/?q=1&amp;r=&#34;2&#34;">q</a>`},
+	}
+	for _, tc := range testCases {
+		if got := SanitizeMatrixHTML(tc.Input); got != tc.Want {
+			t.Errorf("SanitizeMatrixHTML(%s): got %s, want %s", tc.Input, got, tc.Want)
+		}
+	}
+}
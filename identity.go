@@ -0,0 +1,125 @@
+package gomatrix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"path"
+	"sort"
+)
+
+// ErrNoIdentityServer is returned by identity server requests when Client.IdentityServerURL is not set.
+var ErrNoIdentityServer = errors.New("no identity server is configured")
+
+// ErrTermsNotAccepted is returned by AcceptIdentityServerTerms when there are new terms and Client.TermsCallback
+// is nil or declines them.
+var ErrTermsNotAccepted = errors.New("identity server terms were not accepted")
+
+// buildIdentityURL builds an identity server URL, authenticated with the identity server access token.
+func (cli *Client) buildIdentityURL(urlPath ...string) (string, error) {
+	if cli.IdentityServerURL == nil {
+		return "", ErrNoIdentityServer
+	}
+	isURL, _ := url.Parse(cli.IdentityServerURL.String())
+	isURL.Path = path.Join(append([]string{isURL.Path}, urlPath...)...)
+	if cli.IdentityAccessToken != "" {
+		query := isURL.Query()
+		query.Set("access_token", cli.IdentityAccessToken)
+		isURL.RawQuery = query.Encode()
+	}
+	return isURL.String(), nil
+}
+
+// GetHashDetails returns the pepper and the hashing algorithms supported by the identity server for hashed 3PID
+// lookups. See https://matrix.org/docs/spec/identity_service/r0.3.0#get-matrix-identity-v2-hash-details
+func (cli *Client) GetHashDetails() (resp *RespHashDetails, err error) {
+	u, err := cli.buildIdentityURL("_matrix", "identity", "v2", "hash_details")
+	if err != nil {
+		return nil, err
+	}
+	_, err = cli.MakeRequest("GET", u, nil, &resp)
+	return
+}
+
+// LookupThreePID returns the Matrix user ID bound to a third party identifier, such as an email address (medium
+// "email") or phone number (medium "msisdn"), or "" if there is none. The address is hashed with sha256 if the
+// identity server supports it, so the identity server never sees it in plain text.
+// See https://matrix.org/docs/spec/identity_service/r0.3.0#post-matrix-identity-v2-lookup
+func (cli *Client) LookupThreePID(medium, address string) (string, error) {
+	details, err := cli.GetHashDetails()
+	if err != nil {
+		return "", err
+	}
+	req := ReqIdentityLookup{Pepper: details.LookupPepper}
+	switch {
+	case details.supports("sha256"):
+		req.Algorithm = "sha256"
+		hash := sha256.Sum256([]byte(address + " " + medium + " " + details.LookupPepper))
+		req.Addresses = []string{base64.RawURLEncoding.EncodeToString(hash[:])}
+	case details.supports("none"):
+		req.Algorithm = "none"
+		req.Addresses = []string{address + " " + medium}
+	default:
+		return "", errors.New("identity server does not support the sha256 or none lookup algorithms")
+	}
+	u, err := cli.buildIdentityURL("_matrix", "identity", "v2", "lookup")
+	if err != nil {
+		return "", err
+	}
+	var resp RespIdentityLookup
+	if _, err = cli.MakeRequest("POST", u, &req, &resp); err != nil {
+		return "", err
+	}
+	return resp.Mappings[req.Addresses[0]], nil
+}
+
+// AcceptIdentityServerTerms makes sure the user has accepted the identity server's terms of service, which must
+// be done before using the identity server. Policies whose URL is already listed in the user's m.accepted_terms
+// account data are skipped. If there are any other policies, Client.TermsCallback is asked whether to accept
+// them; if it does, they are accepted with the identity server and added to m.accepted_terms.
+// See https://matrix.org/docs/spec/identity_service/r0.3.0#terms-of-service
+func (cli *Client) AcceptIdentityServerTerms(ctx context.Context) error {
+	termsURL, err := cli.buildIdentityURL("_matrix", "identity", "v2", "terms")
+	if err != nil {
+		return err
+	}
+	var terms RespTerms
+	if _, err = cli.makeRequestWithContext(ctx, "GET", termsURL, nil, &terms); err != nil {
+		return err
+	}
+
+	accountDataURL := cli.BuildURL("user", cli.userID(), "account_data", "m.accepted_terms")
+	var accepted acceptedTermsContent
+	if _, err = cli.makeRequestWithContext(ctx, "GET", accountDataURL, nil, &accepted); err != nil {
+		if httpErr, ok := err.(HTTPError); !ok || httpErr.Code != 404 {
+			return err
+		}
+	}
+	var newURLs []string
+	for _, policy := range terms.Policies {
+		if u := policy.url(accepted.Accepted); u != "" {
+			newURLs = append(newURLs, u)
+		}
+	}
+	if len(newURLs) == 0 {
+		return nil
+	}
+	if cli.TermsCallback == nil || !cli.TermsCallback(&terms) {
+		return ErrTermsNotAccepted
+	}
+
+	sort.Strings(newURLs)
+	if _, err = cli.makeRequestWithContext(ctx, "POST", termsURL, &ReqAcceptTerms{UserAccepts: newURLs}, nil); err != nil {
+		return err
+	}
+	accepted.Accepted = append(accepted.Accepted, newURLs...)
+	_, err = cli.makeRequestWithContext(ctx, "PUT", accountDataURL, &accepted, nil)
+	return err
+}
+
+// acceptedTermsContent is the content of the m.accepted_terms account data event.
+type acceptedTermsContent struct {
+	Accepted []string `json:"accepted"`
+}
@@ -0,0 +1,108 @@
+package gomatrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestClient_LookupThreePID(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host != "id.example.org" || req.URL.Query().Get("access_token") != "idtoken" {
+			return nil, fmt.Errorf("unexpected identity server request: %s", req.URL)
+		}
+		var body string
+		switch req.URL.Path {
+		case "/_matrix/identity/v2/hash_details":
+			body = `{"lookup_pepper":"matrixrocks","algorithms":["none","sha256"]}`
+		case "/_matrix/identity/v2/lookup":
+			var lookup ReqIdentityLookup
+			if err := json.NewDecoder(req.Body).Decode(&lookup); err != nil {
+				return nil, err
+			}
+			// The example hash from the identity service specification.
+			if lookup.Algorithm != "sha256" || lookup.Pepper != "matrixrocks" || len(lookup.Addresses) != 1 ||
+				lookup.Addresses[0] != "4kenr7N9drpCJ4AfalmlGQVsOn3o2RHjkADUpXJWZUc" {
+				return nil, fmt.Errorf("unexpected lookup %+v", lookup)
+			}
+			body = `{"mappings":{"4kenr7N9drpCJ4AfalmlGQVsOn3o2RHjkADUpXJWZUc":"@alice:example.com"}}`
+		default:
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	if _, err := cli.LookupThreePID("email", "alice@example.com"); err != ErrNoIdentityServer {
+		t.Fatalf("LookupThreePID: got error %v without an identity server, want ErrNoIdentityServer", err)
+	}
+	cli.IdentityServerURL, _ = url.Parse("https://id.example.org")
+	cli.IdentityAccessToken = "idtoken"
+
+	userID, err := cli.LookupThreePID("email", "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupThreePID: error, got %s", err.Error())
+	}
+	if userID != "@alice:example.com" {
+		t.Fatalf("LookupThreePID: got %s, want @alice:example.com", userID)
+	}
+}
+
+func TestClient_AcceptIdentityServerTerms(t *testing.T) {
+	var identityAccepts, accountData []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		var body string
+		switch req.Method + " " + req.URL.Path {
+		case "GET /_matrix/identity/v2/terms":
+			body = `{"policies":{
+				"terms_of_service":{"version":"2.0","en":{"name":"Terms","url":"https://id.example.org/tos-en"},"fr":{"name":"Conditions","url":"https://id.example.org/tos-fr"}},
+				"privacy_policy":{"version":"1.2","en":{"name":"Privacy","url":"https://id.example.org/privacy-en"}}
+			}}`
+		case "POST /_matrix/identity/v2/terms":
+			var accept ReqAcceptTerms
+			if err := json.NewDecoder(req.Body).Decode(&accept); err != nil {
+				return nil, err
+			}
+			identityAccepts = accept.UserAccepts
+			body = `{}`
+		case "GET /_matrix/client/r0/user/@user:test.gomatrix.org/account_data/m.accepted_terms":
+			body = `{"accepted":["https://id.example.org/tos-fr"]}`
+		case "PUT /_matrix/client/r0/user/@user:test.gomatrix.org/account_data/m.accepted_terms":
+			var content acceptedTermsContent
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				return nil, err
+			}
+			accountData = content.Accepted
+			body = `{}`
+		default:
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+	cli.IdentityServerURL, _ = url.Parse("https://id.example.org")
+
+	if err := cli.AcceptIdentityServerTerms(context.Background()); err != ErrTermsNotAccepted {
+		t.Fatalf("AcceptIdentityServerTerms: got error %v without a TermsCallback, want ErrTermsNotAccepted", err)
+	}
+	cli.TermsCallback = func(terms *RespTerms) bool {
+		return terms.Policies["privacy_policy"].Version == "1.2"
+	}
+	if err := cli.AcceptIdentityServerTerms(context.Background()); err != nil {
+		t.Fatalf("AcceptIdentityServerTerms: error, got %s", err.Error())
+	}
+	if len(identityAccepts) != 1 || identityAccepts[0] != "https://id.example.org/privacy-en" {
+		t.Fatalf("AcceptIdentityServerTerms: accepted %v with the identity server, want only the privacy policy", identityAccepts)
+	}
+	if len(accountData) != 2 {
+		t.Fatalf("AcceptIdentityServerTerms: stored accepted terms %v, want both policies", accountData)
+	}
+}
@@ -0,0 +1,151 @@
+package gomatrix
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	mdHeadingRegex       = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRuleRegex          = regexp.MustCompile(`^(?:-{3,}|\*{3,}|_{3,})\s*$`)
+	mdBulletRegex        = regexp.MustCompile(`^[-*+]\s+(.*)$`)
+	mdOrderedRegex       = regexp.MustCompile(`^(\d{1,9})[.)]\s+(.*)$`)
+	mdLinkRegex          = regexp.MustCompile(`\[([^\]]+)\]\(((?:[^()\s]|\([^()\s]*\))+)\)`) // URLs may contain balanced parentheses
+	mdStrongRegex        = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdEmphasisRegex      = regexp.MustCompile(`\*([^*\s](?:[^*]*[^*\s])?)\*|(^|[^\w])_([^_\s](?:[^_]*[^_\s])?)_($|[^\w])`)
+	mdStrikethroughRegex = regexp.MustCompile(`~~([^~]+)~~`)
+)
+
+// RenderMarkdown converts a Markdown message into the body and formatted_body of an m.room.message event. The
+// plain body is the rendered text with the Markdown syntax stripped, for clients which do not render HTML: list
+// items keep their bullets or numbers and links keep their URLs. Raw HTML in the source is escaped rather than
+// interpreted, and the result is passed through SanitizeMatrixHTML, so links with unsafe schemes are dropped.
+//
+// Paragraphs, line breaks, headings, block quotes, lists, horizontal rules, fenced code blocks, inline code,
+// links, bold, italic and ~~strikethrough~~ are supported.
+//
+//	plain, htmlText := gomatrix.RenderMarkdown("**Build failed**: see [the log](https://ci.example.org/1)")
+//	cli.SendFormattedText(roomID, plain, htmlText)
+func RenderMarkdown(md string) (plain, htmlText string) {
+	md = strings.TrimSpace(strings.Replace(md, "\r\n", "\n", -1))
+	htmlText = SanitizeMatrixHTML(renderMarkdownBlocks(strings.Split(md, "\n")))
+	return htmlToPlainText(htmlText), htmlText
+}
+
+// renderMarkdownBlocks renders block-level Markdown, recursing for the content of block quotes.
+func renderMarkdownBlocks(lines []string) string {
+	var out bytes.Buffer
+	var paragraph []string
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + strings.Join(paragraph, "<br>") + "</p>")
+			paragraph = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		var block string
+		switch {
+		case trimmed == "":
+			// A blank line ends the paragraph.
+		case strings.HasPrefix(trimmed, "```"):
+			block, i = renderMarkdownCode(lines, i)
+		case mdHeadingRegex.MatchString(trimmed):
+			m := mdHeadingRegex.FindStringSubmatch(trimmed)
+			level := strconv.Itoa(len(m[1]))
+			block = "<h" + level + ">" + renderMarkdownInline(m[2]) + "</h" + level + ">"
+		case mdRuleRegex.MatchString(trimmed):
+			block = "<hr>"
+		case strings.HasPrefix(trimmed, ">"):
+			block, i = renderMarkdownQuote(lines, i)
+		case mdBulletRegex.MatchString(trimmed):
+			block, i = renderMarkdownList(lines, i, mdBulletRegex, 1, "<ul>", "</ul>")
+		case mdOrderedRegex.MatchString(trimmed):
+			openTag := "<ol>"
+			if n, _ := strconv.Atoi(mdOrderedRegex.FindStringSubmatch(trimmed)[1]); n != 1 {
+				openTag = `<ol start="` + strconv.Itoa(n) + `">`
+			}
+			block, i = renderMarkdownList(lines, i, mdOrderedRegex, 2, openTag, "</ol>")
+		default:
+			paragraph = append(paragraph, renderMarkdownInline(trimmed))
+			continue
+		}
+		flushParagraph()
+		out.WriteString(block)
+	}
+	flushParagraph()
+	return out.String()
+}
+
+// renderMarkdownCode renders the fenced code block starting at lines[i]. It returns the HTML and the index of the
+// closing fence, or of the last line if the block is not closed.
+func renderMarkdownCode(lines []string, i int) (string, int) {
+	lang := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), "```"))
+	var code []string
+	for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+		code = append(code, lines[i])
+	}
+	class := ""
+	if lang != "" {
+		class = ` class="language-` + html.EscapeString(strings.Fields(lang)[0]) + `"`
+	}
+	return "<pre><code" + class + ">" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>", i
+}
+
+// renderMarkdownQuote renders the block quote starting at lines[i]. It returns the HTML and the index of the last
+// quoted line.
+func renderMarkdownQuote(lines []string, i int) (string, int) {
+	var quoted []string
+	for ; i < len(lines) && strings.HasPrefix(strings.TrimLeft(lines[i], " "), ">"); i++ {
+		q := strings.TrimPrefix(strings.TrimLeft(lines[i], " "), ">")
+		quoted = append(quoted, strings.TrimPrefix(q, " "))
+	}
+	return "<blockquote>" + renderMarkdownBlocks(quoted) + "</blockquote>", i - 1
+}
+
+// renderMarkdownList renders the list starting at lines[i], whose items match itemRegex with the item text in the
+// given submatch. It returns the HTML and the index of the last item.
+func renderMarkdownList(lines []string, i int, itemRegex *regexp.Regexp, submatch int, openTag, closeTag string) (string, int) {
+	var out bytes.Buffer
+	out.WriteString(openTag)
+	for ; i < len(lines) && itemRegex.MatchString(strings.TrimSpace(lines[i])); i++ {
+		item := itemRegex.FindStringSubmatch(strings.TrimSpace(lines[i]))[submatch]
+		out.WriteString("<li>" + renderMarkdownInline(item) + "</li>")
+	}
+	out.WriteString(closeTag)
+	return out.String(), i - 1
+}
+
+// renderMarkdownInline renders the inline Markdown in a single line. Code spans are rendered verbatim; everything
+// else is HTML-escaped before the inline syntax is converted, so the source cannot inject markup.
+func renderMarkdownInline(text string) string {
+	var out bytes.Buffer
+	for {
+		start := strings.IndexByte(text, '`')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(text[start+1:], '`')
+		if end < 0 {
+			break
+		}
+		out.WriteString(renderMarkdownSpans(text[:start]))
+		out.WriteString("<code>" + html.EscapeString(text[start+1:start+1+end]) + "</code>")
+		text = text[start+end+2:]
+	}
+	out.WriteString(renderMarkdownSpans(text))
+	return out.String()
+}
+
+// renderMarkdownSpans converts links and emphasis in text which contains no code spans.
+func renderMarkdownSpans(text string) string {
+	text = html.EscapeString(text)
+	text = mdLinkRegex.ReplaceAllString(text, `<a href="$2">$1</a>`)
+	text = mdStrongRegex.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = mdEmphasisRegex.ReplaceAllString(text, "$2<em>$1$3</em>$4")
+	text = mdStrikethroughRegex.ReplaceAllString(text, "<del>$1</del>")
+	return text
+}
@@ -0,0 +1,34 @@
+package gomatrix
+
+import "testing"
+
+func TestRenderMarkdown(t *testing.T) {
+	testCases := []struct {
+		Input     string
+		Want      string
+		WantPlain string
+	}{
+		{"hello world", "<p>hello world</p>", "hello world"},
+		{"**bold**, *italic*, _also italic_ and ~~gone~~", "<p><strong>bold</strong>, <em>italic</em>, <em>also italic</em> and <del>gone</del></p>", "bold, italic, also italic and gone"},
+		{"snake_case_name stays", "<p>snake_case_name stays</p>", "snake_case_name stays"},
+		{"see [the docs](https://matrix.org/docs?a=1&b=2)", `<p>see <a href="https://matrix.org/docs?a=1&amp;b=2">the docs</a></p>`, "see the docs (https://matrix.org/docs?a=1&b=2)"},
+		{"[click](javascript:alert(1))", "<p><a>click</a></p>", "click"},
+		{"[Go](https://en.wikipedia.org/wiki/Go_(programming_language)).", `<p><a href="https://en.wikipedia.org/wiki/Go_(programming_language)">Go</a>.</p>`, "Go (https://en.wikipedia.org/wiki/Go_(programming_language))."},
+		{"use `<b>` and `*x*`", "<p>use <code>&lt;b&gt;</code> and <code>*x*</code></p>", "use <b> and *x*"},
+		{"<script>alert(1)</script>hi <b>there</b>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;hi &lt;b&gt;there&lt;/b&gt;</p>", "<script>alert(1)</script>hi <b>there</b>"},
+		{"line one\nline two\n\nnext para", "<p>line one<br>line two</p><p>next para</p>", "line one\nline two\n\nnext para"},
+		{"## Title ##\ntext", "<h2>Title</h2><p>text</p>", "Title\n\ntext"},
+		{"- one\n- **two**\n\n3. three\n4. four", "<ul><li>one</li><li><strong>two</strong></li></ul><ol start=\"3\"><li>three</li><li>four</li></ol>", "- one\n- two\n\n3. three\n4. four"},
+		{"> quoted\n> # heading\nafter", "<blockquote><p>quoted</p><h1>heading</h1></blockquote><p>after</p>", "> quoted\n\n> heading\n\nafter"},
+		{"```go\nif a < b {\n}\n```\n---", "<pre><code class=\"language-go\">if a &lt; b {\n}</code></pre><hr>", "if a < b {\n}"},
+	}
+	for _, tc := range testCases {
+		plain, htmlText := RenderMarkdown(tc.Input)
+		if plain != tc.WantPlain {
+			t.Errorf("RenderMarkdown(%q): got plain body %q, want %q", tc.Input, plain, tc.WantPlain)
+		}
+		if htmlText != tc.Want {
+			t.Errorf("RenderMarkdown(%q): got %s, want %s", tc.Input, htmlText, tc.Want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package gomatrix
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// matrixToPrefix is the prefix of matrix.to permalinks, which clients render as mentions ("pills").
+const matrixToPrefix = "https://matrix.to/#/"
+
+var mxReplyRegex = regexp.MustCompile(`(?s)<mx-reply>.*?</mx-reply>`)
+
+// matrixToURL returns the matrix.to permalink for a user ID, room ID or room alias. The "#" of a room alias is
+// escaped, as matrix.to URLs put the identifier in the fragment.
+func matrixToURL(id string) string {
+	return matrixToPrefix + strings.Replace(id, "#", "%23", -1)
+}
+
+// UserPill returns the HTML for a mention of a user, which clients render as a "pill" with the user's avatar. The
+// link text is the display name, or the user ID if displayName is "".
+func UserPill(userID, displayName string) string {
+	if displayName == "" {
+		displayName = userID
+	}
+	return `<a href="` + html.EscapeString(matrixToURL(userID)) + `">` + html.EscapeString(displayName) + "</a>"
+}
+
+// RoomPill returns the HTML for a link to a room, by room ID or alias, which clients render as a pill. The link
+// text is the display name, or the room ID or alias if displayName is "".
+func RoomPill(roomID, displayName string) string {
+	if displayName == "" {
+		displayName = roomID
+	}
+	return `<a href="` + html.EscapeString(matrixToURL(roomID)) + `">` + html.EscapeString(displayName) + "</a>"
+}
+
+// AtRoomPill returns the HTML for an @room mention, which notifies everyone in the room if the sender has the power
+// level to do so. Clients render the text itself as a pill.
+func AtRoomPill() string {
+	return "@room"
+}
+
+// MessageBuilder composes the content of an m.text message with HTML formatting, mentions, a reply and a thread.
+// Text is added in order by Body, HTML and MentionUser, and the plain body and formatted_body are both built from
+// it, so that clients which do not render HTML get a matching fallback.
+//
+//	content, err := gomatrix.NewMessageBuilder().
+//		MentionUser("@alice:example.org", "Alice").
+//		Body(": the build ").
+//		HTML("<b>failed</b>").
+//		Reply(event).
+//		Build()
+//	if err == nil {
+//		_, err = cli.SendMessageEvent(roomID, "m.room.message", content)
+//	}
+type MessageBuilder struct {
+	plain     bytes.Buffer
+	html      bytes.Buffer
+	formatted bool     // whether formatted_body is needed, i.e. HTML or a mention was added
+	mentions  []string // user IDs for m.mentions
+	reply     *Event
+	thread    string
+}
+
+// NewMessageBuilder returns an empty MessageBuilder.
+func NewMessageBuilder() *MessageBuilder {
+	return &MessageBuilder{}
+}
+
+// Body adds plain text to the message. It is escaped in the formatted body.
+func (b *MessageBuilder) Body(text string) *MessageBuilder {
+	b.plain.WriteString(text)
+	b.html.WriteString(strings.Replace(html.EscapeString(text), "\n", "<br>", -1))
+	return b
+}
+
+// HTML adds HTML to the message. It is sanitized with SanitizeMatrixHTML, and its text content is added to the
+// plain body.
+func (b *MessageBuilder) HTML(htmlText string) *MessageBuilder {
+	htmlText = SanitizeMatrixHTML(htmlText)
+	b.plain.WriteString(htmlToPlainText(htmlText))
+	b.html.WriteString(htmlText)
+	b.formatted = true
+	return b
+}
+
+// MentionUser adds a mention of a user, which clients render as a pill and which notifies the user. The plain body
+// gets the display name, or the user ID if displayName is "".
+func (b *MessageBuilder) MentionUser(userID, displayName string) *MessageBuilder {
+	if displayName == "" {
+		displayName = userID
+	}
+	b.plain.WriteString(displayName)
+	b.html.WriteString(UserPill(userID, displayName))
+	b.formatted = true
+	b.mentions = append(b.mentions, userID)
+	return b
+}
+
+// Thread makes the message part of the thread started by the given event.
+func (b *MessageBuilder) Thread(parentEventID string) *MessageBuilder {
+	b.thread = parentEventID
+	return b
+}
+
+// Reply makes the message a reply to the given event, quoting it in the fallback bodies and mentioning its sender.
+// The event must have an ID and a room ID.
+func (b *MessageBuilder) Reply(inReplyTo *Event) *MessageBuilder {
+	b.reply = inReplyTo
+	return b
+}
+
+// mentionSet returns the user IDs without duplicates, in the order they were first mentioned.
+func mentionSet(userIDs []string) []string {
+	var set []string
+	seen := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if !seen[userID] {
+			seen[userID] = true
+			set = append(set, userID)
+		}
+	}
+	return set
+}
+
+// Build returns the message content, to be sent with Client.SendMessageEvent as an m.room.message event. It returns
+// an error if the message is empty or the event passed to Reply has no ID or room ID.
+func (b *MessageBuilder) Build() (interface{}, error) {
+	if b.plain.Len() == 0 && b.html.Len() == 0 {
+		return nil, errors.New("message has no body")
+	}
+	plain, formatted := b.plain.String(), b.html.String()
+	mentions := mentionSet(b.mentions)
+	content := map[string]interface{}{"msgtype": "m.text"}
+	if b.reply != nil {
+		if b.reply.ID == "" || b.reply.RoomID == "" {
+			return nil, errors.New("reply event has no event ID or room ID")
+		}
+		mentions = mentionSet(append(mentions, b.reply.Sender))
+		plain = replyFallbackPlain(b.reply) + plain
+		formatted = replyFallbackHTML(b.reply) + formatted
+	}
+	content["body"] = plain
+	if b.formatted || b.reply != nil {
+		content["format"] = "org.matrix.custom.html"
+		content["formatted_body"] = formatted
+	}
+	if len(mentions) > 0 {
+		content["m.mentions"] = map[string]interface{}{"user_ids": mentions}
+	}
+	switch {
+	case b.thread != "":
+		relatesTo := map[string]interface{}{"rel_type": "m.thread", "event_id": b.thread}
+		if b.reply != nil {
+			relatesTo["m.in_reply_to"] = map[string]interface{}{"event_id": b.reply.ID}
+		} else {
+			// Clients without thread support show the message as a reply to the thread root.
+			relatesTo["m.in_reply_to"] = map[string]interface{}{"event_id": b.thread}
+			relatesTo["is_falling_back"] = true
+		}
+		content["m.relates_to"] = relatesTo
+	case b.reply != nil:
+		content["m.relates_to"] = map[string]interface{}{
+			"m.in_reply_to": map[string]interface{}{"event_id": b.reply.ID},
+		}
+	}
+	return content, nil
+}
+
+// replyFallbackPlain quotes an event for the plain body of a reply, without any reply fallback of its own.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#fallbacks-for-rich-replies
+func replyFallbackPlain(event *Event) string {
+	body, _ := event.Body()
+	lines := strings.Split(body, "\n")
+	// Strip the quoted lines of a reply fallback in the event itself. Other events may start with a quote of their
+	// own, which is kept.
+	for isReply(event) && len(lines) > 1 && strings.HasPrefix(lines[0], "> ") {
+		lines = lines[1:]
+		if lines[0] == "" {
+			lines = lines[1:]
+			break
+		}
+	}
+	var out bytes.Buffer
+	for i, line := range lines {
+		out.WriteString("> ")
+		if i == 0 {
+			out.WriteString("<" + event.Sender + "> ")
+		}
+		out.WriteString(line + "\n")
+	}
+	out.WriteString("\n")
+	return out.String()
+}
+
+// isReply returns true if the event is a reply to another event, so its bodies may start with a reply fallback.
+func isReply(event *Event) bool {
+	relatesTo, _ := event.Content["m.relates_to"].(map[string]interface{})
+	_, ok := relatesTo["m.in_reply_to"]
+	return ok
+}
+
+// replyFallbackHTML quotes an event for the formatted body of a reply, without any reply fallback of its own.
+func replyFallbackHTML(event *Event) string {
+	quoted, _ := event.Content["formatted_body"].(string)
+	if format, _ := event.Content["format"].(string); format != "org.matrix.custom.html" || quoted == "" {
+		body, _ := event.Body()
+		quoted = strings.Replace(html.EscapeString(body), "\n", "<br>", -1)
+	} else {
+		quoted = SanitizeMatrixHTML(mxReplyRegex.ReplaceAllString(quoted, ""))
+	}
+	eventLink := html.EscapeString(matrixToURL(event.RoomID) + "/" + event.ID)
+	return `<mx-reply><blockquote><a href="` + eventLink + `">In reply to</a> ` + UserPill(event.Sender, "") +
+		"<br>" + quoted + "</blockquote></mx-reply>"
+}
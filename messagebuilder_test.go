@@ -0,0 +1,101 @@
+package gomatrix
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMessageBuilder(t *testing.T) {
+	content, err := NewMessageBuilder().
+		MentionUser("@alice:bar", "Alice").
+		Body(": 1 < 2\n").
+		HTML("<b>bold</b><script>x</script>").
+		Build()
+	if err != nil {
+		t.Fatalf("Build: returned error: %s", err)
+	}
+	c := content.(map[string]interface{})
+	wantHTML := `<a href="https://matrix.to/#/@alice:bar">Alice</a>: 1 &lt; 2<br><b>bold</b>`
+	if c["body"] != "Alice: 1 < 2\nbold" || c["format"] != "org.matrix.custom.html" || c["formatted_body"] != wantHTML {
+		t.Fatalf("Build: got %q, %q", c["body"], c["formatted_body"])
+	}
+	if mentions, _ := json.Marshal(c["m.mentions"]); string(mentions) != `{"user_ids":["@alice:bar"]}` {
+		t.Fatalf("Build: got m.mentions %s", mentions)
+	}
+
+	content, err = NewMessageBuilder().Body("plain").Build()
+	if got, _ := json.Marshal(content); err != nil || string(got) != `{"body":"plain","msgtype":"m.text"}` {
+		t.Fatalf("Build: got %s, %v for a plain message", got, err)
+	}
+	if _, err = NewMessageBuilder().Build(); err == nil {
+		t.Fatalf("Build: expected an error for an empty message")
+	}
+}
+
+func TestMessageBuilder_Reply(t *testing.T) {
+	original := &Event{ID: "$orig", RoomID: "!foo:bar", Sender: "@bob:bar", Content: map[string]interface{}{
+		"body":           "> <@carol:bar> earlier\n\nsecond\nthird",
+		"format":         "org.matrix.custom.html",
+		"formatted_body": "<mx-reply><blockquote>earlier</blockquote></mx-reply>second<br>third",
+		"m.relates_to":   map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": "$earlier"}},
+	}}
+	content, err := NewMessageBuilder().Body("agreed").Reply(original).Build()
+	if err != nil {
+		t.Fatalf("Build: returned error: %s", err)
+	}
+	c := content.(map[string]interface{})
+	if c["body"] != "> <@bob:bar> second\n> third\n\nagreed" {
+		t.Fatalf("Build: got body %q", c["body"])
+	}
+	wantHTML := `<mx-reply><blockquote><a href="https://matrix.to/#/!foo:bar/$orig">In reply to</a> ` +
+		`<a href="https://matrix.to/#/@bob:bar">@bob:bar</a><br>second<br>third</blockquote></mx-reply>agreed`
+	if c["formatted_body"] != wantHTML {
+		t.Fatalf("Build: got formatted_body %q, want %q", c["formatted_body"], wantHTML)
+	}
+	relatesTo, _ := json.Marshal(c["m.relates_to"])
+	if string(relatesTo) != `{"m.in_reply_to":{"event_id":"$orig"}}` {
+		t.Fatalf("Build: got m.relates_to %s", relatesTo)
+	}
+
+	content, _ = NewMessageBuilder().Body("in thread").Thread("$root").Build()
+	relatesTo, _ = json.Marshal(content.(map[string]interface{})["m.relates_to"])
+	if string(relatesTo) != `{"event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$root"},"rel_type":"m.thread"}` {
+		t.Fatalf("Build: got m.relates_to %s for a thread", relatesTo)
+	}
+	if _, err = NewMessageBuilder().Body("x").Reply(&Event{Sender: "@bob:bar"}).Build(); err == nil {
+		t.Fatalf("Build: expected an error for a reply to an event without an ID")
+	}
+}
+
+func TestMessageBuilder_ReplyToQuote(t *testing.T) {
+	// A message which starts with a Markdown quote but is not a reply keeps its quote in the fallback.
+	original := &Event{ID: "$orig", RoomID: "!foo:bar", Sender: "@bob:bar", Content: map[string]interface{}{
+		"body": "> to be or not to be\n\nthat is the question",
+	}}
+	content, err := NewMessageBuilder().Body("indeed").Reply(original).Build()
+	if err != nil {
+		t.Fatalf("Build: returned error: %s", err)
+	}
+	want := "> <@bob:bar> > to be or not to be\n> \n> that is the question\n\nindeed"
+	if body := content.(map[string]interface{})["body"]; body != want {
+		t.Fatalf("Build: got body %q, want %q", body, want)
+	}
+}
+
+func TestPills(t *testing.T) {
+	if got := UserPill("@alice:bar", "Alice <3"); got != `<a href="https://matrix.to/#/@alice:bar">Alice &lt;3</a>` {
+		t.Errorf("UserPill: got %s", got)
+	}
+	if got := UserPill("@alice:bar", ""); got != `<a href="https://matrix.to/#/@alice:bar">@alice:bar</a>` {
+		t.Errorf("UserPill: got %s without a display name", got)
+	}
+	if got := RoomPill("#chat:bar", ""); got != `<a href="https://matrix.to/#/%23chat:bar">#chat:bar</a>` {
+		t.Errorf("RoomPill: got %s for an alias", got)
+	}
+	if got := RoomPill("!foo:bar", "Chat"); got != `<a href="https://matrix.to/#/!foo:bar">Chat</a>` {
+		t.Errorf("RoomPill: got %s", got)
+	}
+	if got := AtRoomPill(); got != "@room" {
+		t.Errorf("AtRoomPill: got %s", got)
+	}
+}
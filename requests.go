@@ -10,6 +10,31 @@ type ReqRegister struct {
 	Auth                     interface{} `json:"auth,omitempty"`
 }
 
+// User-interactive authentication stages. See https://matrix.org/docs/spec/client_server/r0.6.0#authentication-types
+const (
+	AuthTypeDummy         = "m.login.dummy"
+	AuthTypeRecaptcha     = "m.login.recaptcha"
+	AuthTypeTerms         = "m.login.terms"
+	AuthTypeEmailIdentity = "m.login.email.identity"
+)
+
+// ReqUIAuth is the "auth" dict used to complete a stage of user-interactive authentication, e.g. as ReqRegister.Auth.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#user-interactive-authentication-api
+type ReqUIAuth struct {
+	Type          string         `json:"type"`
+	Session       string         `json:"session,omitempty"`
+	Response      string         `json:"response,omitempty"`       // The CAPTCHA response, for m.login.recaptcha
+	ThreePIDCreds *ThreePIDCreds `json:"threepid_creds,omitempty"` // The validated email, for m.login.email.identity
+}
+
+// ThreePIDCreds identifies a third party identifier validation session, e.g. an email sent by requestToken.
+type ThreePIDCreds struct {
+	SID           string `json:"sid"`
+	ClientSecret  string `json:"client_secret"`
+	IDServer      string `json:"id_server,omitempty"`
+	IDAccessToken string `json:"id_access_token,omitempty"`
+}
+
 // ReqLogin is the JSON request for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-login
 type ReqLogin struct {
 	Type                     string `json:"type"`
@@ -23,17 +48,57 @@ type ReqLogin struct {
 }
 
 // ReqCreateRoom is the JSON request for https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
+//
+// Each field maps onto the request key named in its JSON tag. To create a space, set CreationContent to
+// {"type": "m.space"}. State events in InitialState are sent after the preset and power levels are applied.
 type ReqCreateRoom struct {
-	Visibility      string                 `json:"visibility,omitempty"`
-	RoomAliasName   string                 `json:"room_alias_name,omitempty"`
-	Name            string                 `json:"name,omitempty"`
-	Topic           string                 `json:"topic,omitempty"`
-	Invite          []string               `json:"invite,omitempty"`
-	Invite3PID      []ReqInvite3PID        `json:"invite_3pid,omitempty"`
-	CreationContent map[string]interface{} `json:"creation_content,omitempty"`
-	InitialState    []Event                `json:"initial_state,omitempty"`
-	Preset          string                 `json:"preset,omitempty"`
-	IsDirect        bool                   `json:"is_direct,omitempty"`
+	Visibility                string                 `json:"visibility,omitempty"`                   // "public" or "private"
+	RoomAliasName             string                 `json:"room_alias_name,omitempty"`              // The localpart of the room's canonical alias
+	Name                      string                 `json:"name,omitempty"`                         // Sent as an m.room.name state event
+	Topic                     string                 `json:"topic,omitempty"`                        // Sent as an m.room.topic state event
+	Invite                    []string               `json:"invite,omitempty"`                       // User IDs to invite
+	Invite3PID                []ReqInvite3PID        `json:"invite_3pid,omitempty"`                  // Third party IDs to invite
+	CreationContent           map[string]interface{} `json:"creation_content,omitempty"`             // Extra keys for the m.room.create content, e.g. "type"
+	InitialState              []Event                `json:"initial_state,omitempty"`                // Only Type, StateKey and Content are used
+	Preset                    string                 `json:"preset,omitempty"`                       // "private_chat", "public_chat" or "trusted_private_chat"
+	IsDirect                  bool                   `json:"is_direct,omitempty"`                    // Flags the invites as direct chats
+	PowerLevelContentOverride map[string]interface{} `json:"power_level_content_override,omitempty"` // Merged over the default m.room.power_levels content
+	RoomVersion               string                 `json:"room_version,omitempty"`                 // The room version to create, or the server default
+}
+
+// ReqMembers holds the query parameters for https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-rooms-roomid-members
+type ReqMembers struct {
+	At            string // A sync token: return the members as of this point in the room's history
+	Membership    string // Only return members with this membership, e.g. "join"
+	NotMembership string // Exclude members with this membership, e.g. "leave"
+}
+
+// ReqPublicRooms is the JSON request for https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-publicrooms
+type ReqPublicRooms struct {
+	Limit                int                `json:"limit,omitempty"`
+	Since                string             `json:"since,omitempty"` // The next_batch token of the previous page
+	Filter               *PublicRoomsFilter `json:"filter,omitempty"`
+	IncludeAllNetworks   bool               `json:"include_all_networks,omitempty"`
+	ThirdPartyInstanceID string             `json:"third_party_instance_id,omitempty"`
+}
+
+// PublicRoomsFilter filters the rooms returned by the room directory.
+type PublicRoomsFilter struct {
+	GenericSearchTerm string `json:"generic_search_term,omitempty"` // Matched against the room's name, topic and alias
+}
+
+// ReqJoinRoom is the JSON request for https://matrix.org/docs/spec/client_server/r0.3.0.html#post-matrix-client-r0-join-roomidoralias
+type ReqJoinRoom struct {
+	ThirdPartySigned *ReqThirdPartySigned `json:"third_party_signed,omitempty"`
+}
+
+// ReqThirdPartySigned is the signed third party invite used to join a room the user was invited to by third party ID.
+// See https://matrix.org/docs/spec/client_server/r0.3.0.html#post-matrix-client-r0-join-roomidoralias
+type ReqThirdPartySigned struct {
+	Sender     string                       `json:"sender"`
+	MXID       string                       `json:"mxid"`
+	Token      string                       `json:"token"`
+	Signatures map[string]map[string]string `json:"signatures"`
 }
 
 // ReqRedact is the JSON request for http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-redact-eventid-txnid
@@ -51,6 +116,7 @@ type ReqInvite3PID struct {
 
 // ReqInviteUser is the JSON request for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-invite
 type ReqInviteUser struct {
+	Reason string `json:"reason,omitempty"`
 	UserID string `json:"user_id"`
 }
 
@@ -68,11 +134,68 @@ type ReqBanUser struct {
 
 // ReqUnbanUser is the JSON request for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-unban
 type ReqUnbanUser struct {
+	Reason string `json:"reason,omitempty"`
 	UserID string `json:"user_id"`
 }
 
+// ReqReportContent is the JSON request for https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-rooms-roomid-report-eventid
+type ReqReportContent struct {
+	Reason string `json:"reason"`
+	Score  int    `json:"score"` // From -100 (most offensive) to 0 (inoffensive)
+}
+
+// ReqSetReadMarkers is the JSON request for https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-rooms-roomid-read-markers
+type ReqSetReadMarkers struct {
+	FullyRead string `json:"m.fully_read,omitempty"`
+	Read      string `json:"m.read,omitempty"`
+}
+
 // ReqTyping is the JSON request for https://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-typing-userid
 type ReqTyping struct {
 	Typing  bool  `json:"typing"`
 	Timeout int64 `json:"timeout"`
 }
+
+// ReqPresenceList is the JSON request for https://matrix.org/docs/spec/client_server/r0.0.1.html#post-matrix-client-r0-presence-list-userid
+type ReqPresenceList struct {
+	Invite []string `json:"invite,omitempty"` // User IDs to add to the presence list
+	Drop   []string `json:"drop,omitempty"`   // User IDs to remove from the presence list
+}
+
+// ReqSendToDevice is the JSON request for https://matrix.org/docs/spec/client_server/r0.3.0.html#put-matrix-client-r0-sendtodevice-eventtype-txnid
+// Messages maps user IDs to device IDs to event content. The device ID "*" addresses all of the user's devices.
+type ReqSendToDevice struct {
+	Messages map[string]map[string]interface{} `json:"messages"`
+}
+
+// ReqNotaryKeys is the JSON request for https://matrix.org/docs/spec/server_server/r0.1.0.html#post-matrix-key-v2-query
+type ReqNotaryKeys struct {
+	ServerKeys map[string]map[string]struct{} `json:"server_keys"`
+}
+
+// BatchSendRequest is a single event to send with Client.SendBatch.
+type BatchSendRequest struct {
+	RoomID    string
+	EventType string
+	Content   interface{} // Encoded as JSON using json.Marshal
+}
+
+// StateEventReq is a single state event to send with Client.SendStateEvents.
+type StateEventReq struct {
+	Type        string
+	StateKey    string
+	Content     interface{} // Encoded as JSON using json.Marshal
+	StopOnError bool        // If sending this event fails, the events after it are not sent
+}
+
+// ReqIdentityLookup is the JSON request for https://matrix.org/docs/spec/identity_service/r0.3.0#post-matrix-identity-v2-lookup
+type ReqIdentityLookup struct {
+	Addresses []string `json:"addresses"`
+	Algorithm string   `json:"algorithm"`
+	Pepper    string   `json:"pepper"`
+}
+
+// ReqAcceptTerms is the JSON request for https://matrix.org/docs/spec/identity_service/r0.3.0#post-matrix-identity-v2-terms
+type ReqAcceptTerms struct {
+	UserAccepts []string `json:"user_accepts"`
+}
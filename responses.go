@@ -1,5 +1,10 @@
 package gomatrix
 
+import (
+	"encoding/json"
+	"sort"
+)
+
 // RespError is the standard JSON error response from Homeservers. It also implements the Golang "error" interface.
 // See http://matrix.org/docs/spec/client_server/r0.2.0.html#api-standards
 type RespError struct {
@@ -19,7 +24,8 @@ type RespCreateFilter struct {
 
 // RespVersions is the JSON response for http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-versions
 type RespVersions struct {
-	Versions []string `json:"versions"`
+	Versions         []string        `json:"versions"`
+	UnstableFeatures map[string]bool `json:"unstable_features"`
 }
 
 // RespJoinRoom is the JSON response for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-join
@@ -53,6 +59,10 @@ type RespJoinedRooms struct {
 	JoinedRooms []string `json:"joined_rooms"`
 }
 
+// RespPresenceList is the JSON response for https://matrix.org/docs/spec/client_server/r0.0.1.html#get-matrix-client-r0-presence-list-userid
+// It holds an m.presence event for each user on the presence list.
+type RespPresenceList []Event
+
 // RespJoinedMembers is the JSON response for TODO-SPEC https://github.com/matrix-org/synapse/pull/1680
 type RespJoinedMembers struct {
 	Joined map[string]struct {
@@ -78,13 +88,24 @@ type RespMediaUpload struct {
 	ContentURI string `json:"content_uri"`
 }
 
+// RespMediaConfig is the JSON response for https://matrix.org/docs/spec/client_server/r0.4.0.html#get-matrix-media-r0-config
+type RespMediaConfig struct {
+	UploadSize int64 `json:"m.upload.size,omitempty"` // The maximum upload size in bytes, or 0 if unknown
+}
+
+// RespCreateMXC is the JSON response for POST /_matrix/media/v1/create - https://github.com/matrix-org/matrix-doc/pull/2246
+type RespCreateMXC struct {
+	ContentURI      string `json:"content_uri"`
+	UnusedExpiresAt int64  `json:"unused_expires_at,omitempty"`
+}
+
 // RespUserInteractive is the JSON response for https://matrix.org/docs/spec/client_server/r0.2.0.html#user-interactive-authentication-api
 type RespUserInteractive struct {
 	Flows []struct {
 		Stages []string `json:"stages"`
 	} `json:"flows"`
 	Params    map[string]interface{} `json:"params"`
-	Session   string                 `json:"string"`
+	Session   string                 `json:"session"`
 	Completed []string               `json:"completed"`
 	ErrCode   string                 `json:"errcode"`
 	Error     string                 `json:"error"`
@@ -100,6 +121,34 @@ func (r RespUserInteractive) HasSingleStageFlow(stageName string) bool {
 	return false
 }
 
+// NextStage returns the first stage which has not been completed yet in the first flow consistent with the
+// completed stages, or "" if there is no such flow.
+func (r RespUserInteractive) NextStage() string {
+	for _, f := range r.Flows {
+		if len(f.Stages) <= len(r.Completed) {
+			continue
+		}
+		matches := true
+		for i, stage := range r.Completed {
+			if f.Stages[i] != stage {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return f.Stages[len(r.Completed)]
+		}
+	}
+	return ""
+}
+
+// RecaptchaPublicKey returns the public key to show the m.login.recaptcha CAPTCHA with, or "" if there isn't one.
+func (r RespUserInteractive) RecaptchaPublicKey() string {
+	params, _ := r.Params[AuthTypeRecaptcha].(map[string]interface{})
+	key, _ := params["public_key"].(string)
+	return key
+}
+
 // RespUserDisplayName is the JSON response for https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-profile-userid-displayname
 type RespUserDisplayName struct {
 	DisplayName string `json:"displayname"`
@@ -125,6 +174,9 @@ type RespLogin struct {
 // RespLogout is the JSON response for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-logout
 type RespLogout struct{}
 
+// RespLogoutAll is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-logout-all
+type RespLogoutAll struct{}
+
 // RespCreateRoom is the JSON response for https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
 type RespCreateRoom struct {
 	RoomID string `json:"room_id"`
@@ -139,38 +191,319 @@ type RespSync struct {
 	Presence struct {
 		Events []Event `json:"events"`
 	} `json:"presence"`
+	ToDevice struct {
+		Events []Event `json:"events"`
+	} `json:"to_device"`
 	Rooms struct {
-		Leave map[string]struct {
-			State struct {
-				Events []Event `json:"events"`
-			} `json:"state"`
-			Timeline struct {
-				Events    []Event `json:"events"`
-				Limited   bool    `json:"limited"`
-				PrevBatch string  `json:"prev_batch"`
-			} `json:"timeline"`
-		} `json:"leave"`
-		Join map[string]struct {
-			State struct {
-				Events []Event `json:"events"`
-			} `json:"state"`
-			Timeline struct {
-				Events    []Event `json:"events"`
-				Limited   bool    `json:"limited"`
-				PrevBatch string  `json:"prev_batch"`
-			} `json:"timeline"`
-		} `json:"join"`
-		Invite map[string]struct {
-			State struct {
-				Events []Event
-			} `json:"invite_state"`
-		} `json:"invite"`
+		Leave  map[string]SyncLeftRoom    `json:"leave"`
+		Join   map[string]SyncJoinedRoom  `json:"join"`
+		Invite map[string]SyncInvitedRoom `json:"invite"`
 	} `json:"rooms"`
 }
 
+// SyncLeftRoom is a room the user has left, in the rooms.leave section of a /sync response.
+type SyncLeftRoom struct {
+	State struct {
+		Events []Event `json:"events"`
+	} `json:"state"`
+	Timeline SyncTimeline `json:"timeline"`
+}
+
+// SyncJoinedRoom is a room the user has joined, in the rooms.join section of a /sync response.
+type SyncJoinedRoom struct {
+	State struct {
+		Events []Event `json:"events"`
+	} `json:"state"`
+	Timeline  SyncTimeline `json:"timeline"`
+	Ephemeral struct {
+		Events []Event `json:"events"`
+	} `json:"ephemeral"`
+	AccountData struct {
+		Events []Event `json:"events"`
+	} `json:"account_data"`
+}
+
+// SyncInvitedRoom is a room the user has been invited to, in the rooms.invite section of a /sync response.
+type SyncInvitedRoom struct {
+	State struct {
+		Events []Event
+	} `json:"invite_state"`
+}
+
+// SyncTimeline is the timeline of a room in a /sync response.
+type SyncTimeline struct {
+	Events    []Event `json:"events"`
+	Limited   bool    `json:"limited"`
+	PrevBatch string  `json:"prev_batch"`
+}
+
 type RespTurnServer struct {
 	Username string   `json:"username"`
 	Password string   `json:"password"`
 	TTL      int      `json:"ttl"`
 	URIs     []string `json:"uris"`
 }
+
+// RespRoomKeysVersion is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixclientv3room_keysversion
+type RespRoomKeysVersion struct {
+	Version   string          `json:"version"`
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	Count     int             `json:"count"`
+	ETag      string          `json:"etag"`
+}
+
+// RespCapabilities is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-capabilities
+// Each capability is left as raw JSON, as its shape depends on the capability.
+type RespCapabilities struct {
+	Capabilities map[string]json.RawMessage `json:"capabilities"`
+}
+
+// Enabled returns true if the named capability is present with "enabled": true.
+func (r RespCapabilities) Enabled(name string) bool {
+	var capability struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.Unmarshal(r.Capabilities[name], &capability); err != nil {
+		return false
+	}
+	return capability.Enabled
+}
+
+// RoomVersions returns the m.room_versions capability. If the homeserver does not advertise it, the result has
+// no default and no available versions.
+func (r RespCapabilities) RoomVersions() (*RoomVersionsCapability, error) {
+	var roomVersions RoomVersionsCapability
+	if raw, ok := r.Capabilities["m.room_versions"]; ok {
+		if err := json.Unmarshal(raw, &roomVersions); err != nil {
+			return nil, err
+		}
+	}
+	if roomVersions.Available == nil {
+		roomVersions.Available = make(map[string]string)
+	}
+	return &roomVersions, nil
+}
+
+// RoomVersionsCapability is the m.room_versions capability.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-room-versions-capability
+type RoomVersionsCapability struct {
+	Default   string            `json:"default"`
+	Available map[string]string `json:"available"` // Room version to "stable" or "unstable"
+}
+
+// DeviceKeys are the identity keys of a single device. See https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-keys-upload
+type DeviceKeys struct {
+	UserID     string                       `json:"user_id"`
+	DeviceID   string                       `json:"device_id"`
+	Algorithms []string                     `json:"algorithms"`
+	Keys       map[string]string            `json:"keys"`       // Key ID (e.g. "ed25519:DEVICEID") to key
+	Signatures map[string]map[string]string `json:"signatures"` // User ID to key ID to signature
+}
+
+// RespKeyServerUserKeys is the JSON response for GET /_matrix/client/v1/keys/user/{userID} (MSC3814).
+type RespKeyServerUserKeys struct {
+	UserID     string                `json:"user_id"`
+	DeviceKeys map[string]DeviceKeys `json:"device_keys"` // Device ID to keys
+}
+
+// RespRoomSummary is the JSON response for GET /_matrix/client/v1/rooms/{roomID}/summary (MSC3266).
+type RespRoomSummary struct {
+	RoomID           string   `json:"room_id"`
+	CanonicalAlias   string   `json:"canonical_alias,omitempty"`
+	Name             string   `json:"name,omitempty"`
+	Topic            string   `json:"topic,omitempty"`
+	AvatarURL        string   `json:"avatar_url,omitempty"`
+	NumJoinedMembers int      `json:"num_joined_members"`
+	JoinRule         string   `json:"join_rule,omitempty"`
+	RoomType         string   `json:"room_type,omitempty"`
+	RoomVersion      string   `json:"room_version,omitempty"`
+	WorldReadable    bool     `json:"world_readable"`
+	GuestCanJoin     bool     `json:"guest_can_join"`
+	Encryption       string   `json:"encryption,omitempty"`
+	AllowedRoomIDs   []string `json:"allowed_room_ids,omitempty"`
+	Membership       string   `json:"membership,omitempty"` // The user's membership, if they are in the room
+}
+
+// RespGetNotifications is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-notifications
+type RespGetNotifications struct {
+	NextToken     string         `json:"next_token"` // Pass as "from" to get the next page. Empty if there are no more.
+	Notifications []Notification `json:"notifications"`
+}
+
+// Notification is a single event which the user was notified about.
+type Notification struct {
+	Actions    []interface{} `json:"actions"` // The push rule actions which caused the notification
+	Event      Event         `json:"event"`
+	ProfileTag string        `json:"profile_tag,omitempty"`
+	Read       bool          `json:"read"`
+	RoomID     string        `json:"room_id"`
+	TS         int64         `json:"ts"` // When the notification was sent, in milliseconds since the epoch
+}
+
+// RespAggregatedRelations is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidrelationseventidreltypeeventtype
+type RespAggregatedRelations struct {
+	Chunk     []Event `json:"chunk"` // The child events relating to the parent event
+	NextBatch string  `json:"next_batch,omitempty"`
+	PrevBatch string  `json:"prev_batch,omitempty"`
+}
+
+// RespAnnotations is returned by Client.GetAnnotationAggregations.
+type RespAnnotations struct {
+	Chunk []AnnotationGroup // Sorted by descending count
+}
+
+// AnnotationGroup is the number of annotations, e.g. reactions, with the same key, e.g. the same emoji.
+type AnnotationGroup struct {
+	Key   string
+	Count int
+}
+
+// RespAliasLookup is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-directory-room-roomalias
+type RespAliasLookup struct {
+	RoomID  string   `json:"room_id"`
+	Servers []string `json:"servers"`
+}
+
+// RespMembers is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-rooms-roomid-members
+type RespMembers struct {
+	Chunk []*Event `json:"chunk"`
+}
+
+// RespPublicRooms is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-publicrooms
+type RespPublicRooms struct {
+	Chunk                  []PublicRoom `json:"chunk"`
+	NextBatch              string       `json:"next_batch,omitempty"` // Empty on the last page
+	PrevBatch              string       `json:"prev_batch,omitempty"`
+	TotalRoomCountEstimate int          `json:"total_room_count_estimate,omitempty"`
+}
+
+// PublicRoom is a room in the room directory.
+type PublicRoom struct {
+	RoomID           string   `json:"room_id"`
+	Aliases          []string `json:"aliases,omitempty"`
+	CanonicalAlias   string   `json:"canonical_alias,omitempty"`
+	Name             string   `json:"name,omitempty"`
+	Topic            string   `json:"topic,omitempty"`
+	AvatarURL        string   `json:"avatar_url,omitempty"`
+	NumJoinedMembers int      `json:"num_joined_members"`
+	WorldReadable    bool     `json:"world_readable"`
+	GuestCanJoin     bool     `json:"guest_can_join"`
+}
+
+// RespRoomAliases is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-rooms-roomid-aliases
+type RespRoomAliases struct {
+	Aliases []string `json:"aliases"`
+}
+
+// RespSendToDevice is the JSON response for https://matrix.org/docs/spec/client_server/r0.3.0.html#put-matrix-client-r0-sendtodevice-eventtype-txnid
+type RespSendToDevice struct{}
+
+// RespServerKey is the JSON response for https://matrix.org/docs/spec/server_server/r0.1.0.html#get-matrix-key-v2-server-keyid
+type RespServerKey struct {
+	ServerName string `json:"server_name"`
+	VerifyKeys map[string]struct {
+		Key string `json:"key"`
+	} `json:"verify_keys"`
+	OldVerifyKeys map[string]struct {
+		Key       string `json:"key"`
+		ExpiredTS int64  `json:"expired_ts"`
+	} `json:"old_verify_keys"`
+	Signatures   map[string]map[string]string `json:"signatures"`
+	ValidUntilTS int64                        `json:"valid_until_ts"`
+}
+
+// RespNotaryKeys is the JSON response for https://matrix.org/docs/spec/server_server/r0.1.0.html#post-matrix-key-v2-query
+type RespNotaryKeys struct {
+	ServerKeys []RespServerKey `json:"server_keys"`
+}
+
+// BatchSendResult is the outcome of a single BatchSendRequest sent with Client.SendBatch.
+type BatchSendResult struct {
+	Response *RespSendEvent
+	Err      error
+}
+
+// RespHashDetails is the JSON response for https://matrix.org/docs/spec/identity_service/r0.3.0#get-matrix-identity-v2-hash-details
+type RespHashDetails struct {
+	LookupPepper string   `json:"lookup_pepper"`
+	Algorithms   []string `json:"algorithms"`
+}
+
+func (r RespHashDetails) supports(algorithm string) bool {
+	for _, a := range r.Algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// RespIdentityLookup is the JSON response for https://matrix.org/docs/spec/identity_service/r0.3.0#post-matrix-identity-v2-lookup
+type RespIdentityLookup struct {
+	Mappings map[string]string `json:"mappings"` // Hashed address to user ID
+}
+
+// RespTerms is the JSON response for https://matrix.org/docs/spec/identity_service/r0.3.0#get-matrix-identity-v2-terms
+type RespTerms struct {
+	Policies map[string]TermsPolicy `json:"policies"` // Policy ID, e.g. "privacy_policy", to policy
+}
+
+// TermsPolicy is a single policy in the terms of service, available in one or more languages.
+type TermsPolicy struct {
+	Version      string
+	Translations map[string]TermsTranslation // Language code, e.g. "en", to translation
+}
+
+// TermsTranslation is a policy in a single language.
+type TermsTranslation struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// UnmarshalJSON decodes a policy, whose translations are keyed by language alongside its "version" key.
+func (p *TermsPolicy) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	p.Translations = make(map[string]TermsTranslation)
+	for key, value := range raw {
+		if key == "version" {
+			if err := json.Unmarshal(value, &p.Version); err != nil {
+				return err
+			}
+			continue
+		}
+		var t TermsTranslation
+		if err := json.Unmarshal(value, &t); err != nil {
+			return err
+		}
+		p.Translations[key] = t
+	}
+	return nil
+}
+
+// url returns the URL to accept the policy with, or "" if one of its translations is already in accepted. The
+// English translation is preferred.
+func (p TermsPolicy) url(accepted []string) string {
+	for _, t := range p.Translations {
+		for _, u := range accepted {
+			if t.URL == u {
+				return ""
+			}
+		}
+	}
+	if t, ok := p.Translations["en"]; ok {
+		return t.URL
+	}
+	langs := make([]string, 0, len(p.Translations))
+	for lang := range p.Translations {
+		langs = append(langs, lang)
+	}
+	if len(langs) == 0 {
+		return ""
+	}
+	sort.Strings(langs)
+	return p.Translations[langs[0]].URL
+}
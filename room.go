@@ -1,14 +1,22 @@
 package gomatrix
 
+import "errors"
+
 // Room represents a single Matrix room.
 type Room struct {
 	ID    string
 	State map[string]map[string]*Event
+	// RecentEvents holds the most recent timeline events in the room, oldest first. See AddRecentEvent.
+	RecentEvents []*Event
 }
 
 // UpdateState updates the room's current state with the given Event. This will clobber events based
-// on the type/state_key combination.
+// on the type/state_key combination. Events without a state_key (e.g. if it was removed by a filter's
+// event_fields) are ignored.
 func (room Room) UpdateState(event *Event) {
+	if event.StateKey == nil {
+		return
+	}
 	_, exists := room.State[event.Type]
 	if !exists {
 		room.State[event.Type] = make(map[string]*Event)
@@ -40,6 +48,115 @@ func (room Room) GetMembershipState(userID string) string {
 	return state
 }
 
+// GetMember returns the content of the given user's m.room.member state event, and false if the room's state has
+// no member event for them. Keys with the wrong type in the event content are left as the zero value.
+func (room Room) GetMember(userID string) (*MemberEvent, bool) {
+	event := room.GetStateEvent("m.room.member", userID)
+	if event == nil {
+		return nil, false
+	}
+	return decodeMemberEvent(event), true
+}
+
+// Tombstone returns the room's m.room.tombstone state, or nil if the room has not been upgraded. An error is
+// returned if the tombstone has no replacement room.
+func (room Room) Tombstone() (*Tombstone, error) {
+	event := room.GetStateEvent("m.room.tombstone", "")
+	if event == nil {
+		return nil, nil
+	}
+	replacement, _ := event.Content["replacement_room"].(string)
+	if replacement == "" {
+		return nil, errors.New("tombstone has no replacement_room")
+	}
+	body, _ := event.Content["body"].(string)
+	return &Tombstone{Body: body, ReplacementRoom: replacement}, nil
+}
+
+// InviteInfo summarises an invite from the stripped state of an invited room, e.g. for an invite list.
+type InviteInfo struct {
+	RoomID     string
+	Inviter    string // The user ID of the user who sent the invite
+	RoomName   string // The room's m.room.name, if it is shared in the invite
+	RoomAvatar string // The mxc:// URI of the room's m.room.avatar, if it is shared in the invite
+	IsDirect   bool   // Whether the invite is for a direct chat
+}
+
+// InviteInfo returns a summary of the invite for the given user, or nil if the room's state has no invite for them.
+// For an invited room, the state is the stripped state from the invite.
+func (room Room) InviteInfo(userID string) *InviteInfo {
+	member := room.GetStateEvent("m.room.member", userID)
+	if member == nil || room.GetMembershipState(userID) != "invite" {
+		return nil
+	}
+	info := &InviteInfo{RoomID: room.ID, Inviter: member.Sender}
+	info.IsDirect, _ = member.Content["is_direct"].(bool)
+	if name := room.GetStateEvent("m.room.name", ""); name != nil {
+		info.RoomName, _ = name.Content["name"].(string)
+	}
+	if avatar := room.GetStateEvent("m.room.avatar", ""); avatar != nil {
+		info.RoomAvatar, _ = avatar.Content["url"].(string)
+	}
+	return info
+}
+
+// AddRecentEvent appends a timeline event to RecentEvents, dropping the oldest event if there are already
+// maxEvents recent events. RecentEvents is a plain slice kept in order rather than a ring buffer, so that it can be
+// read directly: once it is full, each call shifts the other events along, which costs O(maxEvents).
+func (room *Room) AddRecentEvent(event *Event, maxEvents int) {
+	if maxEvents <= 0 {
+		return
+	}
+	if len(room.RecentEvents) < maxEvents {
+		room.RecentEvents = append(room.RecentEvents, event)
+		return
+	}
+	// Shift along rather than re-slicing so the backing array never grows beyond maxEvents.
+	n := copy(room.RecentEvents, room.RecentEvents[len(room.RecentEvents)-maxEvents+1:])
+	room.RecentEvents = room.RecentEvents[:n+1]
+	room.RecentEvents[n] = event
+}
+
+// LatestEventID returns the ID of the most recent timeline event in the room, or "" if there are no recent events.
+func (room *Room) LatestEventID() string {
+	if len(room.RecentEvents) == 0 {
+		return ""
+	}
+	return room.RecentEvents[len(room.RecentEvents)-1].ID
+}
+
+// ApplyRedaction applies an m.room.redaction event to the room's state and recent events. The content of the
+// redacted event is stripped with StripRedactedContent, except for redacted reactions which are removed from
+// RecentEvents entirely. Returns false if the redacted event is not known to the room.
+func (room *Room) ApplyRedaction(redaction *Event) bool {
+	redactedID := redaction.RedactedEventID()
+	if redactedID == "" {
+		return false
+	}
+	found := false
+	for i, event := range room.RecentEvents {
+		if event.ID != redactedID {
+			continue
+		}
+		found = true
+		if event.Type == "m.reaction" {
+			room.RecentEvents = append(room.RecentEvents[:i], room.RecentEvents[i+1:]...)
+		} else {
+			event.StripRedactedContent()
+		}
+		break
+	}
+	for _, stateKeyMap := range room.State {
+		for _, event := range stateKeyMap {
+			if event.ID == redactedID {
+				event.StripRedactedContent()
+				found = true
+			}
+		}
+	}
+	return found
+}
+
 // NewRoom creates a new Room with the given ID
 func NewRoom(roomID string) *Room {
 	// Init the State map and return a pointer to the Room
@@ -0,0 +1,84 @@
+package gomatrix
+
+import "testing"
+
+func TestRoom_AddRecentEvent(t *testing.T) {
+	room := NewRoom("!foo:bar")
+	if id := room.LatestEventID(); id != "" {
+		t.Fatalf("LatestEventID: got %s for an empty room, want \"\"", id)
+	}
+	for _, id := range []string{"$1", "$2", "$3", "$4"} {
+		room.AddRecentEvent(&Event{ID: id}, 3)
+	}
+	if len(room.RecentEvents) != 3 || room.RecentEvents[0].ID != "$2" || room.RecentEvents[2].ID != "$4" {
+		t.Fatalf("AddRecentEvent: got %d events starting with %s, want [$2 $3 $4]", len(room.RecentEvents), room.RecentEvents[0].ID)
+	}
+	if id := room.LatestEventID(); id != "$4" {
+		t.Fatalf("LatestEventID: got %s, want $4", id)
+	}
+}
+
+func TestRoom_ApplyRedaction(t *testing.T) {
+	room := NewRoom("!foo:bar")
+	stateKey := "@alice:bar"
+	member := &Event{Type: "m.room.member", StateKey: &stateKey, ID: "$member", Content: map[string]interface{}{
+		"membership": "join", "displayname": "Alice",
+	}}
+	room.UpdateState(member)
+	room.AddRecentEvent(&Event{Type: "m.room.message", ID: "$msg", Content: map[string]interface{}{"body": "hi"}}, 10)
+
+	if room.ApplyRedaction(&Event{Type: "m.room.redaction", Redacts: "$unknown"}) {
+		t.Fatalf("ApplyRedaction: returned true for an unknown event")
+	}
+	if !room.ApplyRedaction(&Event{Type: "m.room.redaction", Redacts: "$member"}) {
+		t.Fatalf("ApplyRedaction: returned false for a known state event")
+	}
+	if len(member.Content) != 1 || member.Content["membership"] != "join" {
+		t.Fatalf("ApplyRedaction: got member content %v, want only the membership", member.Content)
+	}
+	if room.GetMembershipState(stateKey) != "join" {
+		t.Fatalf("ApplyRedaction: membership was lost")
+	}
+	if body, ok := room.RecentEvents[0].Body(); !ok || body != "hi" {
+		t.Fatalf("ApplyRedaction: unrelated event was changed")
+	}
+}
+
+func TestRoom_Tombstone(t *testing.T) {
+	room := NewRoom("!old:bar")
+	if tombstone, err := room.Tombstone(); tombstone != nil || err != nil {
+		t.Fatalf("Tombstone: got %v, %v for a room which has not been upgraded, want nil", tombstone, err)
+	}
+	stateKey := ""
+	room.UpdateState(&Event{Type: "m.room.tombstone", StateKey: &stateKey, Content: map[string]interface{}{
+		"body": "This room has been replaced", "replacement_room": "!new:bar",
+	}})
+	tombstone, err := room.Tombstone()
+	if err != nil || tombstone.ReplacementRoom != "!new:bar" || tombstone.Body != "This room has been replaced" {
+		t.Fatalf("Tombstone: got %+v, %v", tombstone, err)
+	}
+	room.UpdateState(&Event{Type: "m.room.tombstone", StateKey: &stateKey, Content: map[string]interface{}{}})
+	if _, err = room.Tombstone(); err == nil {
+		t.Fatalf("Tombstone: expected an error for a tombstone without a replacement room")
+	}
+}
+
+func TestRoom_GetMember(t *testing.T) {
+	room := NewRoom("!foo:bar")
+	if member, ok := room.GetMember("@alice:bar"); ok || member != nil {
+		t.Fatalf("GetMember: got %+v for a user with no member event, want nil", member)
+	}
+	stateKey := "@alice:bar"
+	room.UpdateState(&Event{Type: "m.room.member", StateKey: &stateKey, Content: map[string]interface{}{
+		"membership":  "invite",
+		"displayname": "Alice",
+		"avatar_url":  42.0, // wrong type, which should be ignored
+		"reason":      "come and chat",
+		"is_direct":   true,
+	}})
+	member, ok := room.GetMember("@alice:bar")
+	want := MemberEvent{UserID: "@alice:bar", Membership: "invite", DisplayName: "Alice", Reason: "come and chat", IsDirect: true}
+	if !ok || *member != want {
+		t.Fatalf("GetMember: got %+v, want %+v", member, want)
+	}
+}
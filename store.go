@@ -1,5 +1,10 @@
 package gomatrix
 
+import (
+	"sort"
+	"sync"
+)
+
 // Storer is an interface which must be satisfied to store client data.
 //
 // You can either write a struct which persists this data to disk, or you can use the
@@ -14,47 +19,87 @@ type Storer interface {
 	LoadRoom(roomID string) *Room
 }
 
-// InMemoryStore implements the Storer interface.
+// RoomRanger is a Storer which can list the rooms it holds. DefaultSyncer.RoomIDs and DefaultSyncer.RangeRooms
+// require the Store to implement it.
+type RoomRanger interface {
+	// RangeRooms calls fn for each stored room until fn returns false.
+	RangeRooms(fn func(roomID string, room *Room) bool)
+}
+
+// InMemoryStore implements the Storer and RoomRanger interfaces.
 //
-// Everything is persisted in-memory as maps. It is not safe to load/save filter IDs
-// or next batch tokens on any goroutine other than the syncing goroutine: the one
-// which called Client.Sync().
+// Everything is persisted in-memory as maps. The methods are safe to call from any goroutine, but the maps must
+// not be accessed directly while Client.Sync() is running.
 type InMemoryStore struct {
 	Filters   map[string]string
 	NextBatch map[string]string
-	Rooms     map[string]*Room
+	// Rooms is not safe to access while syncing; use LoadRoom or RangeRooms, or DefaultSyncer.GetRoom,
+	// DefaultSyncer.RoomIDs and DefaultSyncer.RangeRooms instead. Direct access will be deprecated in the next
+	// major version.
+	Rooms map[string]*Room
+
+	mutex sync.RWMutex // protects the maps
 }
 
 // SaveFilterID to memory.
 func (s *InMemoryStore) SaveFilterID(userID, filterID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.Filters[userID] = filterID
 }
 
 // LoadFilterID from memory.
 func (s *InMemoryStore) LoadFilterID(userID string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.Filters[userID]
 }
 
 // SaveNextBatch to memory.
 func (s *InMemoryStore) SaveNextBatch(userID, nextBatchToken string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.NextBatch[userID] = nextBatchToken
 }
 
 // LoadNextBatch from memory.
 func (s *InMemoryStore) LoadNextBatch(userID string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.NextBatch[userID]
 }
 
 // SaveRoom to memory.
 func (s *InMemoryStore) SaveRoom(room *Room) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.Rooms[room.ID] = room
 }
 
 // LoadRoom from memory.
 func (s *InMemoryStore) LoadRoom(roomID string) *Room {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.Rooms[roomID]
 }
 
+// RangeRooms calls fn for each room in memory, in room ID order, until fn returns false. It iterates over a snapshot,
+// so fn may call the store's other methods.
+func (s *InMemoryStore) RangeRooms(fn func(roomID string, room *Room) bool) {
+	s.mutex.RLock()
+	rooms := make([]*Room, 0, len(s.Rooms))
+	for _, room := range s.Rooms {
+		rooms = append(rooms, room)
+	}
+	s.mutex.RUnlock()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	for _, room := range rooms {
+		if !fn(room.ID, room) {
+			return
+		}
+	}
+}
+
 // NewInMemoryStore constructs a new InMemoryStore.
 func NewInMemoryStore() *InMemoryStore {
 	return &InMemoryStore{
@@ -1,113 +1,511 @@
 package gomatrix
 
 import (
+	"container/list"
+	"context"
 	"encoding/json"
 	"fmt"
+	"runtime"
 	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Syncer represents an interface that must be satisfied in order to do /sync requests on a client.
 type Syncer interface {
-	// Process the /sync response. The since parameter is the since= value that was used to produce the response.
+	// Process the /sync response. The batch's Since is the since= value that was used to produce the response.
 	// This is useful for detecting the very first sync (since=""). If an error is return, Syncing will be stopped
 	// permanently.
+	ProcessResponse(batch *SyncBatch) error
+	// OnFailedSync returns either the time to wait before retrying or an error to stop syncing permanently. ctx is
+	// done when the sync is stopped with StopSync or replaced by another call to Sync.
+	OnFailedSync(ctx context.Context, res *RespSync, err error) (time.Duration, error)
+	// GetFilterJSON for the given user ID. NOT the filter ID.
+	GetFilterJSON(userID string) json.RawMessage
+}
+
+// LegacySyncer is a Syncer written before ProcessResponse took a SyncBatch and OnFailedSync took a context. See
+// WrapLegacySyncer.
+type LegacySyncer interface {
 	ProcessResponse(resp *RespSync, since string) error
-	// OnFailedSync returns either the time to wait before retrying or an error to stop syncing permanently.
 	OnFailedSync(res *RespSync, err error) (time.Duration, error)
-	// GetFilterJSON for the given user ID. NOT the filter ID.
 	GetFilterJSON(userID string) json.RawMessage
 }
 
+// WrapLegacySyncer adapts a LegacySyncer to the Syncer interface by passing the response and since token of each
+// SyncBatch to its ProcessResponse, and ignoring the context passed to OnFailedSync.
+//
+// Deprecated: Change the syncer's ProcessResponse to take a *SyncBatch and add a context.Context parameter to its
+// OnFailedSync instead. This will be removed in a future release.
+func WrapLegacySyncer(syncer LegacySyncer) Syncer {
+	return legacySyncer{syncer}
+}
+
+type legacySyncer struct {
+	LegacySyncer
+}
+
+func (s legacySyncer) ProcessResponse(batch *SyncBatch) error {
+	return s.LegacySyncer.ProcessResponse(batch.Response, batch.Since)
+}
+
+func (s legacySyncer) OnFailedSync(ctx context.Context, res *RespSync, err error) (time.Duration, error) {
+	return s.LegacySyncer.OnFailedSync(res, err)
+}
+
+// InviteRejecter is a Syncer which is told when Client.RejectInvite rejects an invite.
+type InviteRejecter interface {
+	InviteRejected(roomID string)
+}
+
+// SyncBatch is a /sync response along with the since token used to request it. It decouples fetching /sync
+// responses from processing them, e.g. so that one process can write batches to a persistent queue while
+// another reads them and passes them to Syncer.ProcessResponse.
+type SyncBatch struct {
+	Response   *RespSync
+	Since      string    // The since= value that was used to produce the response. "" for the very first sync.
+	ReceivedAt time.Time // When the response was received from the homeserver
+}
+
 // DefaultSyncer is the default syncing implementation. You can either write your own syncer, or selectively
 // replace parts of this default syncer (e.g. the ProcessResponse method). The default syncer uses the observer
 // pattern to notify callers about incoming events. See DefaultSyncer.OnEventType for more information.
 type DefaultSyncer struct {
-	UserID    string
-	Store     Storer
-	listeners map[string][]OnEventListener // event type to listeners array
+	// DroppedEvents counts the events dropped because an event queue was full. See EventQueueSize. It must be
+	// read with atomic.LoadUint64, and is the first field to keep it 64-bit aligned on 32-bit platforms.
+	DroppedEvents uint64
+
+	UserID string
+	Store  Storer
+	// SkipInitialSync restores the legacy behaviour of discarding the very first sync (since="") entirely. By
+	// default, the first sync is used to populate room state without notifying any listeners.
+	SkipInitialSync bool
+	// Filter is uploaded as the /sync filter if set, e.g. to only sync a handful of rooms with Filter.Room.Rooms.
+	// It must be set before the first call to Client.Sync, as the resulting filter ID is stored and reused.
+	Filter *Filter
+	// OnLimitedTimeline is called for each joined room whose timeline was limited, meaning the server skipped
+	// events since the last sync. It should return the skipped events in chronological order, e.g. by calling
+	// Client.Backfill, and listeners are notified of them before the rest of the timeline. since is the token of
+	// the last sync, which bounds the skipped events so that events from before it are not returned again. It is
+	// not called for the initial sync.
+	OnLimitedTimeline func(roomID, prevBatch, since string) []Event
+	// ConcurrentRoomProcessing processes the events of each room in a separate goroutine, so that a slow listener
+	// in one room does not hold up other rooms. Events within a room are still processed in order. When this is
+	// set, listeners (including OnLimitedTimeline) may be called concurrently and must be safe for concurrent use.
+	ConcurrentRoomProcessing bool
+	// RoomParallelism is the maximum number of rooms processed at once when ConcurrentRoomProcessing is set.
+	// Defaults to the number of CPUs.
+	RoomParallelism int
+	// DecryptEvent, if set, is called for every encrypted event before listeners are notified of it. On success,
+	// listeners are notified of the returned event instead. On failure, they are notified of the original event with
+	// its DecryptionError set. If it returns neither an event nor an error, they are notified of the original event.
+	// It must be safe for concurrent use if ConcurrentRoomProcessing is set.
+	DecryptEvent func(*Event) (*Event, error)
+	// RecentEventsSize is the number of timeline events kept in each Room's RecentEvents. Defaults to 100 if zero.
+	// If negative, recent events are not kept.
+	RecentEventsSize int
+	// EventQueueSize, if positive, decouples listeners from ProcessResponse. Each event type gets a queue of this
+	// size which is drained by its own goroutine calling the listeners, so ProcessResponse never waits for slow
+	// listeners. When a queue is full, its oldest event is dropped and DroppedEvents is incremented. Panics in
+	// queued listeners are recovered and the event is skipped. It must be set before the first ProcessResponse.
+	EventQueueSize int
+	// DedupeSize is the number of recently seen event IDs remembered so that listeners are not notified of the same
+	// event twice, e.g. when it appears in both the state and the timeline or is sent again after a gappy sync.
+	// Defaults to 1000 if zero. If negative, events are not deduplicated. It must be set before the first
+	// ProcessResponse.
+	DedupeSize int
+	// IgnoreOwnEvents skips notifying listeners of events sent by UserID, e.g. so a bot does not respond to its own
+	// messages. Room state is still updated with them.
+	IgnoreOwnEvents bool
+	// PreEvent, if set, is called for each event before listeners are notified of it. If it returns false, listeners
+	// (including WaitForEvent and PostEvent) are not notified of the event. Room state is still updated with it.
+	PreEvent func(event *Event) bool
+	// PostEvent, if set, is called for each event after all of its listeners have been called, with the first error
+	// returned by an OnEventListenerErr listener or nil. With EventQueueSize set, it is called from the queue's
+	// goroutine.
+	PostEvent func(event *Event, listenerErr error)
+	// OnInviteInfo, if set, is called with a summary of each invite in the rooms.invite section of a /sync response,
+	// after its stripped state has been applied to the Room. It is not called for the initial sync; use RangeRooms
+	// and Room.InviteInfo to list the invites which were pending at startup.
+	OnInviteInfo func(info *InviteInfo)
+	// OnProcessPanic, if set, is called when a listener panics during ProcessResponse, with the recovered value and
+	// the stack trace. If it returns nil, the rest of the batch is skipped (with ConcurrentRoomProcessing, the rest of
+	// the room) and syncing continues from the next batch. Otherwise its error is returned by ProcessResponse, which
+	// stops Sync. By default, panics stop Sync. Calls are never concurrent.
+	OnProcessPanic func(recovered interface{}, stack []byte) error
+
+	listenersMutex sync.RWMutex                    // protects listeners
+	listeners      map[string][]OnEventListenerErr // event type to listeners array
+	queuesMutex    sync.Mutex                      // protects queues
+	queues         map[string]chan *Event          // event type to queue, if EventQueueSize is positive
+	seenEventsOnce sync.Once
+	seenEvents     *eventIDCache   // recently seen event IDs, if DedupeSize is not negative
+	rejectedMutex  sync.Mutex      // protects rejected
+	rejected       map[string]bool // IDs of rooms whose invite was rejected, until the leave is synced
+	backoff        func() backoff  // the backoff for failed /syncs, or nil for the default parameters
+	failedSyncs    int32           // the number of /syncs which have failed since the last response, used atomically
+	waitersMutex   sync.Mutex      // protects waiters
+	waiters        map[*eventWaiter]struct{}
+}
+
+// eventWaiter is a pending WaitForEvent call.
+type eventWaiter struct {
+	roomID string
+	match  func(*Event) bool
+	found  chan *Event // buffered, so that the first match never blocks
 }
 
 // OnEventListener can be used with DefaultSyncer.OnEventType to be informed of incoming events.
 type OnEventListener func(*Event)
 
+// OnEventListenerErr can be used with DefaultSyncer.OnEventTypeErr to be informed of incoming events. Errors are
+// passed to DefaultSyncer.PostEvent.
+type OnEventListenerErr func(*Event) error
+
 // NewDefaultSyncer returns an instantiated DefaultSyncer
 func NewDefaultSyncer(userID string, store Storer) *DefaultSyncer {
 	return &DefaultSyncer{
 		UserID:    userID,
 		Store:     store,
-		listeners: make(map[string][]OnEventListener),
+		listeners: make(map[string][]OnEventListenerErr),
 	}
 }
 
 // ProcessResponse processes the /sync response in a way suitable for bots. "Suitable for bots" means a stream of
-// unrepeating events. Returns a fatal error if a listener panics.
-func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error) {
+// unrepeating events: see DedupeSize. Returns a fatal error if a listener panics, unless OnProcessPanic chooses to
+// continue.
+//
+// The very first sync (since="") only updates room state: listeners are not notified of the historical events
+// it contains. Set SkipInitialSync to ignore the first sync entirely.
+func (s *DefaultSyncer) ProcessResponse(batch *SyncBatch) (err error) {
+	res, since := batch.Response, batch.Since
+	atomic.StoreInt32(&s.failedSyncs, 0)
 	if !s.shouldProcessResponse(res, since) {
 		return
 	}
+	notify := s.notifyListeners
+	if since == "" {
+		// Remember the initial events, so listeners are not notified of them if they are sent again.
+		notify = func(event *Event) { s.isDuplicate(event) }
+	} else if s.DecryptEvent != nil {
+		notify = func(event *Event) {
+			s.notifyListeners(s.decryptEvent(event))
+		}
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
-			err = fmt.Errorf("ProcessResponse panicked! userID=%s since=%s panic=%s\n%s", s.UserID, since, r, debug.Stack())
+			err = s.panicError(since, r)
 		}
 	}()
 
-	for roomID, roomData := range res.Rooms.Join {
-		room := s.getOrCreateRoom(roomID)
-		for _, event := range roomData.State.Events {
-			event.RoomID = roomID
-			room.UpdateState(&event)
-			s.notifyListeners(&event)
-		}
-		for _, event := range roomData.Timeline.Events {
-			event.RoomID = roomID
-			s.notifyListeners(&event)
+	// Rooms are loaded up front, as the Store may only be used by this goroutine.
+	rooms := make(map[string]*syncRoom)
+	getRoom := func(roomID string) *syncRoom {
+		if rooms[roomID] == nil {
+			rooms[roomID] = &syncRoom{room: s.getOrCreateRoom(roomID)}
 		}
+		return rooms[roomID]
+	}
+	for roomID, roomData := range res.Rooms.Join {
+		roomData := roomData
+		getRoom(roomID).join = &roomData
 	}
+	rejected := s.rejectedInvites(res)
 	for roomID, roomData := range res.Rooms.Invite {
-		room := s.getOrCreateRoom(roomID)
-		for _, event := range roomData.State.Events {
-			event.RoomID = roomID
-			room.UpdateState(&event)
-			s.notifyListeners(&event)
+		if rejected[roomID] {
+			continue
 		}
+		roomData := roomData
+		getRoom(roomID).invite = &roomData
 	}
 	for roomID, roomData := range res.Rooms.Leave {
-		room := s.getOrCreateRoom(roomID)
-		for _, event := range roomData.Timeline.Events {
+		roomData := roomData
+		getRoom(roomID).leave = &roomData
+	}
+
+	// To-device events are processed first, as they may carry the keys to decrypt the room events.
+	s.processGlobalEvents(res, notify)
+
+	if !s.ConcurrentRoomProcessing {
+		for _, sr := range rooms {
+			s.processRoom(sr, since, notify)
+		}
+		return
+	}
+	return s.processRoomsConcurrently(rooms, since, notify)
+}
+
+// processGlobalEvents notifies listeners of the events in the to_device and global account_data sections, which
+// belong to no room.
+func (s *DefaultSyncer) processGlobalEvents(res *RespSync, notify func(*Event)) {
+	for _, event := range res.ToDevice.Events {
+		event.Origin = ToDeviceEvent
+		notify(&event)
+	}
+	for _, event := range res.AccountData.Events {
+		event.Origin = AccountDataEvent
+		notify(&event)
+	}
+}
+
+// syncRoom holds the sections of a /sync response which apply to a single room.
+type syncRoom struct {
+	room   *Room
+	join   *SyncJoinedRoom
+	invite *SyncInvitedRoom
+	leave  *SyncLeftRoom
+}
+
+func (s *DefaultSyncer) processRoom(sr *syncRoom, since string, notify func(*Event)) {
+	if sr.join != nil {
+		s.processJoinedRoom(sr.room, sr.join, since, notify)
+	}
+	if sr.invite != nil {
+		s.processInvitedRoom(sr.room, sr.invite, since, notify)
+	}
+	if sr.leave != nil {
+		for _, event := range sr.leave.Timeline.Events {
 			if event.StateKey != nil {
-				event.RoomID = roomID
-				room.UpdateState(&event)
-				s.notifyListeners(&event)
+				event.RoomID = sr.room.ID
+				event.Origin = TimelineEvent
+				sr.room.UpdateState(&event)
+				notify(&event)
 			}
 		}
 	}
+}
+
+func (s *DefaultSyncer) processJoinedRoom(room *Room, join *SyncJoinedRoom, since string, notify func(*Event)) {
+	for _, event := range join.State.Events {
+		event.RoomID = room.ID
+		event.Origin = StateEvent
+		room.UpdateState(&event)
+		notify(&event)
+	}
+	if join.Timeline.Limited && s.OnLimitedTimeline != nil && since != "" {
+		for _, event := range s.OnLimitedTimeline(room.ID, join.Timeline.PrevBatch, since) {
+			s.processTimelineEvent(room, event, notify)
+		}
+	}
+	// State events in the timeline are applied in order after the state section, which is the state at the
+	// start of the timeline.
+	for _, event := range join.Timeline.Events {
+		s.processTimelineEvent(room, event, notify)
+	}
+	for _, event := range join.Ephemeral.Events {
+		event.RoomID = room.ID
+		event.Origin = EphemeralEvent
+		notify(&event)
+	}
+	for _, event := range join.AccountData.Events {
+		event.RoomID = room.ID
+		event.Origin = AccountDataEvent
+		notify(&event)
+	}
+}
+
+// processTimelineEvent applies a timeline event of a joined room to the room's state and recent events.
+func (s *DefaultSyncer) processTimelineEvent(room *Room, event Event, notify func(*Event)) {
+	event.RoomID = room.ID
+	event.Origin = TimelineEvent
+	room.UpdateState(&event)
+	room.ApplyRedaction(&event)
+	s.addRecentEvent(room, event)
+	notify(&event)
+}
+
+func (s *DefaultSyncer) processInvitedRoom(room *Room, invite *SyncInvitedRoom, since string, notify func(*Event)) {
+	for _, event := range invite.State.Events {
+		event.RoomID = room.ID
+		event.Origin = InviteEvent
+		room.UpdateState(&event)
+		notify(&event)
+	}
+	if s.OnInviteInfo != nil && since != "" {
+		if info := room.InviteInfo(s.UserID); info != nil {
+			s.OnInviteInfo(info)
+		}
+	}
+}
+
+// decryptEvent returns the decrypted event if the event is encrypted and DecryptEvent succeeds. Otherwise it
+// returns the event, with DecryptionError set if decryption failed.
+func (s *DefaultSyncer) decryptEvent(event *Event) *Event {
+	if !event.IsEncrypted() {
+		return event
+	}
+	decrypted, err := s.DecryptEvent(event)
+	if err != nil {
+		event.DecryptionError = err
+		return event
+	}
+	if decrypted == nil {
+		return event
+	}
+	if decrypted.RoomID == "" {
+		decrypted.RoomID = event.RoomID
+	}
+	return decrypted
+}
+
+// addRecentEvent adds a copy of the event to the room's RecentEvents.
+func (s *DefaultSyncer) addRecentEvent(room *Room, event Event) {
+	size := s.RecentEventsSize
+	if size == 0 {
+		size = 100
+	}
+	room.AddRecentEvent(&event, size)
+}
+
+// processRoomsConcurrently processes each room in its own goroutine, running at most RoomParallelism at once.
+// Returns an error for the first listener which panics.
+func (s *DefaultSyncer) processRoomsConcurrently(rooms map[string]*syncRoom, since string, notify func(*Event)) (err error) {
+	parallelism := s.RoomParallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	for _, sr := range rooms {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(sr *syncRoom) {
+			defer func() {
+				if r := recover(); r != nil {
+					errMutex.Lock()
+					if err == nil {
+						err = s.panicError(since, r)
+					}
+					errMutex.Unlock()
+				}
+				<-sem
+				wg.Done()
+			}()
+			s.processRoom(sr, since, notify)
+		}(sr)
+	}
+	wg.Wait()
 	return
 }
 
+// panicError returns the error for a panic recovered while processing a response, which is nil if OnProcessPanic
+// chooses to continue syncing.
+func (s *DefaultSyncer) panicError(since string, r interface{}) error {
+	stack := debug.Stack()
+	if s.OnProcessPanic != nil {
+		return s.OnProcessPanic(r, stack)
+	}
+	return fmt.Errorf("ProcessResponse panicked! userID=%s since=%s panic=%s\n%s", s.UserID, since, r, stack)
+}
+
 // OnEventType allows callers to be notified when there are new events for the given event type.
 // There are no duplicate checks.
 func (s *DefaultSyncer) OnEventType(eventType string, callback OnEventListener) {
-	_, exists := s.listeners[eventType]
-	if !exists {
-		s.listeners[eventType] = []OnEventListener{}
+	s.OnEventTypeErr(eventType, func(event *Event) error {
+		callback(event)
+		return nil
+	})
+}
+
+// OnEventTypeErr is like OnEventType, for listeners which return an error. The error does not stop other
+// listeners being called, and is passed to PostEvent.
+func (s *DefaultSyncer) OnEventTypeErr(eventType string, callback OnEventListenerErr) {
+	s.listenersMutex.Lock()
+	defer s.listenersMutex.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[string][]OnEventListenerErr)
 	}
 	s.listeners[eventType] = append(s.listeners[eventType], callback)
 }
 
+// listenersFor returns the listeners for the given event type. The returned slice must not be modified.
+func (s *DefaultSyncer) listenersFor(eventType string) ([]OnEventListenerErr, bool) {
+	s.listenersMutex.RLock()
+	defer s.listenersMutex.RUnlock()
+	listeners, exists := s.listeners[eventType]
+	return listeners, exists
+}
+
+// OnMembership allows callers to be notified of m.room.member events with the given membership, e.g. "join" or
+// "ban". The callback is given the ID of the room and of the user whose membership changed.
+func (s *DefaultSyncer) OnMembership(membership string, callback func(roomID, userID string, event *Event)) {
+	s.OnEventType("m.room.member", func(event *Event) {
+		if event.StateKey == nil {
+			return
+		}
+		if m, _ := event.Content["membership"].(string); m == membership {
+			callback(event.RoomID, *event.StateKey, event)
+		}
+	})
+}
+
+// OnMembershipEvent allows callers to be notified of every m.room.member event, with the membership before and
+// after it.
+func (s *DefaultSyncer) OnMembershipEvent(callback func(*MembershipEvent)) {
+	s.OnEventType("m.room.member", func(event *Event) {
+		if member := NewMembershipEvent(event); member != nil {
+			callback(member)
+		}
+	})
+}
+
+// OnInvite allows callers to be notified when UserID is invited to a room, e.g. to accept invites automatically
+// with JoinRoom. The callback is given the ID of the room and of the user who sent the invite.
+func (s *DefaultSyncer) OnInvite(callback func(roomID, inviterID string, event *Event)) {
+	s.OnMembership("invite", func(roomID, userID string, event *Event) {
+		if userID == s.UserID {
+			callback(roomID, event.Sender, event)
+		}
+	})
+}
+
+// OnRoomJoin allows callers to be notified when UserID joins a room. Changes to UserID's profile, which are sent as
+// a join to a room UserID has already joined, are ignored. Nothing is called if IgnoreOwnEvents is set and UserID
+// joined the room itself.
+func (s *DefaultSyncer) OnRoomJoin(callback func(roomID string)) {
+	s.OnMembership("join", func(roomID, userID string, event *Event) {
+		if userID == s.UserID && event.prevMembership() != "join" {
+			callback(roomID)
+		}
+	})
+}
+
+// OnRoomLeave allows callers to be notified when UserID leaves a joined room, including being kicked or banned. The
+// reason is the one given by whoever removed UserID, or "". Rejecting an invite is not a leave. Nothing is called if
+// IgnoreOwnEvents is set and UserID left the room itself.
+func (s *DefaultSyncer) OnRoomLeave(callback func(roomID string, reason string)) {
+	s.OnEventType("m.room.member", func(event *Event) {
+		if event.StateKey == nil || *event.StateKey != s.UserID {
+			return
+		}
+		membership, _ := event.Content["membership"].(string)
+		if membership != "leave" && membership != "ban" {
+			return
+		}
+		// Without unsigned.prev_content the previous membership is unknown, so the event is assumed to be a leave.
+		if prev := event.prevMembership(); prev == "join" || prev == "" {
+			reason, _ := event.Content["reason"].(string)
+			callback(event.RoomID, reason)
+		}
+	})
+}
+
 // shouldProcessResponse returns true if the response should be processed. May modify the response to remove
 // stuff that shouldn't be processed.
 func (s *DefaultSyncer) shouldProcessResponse(resp *RespSync, since string) bool {
 	if since == "" {
-		return false
+		return !s.SkipInitialSync
 	}
 	// This is a horrible hack because /sync will return the most recent messages for a room
 	// as soon as you /join it. We do NOT want to process those events in that particular room
 	// because they may have already been processed (if you toggle the bot in/out of the room).
 	//
 	// Work around this by inspecting each room's timeline and seeing if an m.room.member event for us
-	// exists and is "join" and then discard processing that room entirely if so.
+	// exists and is "join" and then discard processing that room if so, apart from the join itself.
 	// TODO: We probably want to process messages from after the last join event in the timeline.
 	for roomID, roomData := range resp.Rooms.Join {
 		for i := len(roomData.Timeline.Events) - 1; i >= 0; i-- {
@@ -123,7 +521,10 @@ func (s *DefaultSyncer) shouldProcessResponse(resp *RespSync, since string) bool
 					if !ok {
 						continue
 					}
-					delete(resp.Rooms.Join, roomID)   // don't re-process messages
+					// don't re-process messages, but keep the join for OnRoomJoin
+					joined := SyncJoinedRoom{}
+					joined.Timeline.Events = []Event{e}
+					resp.Rooms.Join[roomID] = joined
 					delete(resp.Rooms.Invite, roomID) // don't re-process invites
 					break
 				}
@@ -133,6 +534,64 @@ func (s *DefaultSyncer) shouldProcessResponse(resp *RespSync, since string) bool
 	return true
 }
 
+// InviteRejected implements InviteRejecter. Invites to the room are ignored until the room appears in the joined or
+// left rooms of a /sync response, so that a rejected invite is not surfaced again by a /sync response which was
+// already in flight.
+func (s *DefaultSyncer) InviteRejected(roomID string) {
+	s.rejectedMutex.Lock()
+	defer s.rejectedMutex.Unlock()
+	if s.rejected == nil {
+		s.rejected = make(map[string]bool)
+	}
+	s.rejected[roomID] = true
+}
+
+// rejectedInvites returns the IDs of the rooms whose invites in the response have been rejected. Once a response
+// shows the room as left or joined, the rejection has been synced and later invites are processed as usual.
+func (s *DefaultSyncer) rejectedInvites(res *RespSync) map[string]bool {
+	s.rejectedMutex.Lock()
+	defer s.rejectedMutex.Unlock()
+	for roomID := range s.rejected {
+		_, left := res.Rooms.Leave[roomID]
+		_, joined := res.Rooms.Join[roomID]
+		if left || joined {
+			delete(s.rejected, roomID)
+		}
+	}
+	rejected := make(map[string]bool, len(s.rejected))
+	for roomID := range s.rejected {
+		rejected[roomID] = true
+	}
+	return rejected
+}
+
+// GetRoom returns the room with the given ID from the Store, and false if the Store has no such room. The Room's
+// state is updated while syncing, so it should only be read from listeners unless Sync has been stopped.
+func (s *DefaultSyncer) GetRoom(roomID string) (*Room, bool) {
+	room := s.Store.LoadRoom(roomID)
+	return room, room != nil
+}
+
+// RoomIDs returns the IDs of the rooms in the Store, sorted. It returns nil if the Store does not implement
+// RoomRanger.
+func (s *DefaultSyncer) RoomIDs() []string {
+	var roomIDs []string
+	s.RangeRooms(func(roomID string, room *Room) bool {
+		roomIDs = append(roomIDs, roomID)
+		return true
+	})
+	sort.Strings(roomIDs)
+	return roomIDs
+}
+
+// RangeRooms calls fn for each room in the Store until fn returns false. It does nothing if the Store does not
+// implement RoomRanger.
+func (s *DefaultSyncer) RangeRooms(fn func(roomID string, room *Room) bool) {
+	if ranger, ok := s.Store.(RoomRanger); ok {
+		ranger.RangeRooms(fn)
+	}
+}
+
 // getOrCreateRoom must only be called by the Sync() goroutine which calls ProcessResponse()
 func (s *DefaultSyncer) getOrCreateRoom(roomID string) *Room {
 	room := s.Store.LoadRoom(roomID)
@@ -144,21 +603,224 @@ func (s *DefaultSyncer) getOrCreateRoom(roomID string) *Room {
 }
 
 func (s *DefaultSyncer) notifyListeners(event *Event) {
-	listeners, exists := s.listeners[event.Type]
-	if !exists {
+	if s.isDuplicate(event) || (s.IgnoreOwnEvents && event.Sender == s.UserID) {
 		return
 	}
+	if s.PreEvent != nil && !s.PreEvent(event) {
+		return
+	}
+	s.notifyWaiters(event)
+	listeners, exists := s.listenersFor(event.Type)
+	if exists && s.EventQueueSize > 0 {
+		s.enqueue(event)
+		return
+	}
+	var firstErr error
 	for _, fn := range listeners {
-		fn(event)
+		if err := fn(event); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if s.PostEvent != nil {
+		s.PostEvent(event, firstErr)
+	}
+}
+
+// WaitForEvent waits for an event in the given room for which match returns true, e.g. a reply to a command.
+// Only events processed after WaitForEvent is called are considered. If roomID is "", events in any room are
+// considered. It returns ctx.Err() if ctx is done first. Sync must be running for events to arrive.
+//
+// match is called from the goroutine processing the sync response, so it must not block.
+func (s *DefaultSyncer) WaitForEvent(ctx context.Context, roomID string, match func(*Event) bool) (*Event, error) {
+	waiter := &eventWaiter{roomID: roomID, match: match, found: make(chan *Event, 1)}
+	s.waitersMutex.Lock()
+	if s.waiters == nil {
+		s.waiters = make(map[*eventWaiter]struct{})
+	}
+	s.waiters[waiter] = struct{}{}
+	s.waitersMutex.Unlock()
+	defer func() {
+		s.waitersMutex.Lock()
+		delete(s.waiters, waiter)
+		s.waitersMutex.Unlock()
+	}()
+
+	select {
+	case event := <-waiter.found:
+		return event, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// notifyWaiters passes a copy of the event to each WaitForEvent call which it matches.
+func (s *DefaultSyncer) notifyWaiters(event *Event) {
+	s.waitersMutex.Lock()
+	waiters := make([]*eventWaiter, 0, len(s.waiters))
+	for waiter := range s.waiters {
+		if waiter.roomID == "" || waiter.roomID == event.RoomID {
+			waiters = append(waiters, waiter)
+		}
 	}
+	s.waitersMutex.Unlock()
+	for _, waiter := range waiters {
+		if waiter.match != nil && !waiter.match(event) {
+			continue
+		}
+		ev := *event
+		select {
+		case waiter.found <- &ev:
+		default: // an earlier event already matched
+		}
+	}
+}
+
+// isDuplicate records the event as seen, returning true if it had already been seen.
+func (s *DefaultSyncer) isDuplicate(event *Event) bool {
+	s.seenEventsOnce.Do(func() {
+		size := s.DedupeSize
+		if size == 0 {
+			size = 1000
+		}
+		if size > 0 {
+			s.seenEvents = newEventIDCache(size)
+		}
+	})
+	if s.seenEvents == nil || event.ID == "" {
+		return false
+	}
+	return s.seenEvents.add(event.ID)
 }
 
-// OnFailedSync always returns a 10 second wait period between failed /syncs, never a fatal error.
-func (s *DefaultSyncer) OnFailedSync(res *RespSync, err error) (time.Duration, error) {
-	return 10 * time.Second, nil
+// eventIDCache is a fixed-size set of event IDs which evicts the least recently seen ID when full. It is safe for
+// concurrent use.
+type eventIDCache struct {
+	mutex sync.Mutex
+	size  int
+	order *list.List               // event IDs, most recently seen first
+	ids   map[string]*list.Element // event ID to its element in order
+}
+
+func newEventIDCache(size int) *eventIDCache {
+	return &eventIDCache{
+		size:  size,
+		order: list.New(),
+		ids:   make(map[string]*list.Element),
+	}
 }
 
-// GetFilterJSON returns a filter with a timeline limit of 50.
+// add marks the event ID as the most recently seen, returning true if it was already in the cache.
+func (c *eventIDCache) add(eventID string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.ids[eventID]; ok {
+		c.order.MoveToFront(elem)
+		return true
+	}
+	c.ids[eventID] = c.order.PushFront(eventID)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.ids, oldest.Value.(string))
+	}
+	return false
+}
+
+// enqueue adds a copy of the event to the queue for its type without blocking, dropping the oldest queued event
+// if the queue is full.
+func (s *DefaultSyncer) enqueue(event *Event) {
+	// Hold the lock so that Close cannot close the queue while sending to it. The sends never block.
+	s.queuesMutex.Lock()
+	defer s.queuesMutex.Unlock()
+	queue := s.getOrCreateQueue(event.Type)
+	ev := *event
+	for {
+		select {
+		case queue <- &ev:
+			return
+		default:
+		}
+		select {
+		case <-queue:
+			atomic.AddUint64(&s.DroppedEvents, 1)
+		default:
+		}
+	}
+}
+
+// getOrCreateQueue must be called with queuesMutex held.
+func (s *DefaultSyncer) getOrCreateQueue(eventType string) chan *Event {
+	if s.queues == nil {
+		s.queues = make(map[string]chan *Event)
+	}
+	queue, exists := s.queues[eventType]
+	if !exists {
+		queue = make(chan *Event, s.EventQueueSize)
+		s.queues[eventType] = queue
+		go s.drainQueue(eventType, queue)
+	}
+	return queue
+}
+
+func (s *DefaultSyncer) drainQueue(eventType string, queue chan *Event) {
+	for event := range queue {
+		var firstErr error
+		listeners, _ := s.listenersFor(eventType)
+		for _, fn := range listeners {
+			if err := s.callQueuedListener(fn, event); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if s.PostEvent != nil {
+			s.PostEvent(event, firstErr)
+		}
+	}
+}
+
+// Close stops the goroutines draining the event queues once the events already queued have been delivered. It is
+// called by Client.StopSync, and should be called when a DefaultSyncer is replaced with another Syncer. If events
+// are processed again afterwards, new queues are created. It always returns nil.
+func (s *DefaultSyncer) Close() error {
+	s.queuesMutex.Lock()
+	defer s.queuesMutex.Unlock()
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.queues = nil
+	return nil
+}
+
+func (s *DefaultSyncer) callQueuedListener(fn OnEventListenerErr, event *Event) error {
+	defer func() {
+		recover() // there is no caller to report the panic to, so skip the event
+	}()
+	return fn(event)
+}
+
+// OnFailedSync backs off exponentially between consecutive failed /syncs, as configured by Client.RetryBaseDelay if
+// the syncer was created by NewClient, or with the defaults otherwise. If the server asked the client to wait longer,
+// e.g. with a 429 response, it waits that long instead. It only returns an error if ctx is done, i.e. the sync has
+// been stopped.
+func (s *DefaultSyncer) OnFailedSync(ctx context.Context, res *RespSync, err error) (time.Duration, error) {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return 0, ctxErr
+	}
+	b := backoff{base: defaultRetryBaseDelay, max: defaultRetryMaxDelay, jitter: defaultRetryJitter}
+	if s.backoff != nil {
+		b = s.backoff()
+	}
+	wait := b.duration(int(atomic.AddInt32(&s.failedSyncs, 1)) - 1)
+	if floor := retryAfter(err); wait < floor {
+		wait = floor
+	}
+	return wait, nil
+}
+
+// GetFilterJSON returns the syncer's Filter, or a filter with a timeline limit of 50 if there isn't one.
 func (s *DefaultSyncer) GetFilterJSON(userID string) json.RawMessage {
-	return json.RawMessage(`{"room":{"timeline":{"limit":50}}}`)
+	if s.Filter == nil {
+		return json.RawMessage(`{"room":{"timeline":{"limit":50}}}`)
+	}
+	filterJSON, _ := json.Marshal(s.Filter)
+	return filterJSON
 }
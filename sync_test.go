@@ -0,0 +1,818 @@
+package gomatrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func syncResponse(t *testing.T, body string) *RespSync {
+	var res RespSync
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatalf("failed to decode sync response: %s", err)
+	}
+	return &res
+}
+
+const initialSyncJSON = `{
+	"next_batch": "s1",
+	"rooms": {
+		"join": {
+			"!foo:bar": {
+				"state": {"events": [
+					{"type": "m.room.name", "state_key": "", "event_id": "$name", "content": {"name": "Foo"}}
+				]},
+				"timeline": {"events": [
+					{"type": "m.room.message", "event_id": "$msg", "content": {"body": "old"}}
+				]}
+			}
+		}
+	}
+}`
+
+func TestDefaultSyncer_ProcessResponseInitialSync(t *testing.T) {
+	store := NewInMemoryStore()
+	syncer := NewDefaultSyncer("@alice:bar", store)
+	notified := 0
+	syncer.OnEventType("m.room.name", func(*Event) { notified++ })
+	syncer.OnEventType("m.room.message", func(*Event) { notified++ })
+
+	if err := syncer.ProcessResponse(&SyncBatch{Response: syncResponse(t, initialSyncJSON)}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if notified != 0 {
+		t.Fatalf("ProcessResponse: notified %d listeners for the initial sync, want 0", notified)
+	}
+	room := store.LoadRoom("!foo:bar")
+	if room == nil || room.GetStateEvent("m.room.name", "") == nil {
+		t.Fatal("ProcessResponse: initial sync did not populate room state")
+	}
+}
+
+func TestDefaultSyncer_ProcessResponseSkipInitialSync(t *testing.T) {
+	store := NewInMemoryStore()
+	syncer := NewDefaultSyncer("@alice:bar", store)
+	syncer.SkipInitialSync = true
+
+	if err := syncer.ProcessResponse(&SyncBatch{Response: syncResponse(t, initialSyncJSON)}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if store.LoadRoom("!foo:bar") != nil {
+		t.Fatal("ProcessResponse: SkipInitialSync still populated room state")
+	}
+}
+
+func TestDefaultSyncer_GetFilterJSON(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	syncer.Filter = &Filter{}
+	syncer.Filter.Room.Rooms = []string{"!foo:bar"}
+
+	var filter map[string]interface{}
+	if err := json.Unmarshal(syncer.GetFilterJSON("@alice:bar"), &filter); err != nil {
+		t.Fatalf("GetFilterJSON: invalid JSON: %s", err)
+	}
+	rooms := filter["room"].(map[string]interface{})["rooms"].([]interface{})
+	if len(rooms) != 1 || rooms[0] != "!foo:bar" {
+		t.Fatalf("GetFilterJSON: got rooms %v, want [!foo:bar]", rooms)
+	}
+}
+
+func TestDefaultSyncer_ProcessSyncBatch(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	var got []string
+	syncer.OnEventType("m.room.message", func(ev *Event) { got = append(got, ev.ID) })
+
+	// Round trip the batch through JSON, as a persistent sync queue would.
+	data, err := json.Marshal(SyncBatch{
+		Response:   syncResponse(t, `{"next_batch":"s2","rooms":{"join":{"!foo:bar":{"timeline":{"events":[{"type":"m.room.message","event_id":"$msg"}]}}}}}`),
+		Since:      "s1",
+		ReceivedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch SyncBatch
+	if err = json.Unmarshal(data, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if err = syncer.ProcessResponse(&batch); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if len(got) != 1 || got[0] != "$msg" {
+		t.Fatalf("ProcessResponse: notified %v, want [$msg]", got)
+	}
+}
+
+func TestDefaultSyncer_DecryptEvent(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	syncer.DecryptEvent = func(event *Event) (*Event, error) {
+		switch event.Content["ciphertext"] {
+		case "good":
+			return &Event{Type: "m.room.message", ID: event.ID, Content: map[string]interface{}{"body": "hello"}}, nil
+		case "skip":
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unknown session")
+	}
+	var messages, encrypted []string
+	syncer.OnEventType("m.room.message", func(ev *Event) {
+		if ev.RoomID != "!foo:bar" {
+			t.Errorf("DecryptEvent: decrypted event has room ID %q, want !foo:bar", ev.RoomID)
+		}
+		messages = append(messages, ev.ID)
+	})
+	syncer.OnEventType("m.room.encrypted", func(ev *Event) {
+		if (ev.DecryptionError == nil) != (ev.ID == "$skip") {
+			t.Errorf("DecryptEvent: %s dispatched encrypted with DecryptionError %v", ev.ID, ev.DecryptionError)
+		}
+		encrypted = append(encrypted, ev.ID)
+	})
+
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{"!foo:bar":{"timeline":{"events":[
+		{"type":"m.room.encrypted","event_id":"$good","content":{"ciphertext":"good"}},
+		{"type":"m.room.encrypted","event_id":"$bad","content":{"ciphertext":"bad"}},
+		{"type":"m.room.encrypted","event_id":"$skip","content":{"ciphertext":"skip"}}
+	]}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if len(messages) != 1 || messages[0] != "$good" || len(encrypted) != 2 || encrypted[0] != "$bad" || encrypted[1] != "$skip" {
+		t.Fatalf("ProcessResponse: got decrypted %v and encrypted %v, want [$good] and [$bad $skip]", messages, encrypted)
+	}
+}
+
+func TestDefaultSyncer_ApplyRedactions(t *testing.T) {
+	store := NewInMemoryStore()
+	syncer := NewDefaultSyncer("@alice:bar", store)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: syncResponse(t, initialSyncJSON)}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{"!foo:bar":{"timeline":{"events":[
+		{"type":"m.reaction","event_id":"$react","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$msg","key":"x"}}},
+		{"type":"m.room.redaction","event_id":"$r1","redacts":"$msg","content":{}},
+		{"type":"m.room.redaction","event_id":"$r2","content":{"redacts":"$react"}},
+		{"type":"m.room.redaction","event_id":"$r3","redacts":"$name","content":{}}
+	]}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	room := store.LoadRoom("!foo:bar")
+	if msg := room.RecentEvents[0]; msg.ID != "$msg" || len(msg.Content) != 0 {
+		t.Fatalf("ProcessResponse: got %s with content %v, want $msg with its content stripped", msg.ID, msg.Content)
+	}
+	for _, event := range room.RecentEvents {
+		if event.ID == "$react" {
+			t.Fatalf("ProcessResponse: redacted reaction was not removed from RecentEvents")
+		}
+	}
+	if name := room.GetStateEvent("m.room.name", ""); len(name.Content) != 0 {
+		t.Fatalf("ProcessResponse: got m.room.name content %v, want it stripped", name.Content)
+	}
+}
+
+func TestDefaultSyncer_TimelineState(t *testing.T) {
+	store := NewInMemoryStore()
+	syncer := NewDefaultSyncer("@alice:bar", store)
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{"!foo:bar":{
+		"state":{"events":[{"type":"m.room.topic","state_key":"","event_id":"$t1","content":{"topic":"old"}}]},
+		"timeline":{"events":[
+			{"type":"m.room.topic","state_key":"","event_id":"$t2","content":{"topic":"middle"}},
+			{"type":"m.room.message","event_id":"$msg","content":{"body":"hi"}},
+			{"type":"m.room.topic","state_key":"","event_id":"$t3","content":{"topic":"new"}}
+		]}
+	}}}}`)
+	var topics []string
+	syncer.OnEventType("m.room.topic", func(ev *Event) {
+		// Listeners see the room state as of the event.
+		current := store.LoadRoom("!foo:bar").GetStateEvent("m.room.topic", "")
+		topics = append(topics, current.Content["topic"].(string))
+	})
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if strings.Join(topics, " ") != "old middle new" {
+		t.Fatalf("ProcessResponse: listeners saw topics %v, want [old middle new]", topics)
+	}
+	if topic := store.LoadRoom("!foo:bar").GetStateEvent("m.room.topic", ""); topic.ID != "$t3" {
+		t.Fatalf("ProcessResponse: got topic event %s, want the last one in the timeline", topic.ID)
+	}
+}
+
+func TestDefaultSyncer_RoomAccessors(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	res := syncResponse(t, `{"next_batch":"s1","rooms":{"join":{"!b:bar":{},"!a:bar":{},"!c:bar":{}}}}`)
+
+	// Read the rooms while they are being created.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			syncer.RoomIDs()
+			syncer.GetRoom("!a:bar")
+		}
+	}()
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	<-done
+
+	if room, ok := syncer.GetRoom("!a:bar"); !ok || room.ID != "!a:bar" {
+		t.Fatalf("GetRoom: got %v, %v, want !a:bar", room, ok)
+	}
+	if _, ok := syncer.GetRoom("!missing:bar"); ok {
+		t.Fatalf("GetRoom: found a room which does not exist")
+	}
+	if roomIDs := strings.Join(syncer.RoomIDs(), " "); roomIDs != "!a:bar !b:bar !c:bar" {
+		t.Fatalf("RoomIDs: got %s, want !a:bar !b:bar !c:bar", roomIDs)
+	}
+	var ranged []string
+	syncer.RangeRooms(func(roomID string, room *Room) bool {
+		ranged = append(ranged, roomID)
+		return len(ranged) < 2
+	})
+	if len(ranged) != 2 {
+		t.Fatalf("RangeRooms: visited %v, want it to stop after 2 rooms", ranged)
+	}
+}
+
+func TestDefaultSyncer_EventOrigin(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	origins := make(map[string]EventOrigin)
+	syncer.OnEventType("m.room.member", func(ev *Event) { origins[ev.ID] = ev.Origin })
+	for _, eventType := range []string{"m.typing", "m.room_key", "m.direct", "m.fully_read"} {
+		syncer.OnEventType(eventType, func(ev *Event) { origins[ev.Type+ev.RoomID] = ev.Origin })
+	}
+	res := syncResponse(t, `{"next_batch":"s2",
+		"to_device":{"events":[{"type":"m.room_key","sender":"@bob:bar","content":{}}]},
+		"account_data":{"events":[{"type":"m.direct","content":{}}]},
+		"rooms":{
+		"join":{"!foo:bar":{
+			"state":{"events":[{"type":"m.room.member","state_key":"@bob:bar","event_id":"$state","content":{"membership":"join"}}]},
+			"timeline":{"events":[{"type":"m.room.member","state_key":"@carol:bar","event_id":"$timeline","content":{"membership":"join"}}]},
+			"ephemeral":{"events":[{"type":"m.typing","content":{"user_ids":["@bob:bar"]}}]},
+			"account_data":{"events":[{"type":"m.fully_read","content":{"event_id":"$timeline"}}]}
+		}},
+		"invite":{"!baz:bar":{"invite_state":{"events":[{"type":"m.room.member","state_key":"@alice:bar","event_id":"$invite","content":{"membership":"invite"}}]}}}
+	}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	want := map[string]EventOrigin{
+		"$state":               StateEvent,
+		"$timeline":            TimelineEvent,
+		"$invite":              InviteEvent,
+		"m.typing!foo:bar":     EphemeralEvent,
+		"m.room_key":           ToDeviceEvent,
+		"m.direct":             AccountDataEvent,
+		"m.fully_read!foo:bar": AccountDataEvent,
+	}
+	for id, origin := range want {
+		if origins[id] != origin {
+			t.Errorf("ProcessResponse: got origin %s for %s, want %s", origins[id], id, origin)
+		}
+	}
+	if ev := (&Event{Origin: StateEvent}); !ev.IsStateEvent() || ev.IsTimelineEvent() {
+		t.Errorf("IsStateEvent: wrong classification for a state event")
+	}
+}
+
+func TestDefaultSyncer_OnInviteInfo(t *testing.T) {
+	store := NewInMemoryStore()
+	syncer := NewDefaultSyncer("@alice:bar", store)
+	var infos []*InviteInfo
+	syncer.OnInviteInfo = func(info *InviteInfo) { infos = append(infos, info) }
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"invite":{"!dm:bar":{"invite_state":{"events":[
+		{"type":"m.room.name","state_key":"","sender":"@bob:bar","content":{"name":"Chat"}},
+		{"type":"m.room.avatar","state_key":"","sender":"@bob:bar","content":{"url":"mxc://bar/avatar"}},
+		{"type":"m.room.member","state_key":"@alice:bar","sender":"@bob:bar","content":{"membership":"invite","is_direct":true}}
+	]}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	want := InviteInfo{RoomID: "!dm:bar", Inviter: "@bob:bar", RoomName: "Chat", RoomAvatar: "mxc://bar/avatar", IsDirect: true}
+	if len(infos) != 1 || *infos[0] != want {
+		t.Fatalf("OnInviteInfo: got %+v, want [%+v]", infos, want)
+	}
+	if info := store.LoadRoom("!dm:bar").InviteInfo("@carol:bar"); info != nil {
+		t.Fatalf("InviteInfo: got %+v for a user who was not invited, want nil", info)
+	}
+}
+
+func TestDefaultSyncer_OnInvite(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	var invites, bans []string
+	syncer.OnInvite(func(roomID, inviterID string, event *Event) {
+		invites = append(invites, roomID+" "+inviterID)
+	})
+	syncer.OnMembership("ban", func(roomID, userID string, event *Event) {
+		bans = append(bans, roomID+" "+userID)
+	})
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{
+		"invite":{"!new:bar":{"invite_state":{"events":[
+			{"type":"m.room.member","state_key":"@alice:bar","sender":"@bob:bar","content":{"membership":"invite"}}
+		]}}},
+		"join":{"!foo:bar":{"timeline":{"events":[
+			{"type":"m.room.member","state_key":"@carol:bar","sender":"@bob:bar","event_id":"$1","content":{"membership":"invite"}},
+			{"type":"m.room.member","state_key":"@dave:bar","sender":"@bob:bar","event_id":"$2","content":{"membership":"ban"}}
+		]}}}
+	}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if len(invites) != 1 || invites[0] != "!new:bar @bob:bar" {
+		t.Fatalf("OnInvite: got %v, want only the invite for @alice:bar", invites)
+	}
+	if len(bans) != 1 || bans[0] != "!foo:bar @dave:bar" {
+		t.Fatalf("OnMembership: got %v, want [!foo:bar @dave:bar]", bans)
+	}
+}
+
+func TestDefaultSyncer_InviteRejected(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	var invites []string
+	syncer.OnInviteInfo = func(info *InviteInfo) { invites = append(invites, info.RoomID) }
+	invite := `{"next_batch":"s2","rooms":{"invite":{"!foo:bar":{"invite_state":{"events":[
+		{"type":"m.room.member","state_key":"@alice:bar","sender":"@bob:bar","content":{"membership":"invite"}}
+	]}}}}}`
+	leave := `{"next_batch":"s3","rooms":{"leave":{"!foo:bar":{"timeline":{"events":[
+		{"type":"m.room.member","state_key":"@alice:bar","sender":"@alice:bar","event_id":"$leave","content":{"membership":"leave"}}
+	]}}}}}`
+
+	syncer.InviteRejected("!foo:bar")
+	for i, body := range []string{invite, leave, invite} {
+		if err := syncer.ProcessResponse(&SyncBatch{Response: syncResponse(t, body), Since: fmt.Sprintf("s%d", i+1)}); err != nil {
+			t.Fatalf("ProcessResponse: error, got %s", err)
+		}
+	}
+	// The first invite was rejected; the second is a new invite after the rejection was synced.
+	if len(invites) != 1 {
+		t.Fatalf("ProcessResponse: surfaced %d invites, want 1", len(invites))
+	}
+}
+
+func TestDefaultSyncer_OnLimitedTimeline(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/rooms/!foo:bar/messages" || req.URL.Query().Get("from") != "p2" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL)
+		}
+		// Without the to bound, the server would paginate back past the previous sync to $old.
+		chunk := `[{"type":"m.room.message","event_id":"$skipped2"},{"type":"m.room.message","event_id":"$skipped1"}]`
+		if req.URL.Query().Get("to") != "s2" {
+			chunk = `[{"type":"m.room.message","event_id":"$skipped2"},{"type":"m.room.message","event_id":"$skipped1"},{"type":"m.room.message","event_id":"$old"}]`
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"start":"p2","end":"s2","chunk":` + chunk + `}`)),
+		}, nil
+	})
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	syncer.DedupeSize = -1 // the bound alone must prevent duplicates
+	syncer.OnLimitedTimeline = func(roomID, prevBatch, since string) []Event {
+		resp, err := cli.Backfill(roomID, prevBatch, since, 100)
+		if err != nil {
+			t.Fatalf("Backfill: error, got %s", err)
+		}
+		return resp.Chunk
+	}
+	var got []string
+	syncer.OnEventType("m.room.message", func(ev *Event) { got = append(got, ev.ID) })
+
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{"!foo:bar":{"timeline":{
+		"events": [{"type": "m.room.message", "event_id": "$old", "content": {"body": "old"}}]
+	}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	res = syncResponse(t, `{"next_batch":"s3","rooms":{"join":{"!foo:bar":{"timeline":{
+		"limited": true, "prev_batch": "p2",
+		"events": [{"type": "m.room.message", "event_id": "$new", "content": {"body": "new"}}]
+	}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s2"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	want := []string{"$old", "$skipped1", "$skipped2", "$new"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("ProcessResponse: notified %v, want %v", got, want)
+	}
+}
+
+func TestDefaultSyncer_ConcurrentRoomProcessing(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	syncer.ConcurrentRoomProcessing = true
+	syncer.RoomParallelism = 2
+	var mutex sync.Mutex
+	got := make(map[string][]string)
+	syncer.OnEventType("m.room.message", func(ev *Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		got[ev.RoomID] = append(got[ev.RoomID], ev.ID)
+	})
+
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{
+		"!a:bar": {"timeline":{"events":[{"type":"m.room.message","event_id":"$a1"},{"type":"m.room.message","event_id":"$a2"}]}},
+		"!b:bar": {"timeline":{"events":[{"type":"m.room.message","event_id":"$b1"}]}},
+		"!c:bar": {"timeline":{"events":[{"type":"m.room.message","event_id":"$c1"}]}}
+	}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if len(got) != 3 || len(got["!a:bar"]) != 2 || got["!a:bar"][0] != "$a1" || got["!a:bar"][1] != "$a2" {
+		t.Fatalf("ProcessResponse: got events %v", got)
+	}
+
+	syncer.OnEventType("m.room.message", func(ev *Event) { panic("oops") })
+	res = syncResponse(t, `{"next_batch":"s3","rooms":{"join":{
+		"!a:bar": {"timeline":{"events":[{"type":"m.room.message","event_id":"$a3"}]}}
+	}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s2"}); err == nil {
+		t.Fatal("ProcessResponse: listener panicked but no error was returned")
+	}
+}
+
+func TestDefaultSyncer_OnMembershipEvent(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	var got []*MembershipEvent
+	syncer.OnMembershipEvent(func(member *MembershipEvent) { got = append(got, member) })
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{"!foo:bar":{"timeline":{"events":[
+		{"type":"m.room.member","state_key":"@carol:bar","sender":"@bob:bar","event_id":"$1",
+			"content":{"membership":"invite","displayname":"Carol","is_direct":true}},
+		{"type":"m.room.member","state_key":"@carol:bar","sender":"@bob:bar","event_id":"$2",
+			"content":{"membership":"ban"},"unsigned":{"prev_content":{"membership":"invite"}}}
+	]}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("OnMembershipEvent: got %d events, want 2", len(got))
+	}
+	want := MembershipEvent{Event: got[0].Event, RoomID: "!foo:bar", Sender: "@bob:bar", Target: "@carol:bar",
+		NewMembership: "invite", DisplayName: "Carol", IsDirect: true}
+	if *got[0] != want {
+		t.Fatalf("OnMembershipEvent: got %+v, want %+v", got[0], want)
+	}
+	if got[1].NewMembership != "ban" || got[1].PrevMembership != "invite" {
+		t.Fatalf("OnMembershipEvent: got %s -> %s, want invite -> ban", got[1].PrevMembership, got[1].NewMembership)
+	}
+}
+
+func TestDefaultSyncer_OnRoomJoinLeave(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	var joined, left []string
+	syncer.OnRoomJoin(func(roomID string) { joined = append(joined, roomID) })
+	syncer.OnRoomLeave(func(roomID, reason string) { left = append(left, roomID+" "+reason) })
+	var messages int
+	syncer.OnEventType("m.room.message", func(ev *Event) { messages++ })
+
+	// The history sent on joining a room is skipped, but the join is not.
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{"!foo:bar":{"timeline":{"events":[
+		{"type":"m.room.message","sender":"@bob:bar","event_id":"$old","content":{"body":"hi"}},
+		{"type":"m.room.member","state_key":"@alice:bar","sender":"@alice:bar","event_id":"$join",
+			"content":{"membership":"join"},"unsigned":{"prev_content":{"membership":"invite"}}}
+	]}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if len(joined) != 1 || joined[0] != "!foo:bar" || messages != 0 {
+		t.Fatalf("OnRoomJoin: got %v and %d messages, want [!foo:bar] and none", joined, messages)
+	}
+
+	res = syncResponse(t, `{"next_batch":"s3","rooms":{"join":{"!foo:bar":{"state":{"events":[
+		{"type":"m.room.member","state_key":"@alice:bar","sender":"@alice:bar","event_id":"$rename",
+			"content":{"membership":"join","displayname":"Alice"},"unsigned":{"prev_content":{"membership":"join"}}}
+	]}}},"leave":{"!baz:bar":{"timeline":{"events":[
+		{"type":"m.room.member","state_key":"@alice:bar","sender":"@bob:bar","event_id":"$kick",
+			"content":{"membership":"leave","reason":"spam"},"unsigned":{"prev_content":{"membership":"join"}}}
+	]}},"!invited:bar":{"timeline":{"events":[
+		{"type":"m.room.member","state_key":"@alice:bar","sender":"@alice:bar","event_id":"$reject",
+			"content":{"membership":"leave"},"unsigned":{"prev_content":{"membership":"invite"}}}
+	]}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s2"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if len(joined) != 1 {
+		t.Fatalf("OnRoomJoin: got %v, want a profile change to be ignored", joined)
+	}
+	if len(left) != 1 || left[0] != "!baz:bar spam" {
+		t.Fatalf("OnRoomLeave: got %v, want [!baz:bar spam]", left)
+	}
+}
+
+func TestDefaultSyncer_OnFailedSyncBackoff(t *testing.T) {
+	cli, _ := NewClient("https://test.gomatrix.org", "@alice:bar", "abcdef")
+	cli.RetryBaseDelay = time.Second
+	cli.RetryMaxDelay = 4 * time.Second
+	cli.RetryJitter = -1
+	syncer := cli.Syncer.(*DefaultSyncer)
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if got, err := syncer.OnFailedSync(context.Background(), nil, fmt.Errorf("oops")); err != nil || got != want {
+			t.Fatalf("OnFailedSync: got %s, %v, want %s", got, err, want)
+		}
+	}
+	if err := syncer.ProcessResponse(&SyncBatch{Response: syncResponse(t, `{"next_batch":"s2"}`), Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if got, _ := syncer.OnFailedSync(context.Background(), nil, fmt.Errorf("oops")); got != time.Second {
+		t.Fatalf("OnFailedSync: got %s after a successful sync, want the backoff to be reset", got)
+	}
+}
+
+func TestDefaultSyncer_OnFailedSyncRetryAfter(t *testing.T) {
+	cli, _ := NewClient("https://test.gomatrix.org", "@alice:bar", "abcdef")
+	cli.RetryBaseDelay = time.Second
+	cli.RetryJitter = -1
+	syncer := cli.Syncer.(*DefaultSyncer)
+	rateLimited := HTTPError{Code: 429, RetryAfterMS: 5000}
+	if got, _ := syncer.OnFailedSync(context.Background(), nil, rateLimited); got != 5*time.Second {
+		t.Fatalf("OnFailedSync: got %s, want the 5s the server asked for", got)
+	}
+	rateLimited.RetryAfterMS = 10
+	if got, _ := syncer.OnFailedSync(context.Background(), nil, rateLimited); got != 2*time.Second {
+		t.Fatalf("OnFailedSync: got %s, want the 2s backoff when the server asks for less", got)
+	}
+}
+
+func TestDefaultSyncer_OnProcessPanic(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	var got []string
+	syncer.OnEventType("m.room.message", func(ev *Event) {
+		if strings.HasPrefix(ev.ID, "$bad") {
+			panic("oops")
+		}
+		got = append(got, ev.ID)
+	})
+	var recovered interface{}
+	syncer.OnProcessPanic = func(r interface{}, stack []byte) error {
+		recovered = r
+		if len(stack) == 0 {
+			t.Errorf("OnProcessPanic: got an empty stack trace")
+		}
+		return nil
+	}
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{"!a:bar":{"timeline":{"events":[
+		{"type":"m.room.message","event_id":"$bad"},{"type":"m.room.message","event_id":"$skipped"}
+	]}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if recovered != "oops" || len(got) != 0 {
+		t.Fatalf("ProcessResponse: recovered %v and notified %v, want oops and nothing", recovered, got)
+	}
+	res = syncResponse(t, `{"next_batch":"s3","rooms":{"join":{"!a:bar":{"timeline":{"events":[
+		{"type":"m.room.message","event_id":"$good"}
+	]}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s2"}); err != nil || len(got) != 1 {
+		t.Fatalf("ProcessResponse: got %v, %v after skipping a batch, want [$good]", err, got)
+	}
+
+	syncer.OnProcessPanic = func(r interface{}, stack []byte) error { return fmt.Errorf("stop: %v", r) }
+	res = syncResponse(t, `{"next_batch":"s4","rooms":{"join":{"!a:bar":{"timeline":{"events":[
+		{"type":"m.room.message","event_id":"$bad2"}
+	]}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s3"}); err == nil || err.Error() != "stop: oops" {
+		t.Fatalf("ProcessResponse: got %v, want the error from OnProcessPanic", err)
+	}
+}
+
+func TestDefaultSyncer_DedupeSize(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	syncer.DedupeSize = 2
+	var got []string
+	syncer.OnEventType("m.room.message", func(ev *Event) { got = append(got, ev.ID) })
+	if err := syncer.ProcessResponse(&SyncBatch{Response: syncResponse(t, initialSyncJSON)}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+
+	timeline := func(next string, ids ...string) *RespSync {
+		var events []string
+		for _, id := range ids {
+			events = append(events, `{"type":"m.room.message","event_id":"`+id+`"}`)
+		}
+		return syncResponse(t, `{"next_batch":"`+next+`","rooms":{"join":{"!foo:bar":{"timeline":{"events":[`+
+			strings.Join(events, ",")+`]}}}}}`)
+	}
+	// $msg was in the initial sync, and $1 is repeated within and across batches.
+	for i, res := range []*RespSync{timeline("s2", "$msg", "$1", "$1"), timeline("s3", "$2", "$1"), timeline("s4", "$3", "$1", "$msg")} {
+		if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: fmt.Sprintf("s%d", i+1)}); err != nil {
+			t.Fatalf("ProcessResponse: error, got %s", err)
+		}
+	}
+	// Only 2 IDs are remembered, so $msg has been evicted by the time it is sent again.
+	if want := []string{"$1", "$2", "$3", "$msg"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("ProcessResponse: notified %v, want %v", got, want)
+	}
+
+	syncer = NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	syncer.DedupeSize = -1
+	got = nil
+	syncer.OnEventType("m.room.message", func(ev *Event) { got = append(got, ev.ID) })
+	if err := syncer.ProcessResponse(&SyncBatch{Response: timeline("s2", "$1", "$1"), Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("ProcessResponse: notified %v with deduplication disabled, want [$1 $1]", got)
+	}
+}
+
+func TestDefaultSyncer_IgnoreOwnEvents(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	syncer.IgnoreOwnEvents = true
+	var got []string
+	syncer.OnEventType("m.room.message", func(ev *Event) { got = append(got, ev.ID) })
+	syncer.OnEventType("m.room.topic", func(ev *Event) { got = append(got, ev.ID) })
+
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{"!foo:bar":{
+		"state":{"events":[{"type":"m.room.topic","state_key":"","sender":"@alice:bar","event_id":"$topic","content":{"topic":"mine"}}]},
+		"timeline":{"events":[
+			{"type":"m.room.message","sender":"@alice:bar","event_id":"$own"},
+			{"type":"m.room.message","sender":"@bob:bar","event_id":"$other"}
+		]}
+	}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if len(got) != 1 || got[0] != "$other" {
+		t.Fatalf("ProcessResponse: notified %v, want [$other]", got)
+	}
+	if topic := syncer.Store.LoadRoom("!foo:bar").GetStateEvent("m.room.topic", ""); topic == nil {
+		t.Fatalf("ProcessResponse: own state event was not applied to the room")
+	}
+}
+
+func TestDefaultSyncer_WaitForEvent(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	isReply := func(ev *Event) bool {
+		body, _ := ev.Body()
+		return ev.Sender == "@bob:bar" && body == "pong"
+	}
+
+	type result struct {
+		event *Event
+		err   error
+	}
+	results := make(chan result)
+	waiting := func() int {
+		syncer.waitersMutex.Lock()
+		defer syncer.waitersMutex.Unlock()
+		return len(syncer.waiters)
+	}
+	go func() {
+		event, err := syncer.WaitForEvent(context.Background(), "!foo:bar", isReply)
+		results <- result{event, err}
+	}()
+	for waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{
+		"!other:bar": {"timeline":{"events":[{"type":"m.room.message","sender":"@bob:bar","event_id":"$wrongroom","content":{"body":"pong"}}]}},
+		"!foo:bar": {"timeline":{"events":[
+			{"type":"m.room.message","sender":"@bob:bar","event_id":"$ping","content":{"body":"ping"}},
+			{"type":"m.room.message","sender":"@bob:bar","event_id":"$pong","content":{"body":"pong"}},
+			{"type":"m.room.message","sender":"@bob:bar","event_id":"$pong2","content":{"body":"pong"}}
+		]}}
+	}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	select {
+	case r := <-results:
+		if r.err != nil || r.event.ID != "$pong" {
+			t.Fatalf("WaitForEvent: got %v, %v, want $pong", r.event, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForEvent: did not return after a matching event")
+	}
+	if n := waiting(); n != 0 {
+		t.Fatalf("WaitForEvent: left %d waiters registered", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := syncer.WaitForEvent(ctx, "", isReply); err != context.DeadlineExceeded {
+		t.Fatalf("WaitForEvent: got error %v, want context.DeadlineExceeded", err)
+	}
+	if n := waiting(); n != 0 {
+		t.Fatalf("WaitForEvent: left %d waiters registered after the context expired", n)
+	}
+}
+
+func TestDefaultSyncer_PreEventPostEvent(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	syncer.PreEvent = func(ev *Event) bool { return ev.Sender != "@spammer:bar" }
+	type post struct {
+		id  string
+		err error
+	}
+	var posts []post
+	syncer.PostEvent = func(ev *Event, err error) { posts = append(posts, post{ev.ID, err}) }
+	var notified []string
+	syncer.OnEventType("m.room.message", func(ev *Event) { notified = append(notified, ev.ID) })
+	errBadCommand := fmt.Errorf("bad command")
+	syncer.OnEventTypeErr("m.room.message", func(ev *Event) error {
+		if body, _ := ev.Body(); body == "!bad" {
+			return errBadCommand
+		}
+		return nil
+	})
+
+	res := syncResponse(t, `{"next_batch":"s2","rooms":{"join":{"!foo:bar":{"timeline":{"events":[
+		{"type":"m.room.message","sender":"@bob:bar","event_id":"$good","content":{"body":"hi"}},
+		{"type":"m.room.message","sender":"@spammer:bar","event_id":"$spam","content":{"body":"buy"}},
+		{"type":"m.room.message","sender":"@bob:bar","event_id":"$bad","content":{"body":"!bad"}},
+		{"type":"m.room.topic","state_key":"","sender":"@bob:bar","event_id":"$topic","content":{"topic":"t"}}
+	]}}}}}`)
+	if err := syncer.ProcessResponse(&SyncBatch{Response: res, Since: "s1"}); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	if strings.Join(notified, " ") != "$good $bad" {
+		t.Fatalf("ProcessResponse: notified %v, want [$good $bad]", notified)
+	}
+	want := []post{{"$good", nil}, {"$bad", errBadCommand}, {"$topic", nil}}
+	if len(posts) != len(want) {
+		t.Fatalf("PostEvent: got %v, want %v", posts, want)
+	}
+	for i := range want {
+		if posts[i] != want[i] {
+			t.Fatalf("PostEvent: got %v, want %v", posts, want)
+		}
+	}
+}
+
+func TestDefaultSyncer_EventQueueSize(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	syncer.EventQueueSize = 1
+	block := make(chan struct{})
+	got := make(chan string, 10)
+	syncer.OnEventType("m.room.message", func(ev *Event) {
+		<-block
+		got <- ev.ID
+	})
+
+	// The listener is blocked, so at most one event can be in the listener and one in the queue.
+	ids := []string{"$1", "$2", "$3", "$4", "$5"}
+	for _, id := range ids {
+		syncer.notifyListeners(&Event{Type: "m.room.message", ID: id})
+	}
+	close(block)
+	received := 0
+	for id := range got {
+		received++
+		if id == "$5" {
+			break
+		}
+	}
+	dropped := atomic.LoadUint64(&syncer.DroppedEvents)
+	if dropped < 3 || received+int(dropped) != len(ids) {
+		t.Fatalf("EventQueueSize: received %d events and dropped %d, want %d in total with at least 3 dropped", received, dropped, len(ids))
+	}
+}
+
+func TestDefaultSyncer_EventQueueConcurrentListeners(t *testing.T) {
+	syncer := NewDefaultSyncer("@alice:bar", NewInMemoryStore())
+	syncer.EventQueueSize = 100
+	var calls int32
+	syncer.OnEventType("m.room.message", func(ev *Event) {
+		atomic.AddInt32(&calls, 1)
+	})
+
+	// Register listeners while the queue's goroutine is delivering events. Run with -race to detect unguarded access.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			syncer.OnEventType("m.room.message", func(ev *Event) {})
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		syncer.notifyListeners(&Event{Type: "m.room.message", ID: fmt.Sprintf("$%d", i)})
+	}
+	<-done
+	if err := syncer.Close(); err != nil {
+		t.Fatalf("Close: got %v, want nil", err)
+	}
+	// The queue is drained before its goroutine exits, so wait for the remaining events to be delivered.
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&calls) != 50 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 50 {
+		t.Fatalf("EventQueueSize: first listener called %d times, want 50", n)
+	}
+	// Events after Close get a new queue.
+	syncer.notifyListeners(&Event{Type: "m.room.message", ID: "$after"})
+	deadline = time.Now().Add(time.Second)
+	for atomic.LoadInt32(&calls) != 51 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 51 {
+		t.Fatalf("Close: first listener called %d times after a new event, want 51", n)
+	}
+}
@@ -0,0 +1,125 @@
+package gomatrix
+
+import (
+	"sync"
+	"time"
+)
+
+// SyncError is sent on SyncManager.Errors when a client's Sync returns a fatal error.
+type SyncError struct {
+	Client *Client
+	Err    error
+}
+
+// SyncManager runs the sync loops of many clients, e.g. the users of an application service, restarting
+// each client's Sync with jittered exponential backoff when it fails.
+type SyncManager struct {
+	MinBackoff time.Duration // The wait before restarting a failed Sync. Defaults to 1 second.
+	MaxBackoff time.Duration // The maximum wait before restarting a failed Sync. Defaults to 5 minutes.
+
+	mutex   sync.Mutex // protects clients, running and stop
+	clients []*Client
+	running bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	errors  chan SyncError
+}
+
+// NewSyncManager returns a SyncManager with no clients. Errors are buffered up to errorBufferSize; when the
+// buffer is full, further errors are dropped rather than blocking the sync loops.
+func NewSyncManager(errorBufferSize int) *SyncManager {
+	return &SyncManager{
+		MinBackoff: time.Second,
+		MaxBackoff: 5 * time.Minute,
+		errors:     make(chan SyncError, errorBufferSize),
+	}
+}
+
+// Errors returns the channel on which fatal sync errors from every client are sent.
+func (m *SyncManager) Errors() <-chan SyncError {
+	return m.errors
+}
+
+// Add adds a client to the manager. If the manager is running, the client starts syncing immediately.
+func (m *SyncManager) Add(cli *Client) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.clients = append(m.clients, cli)
+	if m.running {
+		m.startClient(cli)
+	}
+}
+
+// Start starts syncing every client. It does nothing if the manager is already running.
+func (m *SyncManager) Start() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.running {
+		return
+	}
+	m.running = true
+	m.stop = make(chan struct{})
+	for _, cli := range m.clients {
+		m.startClient(cli)
+	}
+}
+
+// Stop stops every client's sync loop and waits for them to exit. As a sync loop only notices that it has been
+// stopped when its current /sync request returns, this can block for up to the /sync long-poll timeout.
+func (m *SyncManager) Stop() {
+	m.mutex.Lock()
+	if !m.running {
+		m.mutex.Unlock()
+		return
+	}
+	m.running = false
+	close(m.stop)
+	for _, cli := range m.clients {
+		cli.StopSync()
+	}
+	m.mutex.Unlock()
+	m.wg.Wait()
+}
+
+// startClient must be called with the mutex held.
+func (m *SyncManager) startClient(cli *Client) {
+	m.wg.Add(1)
+	go m.syncLoop(cli, m.stop)
+}
+
+func (m *SyncManager) syncLoop(cli *Client, stop chan struct{}) {
+	defer m.wg.Done()
+	retry := backoff{base: m.MinBackoff, max: m.MaxBackoff, jitter: defaultRetryJitter}
+	attempt := 0
+	for {
+		// Claim the syncing ID while holding the mutex, so that Stop cannot miss a restarted Sync.
+		m.mutex.Lock()
+		select {
+		case <-stop:
+			m.mutex.Unlock()
+			return
+		default:
+		}
+		syncingID, ctx := cli.incrementSyncingID()
+		m.mutex.Unlock()
+
+		started := time.Now()
+		err := cli.sync(ctx, syncingID)
+		if err == nil { // StopSync was called, or another Sync was started for this client
+			return
+		}
+		select {
+		case m.errors <- SyncError{Client: cli, Err: err}:
+		default:
+		}
+		if time.Since(started) > m.MaxBackoff { // the client synced successfully for a while
+			attempt = 0
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(retry.duration(attempt)):
+		}
+		attempt++
+	}
+}
@@ -0,0 +1,42 @@
+package gomatrix
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSyncManager_Errors(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNKNOWN","error":"oops"}`)),
+		}, nil
+	})
+	m := NewSyncManager(1)
+	m.MinBackoff = time.Hour
+	m.Add(cli)
+	m.Start()
+
+	select {
+	case syncErr := <-m.Errors():
+		if syncErr.Client != cli || syncErr.Err == nil {
+			t.Fatalf("Errors: got %+v", syncErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Errors: timed out waiting for a sync error")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop: timed out waiting for sync loops to exit")
+	}
+}
@@ -0,0 +1,228 @@
+package gomatrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file contains a minimal YAML reader which is just capable enough to read Application Service
+// registration files, so that gomatrix does not need to depend on a full YAML library. It supports
+// block mappings and sequences, plain and quoted scalars, flow sequences of scalars and comments.
+// Anchors, multi-line strings and flow mappings are not supported.
+
+type yamlLine struct {
+	num    int    // 1-indexed line number, for errors
+	indent int    // number of leading spaces
+	text   string // the line without indentation or comments
+}
+
+// unmarshalYAML decodes the YAML document in data into v, using v's JSON struct tags.
+func unmarshalYAML(data []byte, v interface{}) error {
+	lines, err := splitYAMLLines(string(data))
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if len(lines) > 0 {
+		var next int
+		doc, next, err = parseYAMLNode(lines, 0, lines[0].indent)
+		if err != nil {
+			return err
+		}
+		if next < len(lines) {
+			return fmt.Errorf("yaml: line %d: unexpected indentation", lines[next].num)
+		}
+	}
+	j, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+func splitYAMLLines(data string) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n") {
+		if strings.HasPrefix(raw, "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs are not allowed for indentation", i+1)
+		}
+		text := strings.TrimRight(stripYAMLComment(raw), " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{i + 1, len(text) - len(trimmed), trimmed})
+	}
+	return lines, nil
+}
+
+// stripYAMLComment removes a trailing "# comment" which is not inside a quoted string.
+func stripYAMLComment(s string) string {
+	var quote rune
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// parseYAMLNode parses the block starting at lines[i], which must be at the given indent. It returns
+// the parsed value and the index of the first line after the block.
+func parseYAMLNode(lines []yamlLine, i, indent int) (interface{}, int, error) {
+	if isYAMLSeqItem(lines[i].text) {
+		return parseYAMLSequence(lines, i, indent)
+	}
+	return parseYAMLMapping(lines, i, indent)
+}
+
+func parseYAMLMapping(lines []yamlLine, i, indent int) (interface{}, int, error) {
+	m := make(map[string]interface{})
+	for i < len(lines) && lines[i].indent == indent && !isYAMLSeqItem(lines[i].text) {
+		key, rest, ok := splitYAMLKey(lines[i].text)
+		if !ok {
+			return nil, i, fmt.Errorf("yaml: line %d: expected a key", lines[i].num)
+		}
+		i++
+		if rest != "" {
+			value, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, i, fmt.Errorf("yaml: line %d: %s", lines[i-1].num, err)
+			}
+			m[key] = value
+			continue
+		}
+		var value interface{}
+		if i < len(lines) && (lines[i].indent > indent || (lines[i].indent == indent && isYAMLSeqItem(lines[i].text))) {
+			var err error
+			if value, i, err = parseYAMLNode(lines, i, lines[i].indent); err != nil {
+				return nil, i, err
+			}
+		}
+		m[key] = value
+	}
+	return m, i, nil
+}
+
+func parseYAMLSequence(lines []yamlLine, i, indent int) (interface{}, int, error) {
+	seq := []interface{}{}
+	for i < len(lines) && lines[i].indent == indent && isYAMLSeqItem(lines[i].text) {
+		item := strings.TrimLeft(strings.TrimPrefix(lines[i].text, "-"), " ")
+		if item == "" {
+			i++
+			var value interface{}
+			if i < len(lines) && lines[i].indent > indent {
+				var err error
+				if value, i, err = parseYAMLNode(lines, i, lines[i].indent); err != nil {
+					return nil, i, err
+				}
+			}
+			seq = append(seq, value)
+			continue
+		}
+		if _, _, isMapping := splitYAMLKey(item); isMapping {
+			// "- key: value" starts a mapping whose keys are aligned with "key".
+			itemIndent := indent + len(lines[i].text) - len(item)
+			lines[i] = yamlLine{lines[i].num, itemIndent, item}
+			value, next, err := parseYAMLMapping(lines, i, itemIndent)
+			if err != nil {
+				return nil, next, err
+			}
+			seq = append(seq, value)
+			i = next
+			continue
+		}
+		value, err := parseYAMLScalar(item)
+		if err != nil {
+			return nil, i, fmt.Errorf("yaml: line %d: %s", lines[i].num, err)
+		}
+		seq = append(seq, value)
+		i++
+	}
+	return seq, i, nil
+}
+
+// splitYAMLKey splits "key: value" into its key and value. ok is false if the text is not a mapping entry.
+func splitYAMLKey(text string) (key, rest string, ok bool) {
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 {
+			return "", "", false
+		}
+		quoted, after := text[:end+2], text[end+2:]
+		if after != ":" && !strings.HasPrefix(after, ": ") {
+			return "", "", false
+		}
+		unquoted, err := parseYAMLScalar(quoted)
+		if err != nil {
+			return "", "", false
+		}
+		return unquoted.(string), strings.TrimSpace(after[1:]), true
+	}
+	if strings.HasSuffix(text, ":") {
+		return text[:len(text)-1], "", true
+	}
+	idx := strings.Index(text, ": ")
+	if idx < 0 {
+		return "", "", false
+	}
+	return text[:idx], strings.TrimSpace(text[idx+2:]), true
+}
+
+func parseYAMLScalar(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "["):
+		return parseYAMLFlowSequence(s)
+	}
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	return s, nil
+}
+
+func parseYAMLFlowSequence(s string) (interface{}, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated flow sequence %s", s)
+	}
+	seq := []interface{}{}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	if inner == "" {
+		return seq, nil
+	}
+	for _, item := range strings.Split(inner, ",") {
+		value, err := parseYAMLScalar(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, value)
+	}
+	return seq, nil
+}